@@ -0,0 +1,87 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/spf13/cobra"
+)
+
+var (
+	dbCmd = &cobra.Command{
+		Use:   "db",
+		Short: "Maintain the sqlite database",
+	}
+	dbRepairCmd = &cobra.Command{
+		Use:   "repair",
+		Short: "Fix common issues with the db and compact it",
+		Long: "Remove rows that refer to rows that don't exist and nodes without any addresses, rebuild the " +
+			"indexes, refresh the query planner statistics and vacuum the db file to reclaim unused space. " +
+			"Vacuuming rewrites the entire db, so stop the crawler first for large databases.",
+		Run: startDBRepair,
+	}
+	dbFlags = struct {
+		DB     string
+		DryRun bool
+	}{}
+)
+
+func init() {
+	dbCmd.PersistentFlags().StringVar(&dbFlags.DB, "db", "", "the sqlite database file to use")
+	dbCmd.MarkPersistentFlagRequired("db")
+	dbRepairCmd.Flags().BoolVar(&dbFlags.DryRun, "dry-run", false, "only print the rows that would be removed")
+
+	dbCmd.AddCommand(dbRepairCmd)
+	Root.AddCommand(dbCmd)
+}
+
+func startDBRepair(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	db.RegisterPragmaHook(100000, "normal")
+	if err := db.CheckDir(dbFlags.DB, false); err != nil {
+		exitWithError(fmt.Sprintf("open db: %s", err))
+		return
+	}
+
+	readConn, writeConn, err := db.OpenReadWrite(ctx, dbFlags.DB, db.OpenOptions{})
+	if err != nil {
+		exitWithError(fmt.Sprintf("open db: %s", err))
+		return
+	}
+	defer writeConn.Close()
+	readConn.Close()
+
+	report, err := db.Repair(ctx, writeConn, dbFlags.DryRun)
+	if err != nil {
+		exitWithError(fmt.Sprintf("repair db: %s", err))
+		return
+	}
+
+	fmt.Print(formatRepairReport(report, dbFlags.DryRun))
+}
+
+// formatRepairReport prints a line for every action of the given report.
+func formatRepairReport(report *db.RepairReport, dryRun bool) string {
+	var res string
+	for _, action := range report.Actions {
+		switch {
+		case action.Skipped:
+			res += fmt.Sprintf("%s: skipped\n", action.Name)
+		case action.Name == db.RepairActionVacuum:
+			res += fmt.Sprintf("%s: reclaimed %d bytes\n", action.Name, report.FreeBytes)
+		case action.Name == db.RepairActionReindex || action.Name == db.RepairActionAnalyze:
+			res += fmt.Sprintf("%s: done\n", action.Name)
+		case dryRun:
+			res += fmt.Sprintf("%s: would remove %d rows\n", action.Name, action.Rows)
+		default:
+			res += fmt.Sprintf("%s: removed %d rows\n", action.Name, action.Rows)
+		}
+	}
+	return res
+}
@@ -0,0 +1,80 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/config"
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/2mf/ToxStatus/internal/diagnose"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diagnoseCmd = &cobra.Command{
+		Use:   "diagnose",
+		Short: "Run a series of self-diagnostic checks",
+		Long: "Check the db, connectivity to the bootstrap node list, whether the Tox UDP socket can be bound " +
+			"and the available disk space. Exits with a non-zero status if any of the checks fail.",
+		Run: startDiagnose,
+	}
+	diagnoseFlags = struct {
+		Config       config.Config
+		MinFreeSpace uint64
+		MaxDBSize    int64
+	}{}
+)
+
+func init() {
+	diagnoseCmd.Flags().StringVar(&diagnoseFlags.Config.DB, "db", "", "the sqlite database file to use")
+	diagnoseCmd.Flags().StringVar(&diagnoseFlags.Config.ToxUDPAddr, "tox-udp-addr", ":33450", "the UDP network address to listen on for Tox")
+	diagnoseCmd.Flags().DurationVar(&diagnoseFlags.Config.HTTPClientTimeout, "http-client-timeout", 10*time.Second, "the http client timeout for requests to nodes.tox.chat")
+	diagnoseCmd.Flags().StringVar(&diagnoseFlags.Config.BootstrapURL, "bootstrap-url", "", "the URL of the nodes.tox.chat-compatible JSON list to fetch bootstrap nodes from (default: https://nodes.tox.chat/json)")
+	diagnoseCmd.Flags().StringVar(&diagnoseFlags.Config.BootstrapCACert, "bootstrap-ca-cert", "", "a PEM file with the CA certificate(s) to verify the bootstrap URL against, instead of the system CAs")
+	diagnoseCmd.Flags().Uint64Var(&diagnoseFlags.MinFreeSpace, "min-free-space", 100, "the minimum amount of free disk space for the db (in MB)")
+	diagnoseCmd.Flags().Int64Var(&diagnoseFlags.MaxDBSize, "max-db-size", 0, "the maximum size of the db (in MB). No limit by default")
+	diagnoseCmd.MarkFlagRequired("db")
+
+	Root.AddCommand(diagnoseCmd)
+}
+
+func startDiagnose(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	cfg := &diagnoseFlags.Config
+	db.RegisterPragmaHook(100000, "normal")
+	tsClient, err := newBootstrapClient(cfg)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+
+	checks := []diagnose.Check{
+		&diagnose.DBCheck{File: cfg.DB},
+		&diagnose.BootstrapCheck{Client: tsClient},
+		&diagnose.UDPBindCheck{Addr: cfg.ToxUDPAddr},
+		&diagnose.DiskSpaceCheck{File: cfg.DB, MinFree: diagnoseFlags.MinFreeSpace << 20},
+	}
+	if diagnoseFlags.MaxDBSize > 0 {
+		checks = append(checks, &diagnose.DBSizeCheck{File: cfg.DB, MaxSize: diagnoseFlags.MaxDBSize << 20})
+	}
+
+	var failed bool
+	for _, res := range diagnose.Run(ctx, checks) {
+		if res.Err != nil {
+			failed = true
+			fmt.Printf("FAIL  %s: %s\n", res.Check.Name(), res.Err)
+		} else {
+			fmt.Printf("PASS  %s\n", res.Check.Name())
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
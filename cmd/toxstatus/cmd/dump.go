@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/crawler"
+)
+
+// defaultDumpFile returns the file that state dumps are written to if no file
+// was configured.
+func defaultDumpFile() string {
+	return fmt.Sprintf("toxstatus-dump-%d.log", os.Getpid())
+}
+
+// writeStateDump appends a snapshot of the in-memory state of the given crawler
+// to the given file.
+func writeStateDump(cr *crawler.Crawler, file string) error {
+	f, err := os.OpenFile(file, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	fmt.Fprintf(f, "### ToxStatus state dump at %s (pid %d)\n\n", time.Now().UTC().Format(time.RFC3339), os.Getpid())
+	if err := cr.DumpState(f); err != nil {
+		return err
+	}
+	fmt.Fprintln(f)
+
+	return f.Close()
+}
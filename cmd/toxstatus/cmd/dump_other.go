@@ -0,0 +1,8 @@
+//go:build !unix
+
+package cmd
+
+import "os"
+
+// There's no SIGUSR1 on this platform, so state dumps can't be triggered
+func notifyDumpSignal(c chan<- os.Signal) {}
@@ -0,0 +1,15 @@
+//go:build unix
+
+package cmd
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumpSignal relays SIGUSR1, the signal that triggers a state dump, to
+// the given channel.
+func notifyDumpSignal(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
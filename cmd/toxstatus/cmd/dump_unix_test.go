@@ -0,0 +1,56 @@
+//go:build unix
+
+package cmd
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/crawler"
+	"github.com/2mf/ToxStatus/internal/repo/mock"
+)
+
+func TestStateDumpSignal(t *testing.T) {
+	cr, err := crawler.New(new(mock.MockNodeRepository), crawler.CrawlerOptions{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Workers: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dumpChan := make(chan os.Signal, 1)
+	notifyDumpSignal(dumpChan)
+	defer signal.Stop(dumpChan)
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGUSR1); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-dumpChan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for SIGUSR1")
+	}
+
+	file := filepath.Join(t.TempDir(), "dump.log")
+	if err := writeStateDump(cr, file); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, section := range []string{"== Crawler ==", "== Queues ==", "== Probes ==", "== Recent probe results =="} {
+		if !strings.Contains(string(data), section) {
+			t.Fatalf("section %q missing from dump:\n%s", section, data)
+		}
+	}
+}
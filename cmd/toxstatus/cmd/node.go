@@ -0,0 +1,585 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+	"unicode/utf8"
+
+	"github.com/2mf/ToxStatus/internal/config"
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/toxstatus"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/maps"
+)
+
+var (
+	nodeCmd = &cobra.Command{
+		Use:   "node",
+		Short: "Manage the nodes in the db",
+	}
+	nodeDeduplicateCmd = &cobra.Command{
+		Use:   "deduplicate",
+		Short: "Merge nodes that share the same network address",
+		Long: "Look for network addresses that are tracked for more than one node. For each of those, " +
+			"only the address with the most probe history is kept. The others are deleted, along with " +
+			"their nodes if they have no addresses left.",
+		Run: startNodeDeduplicate,
+	}
+	nodeCleanCmd = &cobra.Command{
+		Use:   "clean",
+		Short: "Remove invalid nodes from the db",
+		Long: "Remove node addresses that fail validation, because of an invalid public key or an unroutable IP " +
+			"address, along with their nodes if they have no addresses left.",
+		Run: startNodeClean,
+	}
+	nodeImportCmd = &cobra.Command{
+		Use:   "import",
+		Short: "Import the nodes from a list of bootstrap nodes into the db",
+		Long: "Fetch the list of bootstrap nodes from the given source and track all of them in the db, " +
+			"without starting the crawler.",
+		Run: startNodeImport,
+	}
+	nodeAgeReportCmd = &cobra.Command{
+		Use:   "age-report",
+		Short: "Show how long the nodes in the db have been known",
+		Long: "Group the nodes in the db by the time since they were first tracked and print a histogram. " +
+			"This gives an idea of the churn rate of the network.",
+		Run: startNodeAgeReport,
+	}
+	nodeChurnCmd = &cobra.Command{
+		Use:   "churn",
+		Short: "Show the node turnover rate over time",
+		Long: "For each window of the given period, count the nodes that were first seen and the nodes that were " +
+			"last seen in it. The churn rate of a window is (new + lost) / total, where total is the number of " +
+			"nodes known during the window.",
+		Run: startNodeChurn,
+	}
+	nodeFirstSeenReportCmd = &cobra.Command{
+		Use:   "first-seen-report",
+		Short: "Show how many new nodes joined the network over time",
+		Long: "Divide the given period, ending now, into the given number of buckets and count the nodes that " +
+			"were first tracked in each of them. The counts are printed as a histogram, or as JSON.",
+		Run: startNodeFirstSeenReport,
+	}
+	nodeCapabilityMatrixCmd = &cobra.Command{
+		Use:   "capability-matrix",
+		Short: "Show the number of nodes with each capability, by status",
+		Long: "Count the nodes that are reachable over UDP, TCP, IPv4 and IPv6, split up by whether they're up, " +
+			"down or haven't been probed yet (unknown), along with the percentage of all nodes that have each " +
+			"capability.",
+		Run: startNodeCapabilityMatrix,
+	}
+	nodeCountCmd = &cobra.Command{
+		Use:   "count",
+		Short: "Print the number of nodes in the db",
+		Long:  "Print the number of nodes in the db that match the given filters, for use in monitoring scripts.",
+		Run:   startNodeCount,
+	}
+	nodeFindSimilarCmd = &cobra.Command{
+		Use:   "find-similar",
+		Short: "Find the nodes that are most similar to a given node",
+		Long: "Rank the nodes in the db by the number of attributes they have in common with the given node: " +
+			"the bootstrap node version, the MOTD, the set of transports and the network (IPv4 /24 or IPv6 /48) " +
+			"of their addresses. This helps to find clusters of nodes run by the same operator.",
+		Run: startNodeFindSimilar,
+	}
+	nodeFlags = struct {
+		DB                string
+		DryRun            bool
+		ReservedPorts     bool
+		Source            string
+		HTTPClientTimeout time.Duration
+		Buckets           []string
+		Period            string
+		Windows           int
+		Window            string
+		BucketCount       int
+		JSON              bool
+		Key               string
+		Limit             int
+		Status            string
+	}{}
+)
+
+func init() {
+	nodeCmd.PersistentFlags().StringVar(&nodeFlags.DB, "db", "", "the sqlite database file to use")
+	nodeCmd.MarkPersistentFlagRequired("db")
+	nodeDeduplicateCmd.Flags().BoolVar(&nodeFlags.DryRun, "dry-run", false, "only print the merges that would be done")
+
+	nodeCleanCmd.Flags().BoolVar(&nodeFlags.DryRun, "dry-run", false, "only print what would be removed")
+	nodeCleanCmd.Flags().BoolVar(&nodeFlags.ReservedPorts, "reserved-ports", false, "also remove node addresses with a port below 1024")
+	nodeImportCmd.Flags().StringVar(&nodeFlags.Source, "source", "nodes.tox.chat", "the source to import nodes from: nodes.tox.chat or the URL of a compatible JSON list")
+	nodeImportCmd.Flags().DurationVar(&nodeFlags.HTTPClientTimeout, "http-client-timeout", 10*time.Second, "the http client timeout for requests to the source")
+	nodeAgeReportCmd.Flags().StringSliceVar(&nodeFlags.Buckets, "buckets", []string{"7d", "30d", "90d", "180d"}, "the upper bounds of the age buckets, in ascending order. A \"d\" suffix means days")
+	nodeChurnCmd.Flags().StringVar(&nodeFlags.Period, "period", "7d", "the length of each window. A \"d\" suffix means days")
+	nodeChurnCmd.Flags().IntVar(&nodeFlags.Windows, "windows", 12, "the number of windows to report, ending now")
+	nodeFirstSeenReportCmd.Flags().StringVar(&nodeFlags.Window, "period", "30d", "the length of time to report on, ending now. A \"d\" suffix means days")
+	nodeFirstSeenReportCmd.Flags().IntVar(&nodeFlags.BucketCount, "buckets", 6, "the number of buckets to divide the period into")
+	nodeFirstSeenReportCmd.Flags().BoolVar(&nodeFlags.JSON, "json", false, "print the buckets as JSON instead of a histogram")
+	nodeCountCmd.Flags().StringVar(&nodeFlags.Status, "status", "", "only count nodes with the given status: "+strings.Join(repo.NodeStatuses, " or "))
+	nodeFindSimilarCmd.Flags().StringVar(&nodeFlags.Key, "key", "", "the public key of the node to compare against")
+	nodeFindSimilarCmd.MarkFlagRequired("key")
+	nodeFindSimilarCmd.Flags().IntVar(&nodeFlags.Limit, "limit", 10, "the maximum number of nodes to list")
+
+	nodeCmd.AddCommand(nodeAgeReportCmd)
+	nodeCmd.AddCommand(nodeCapabilityMatrixCmd)
+	nodeCmd.AddCommand(nodeChurnCmd)
+	nodeCmd.AddCommand(nodeCleanCmd)
+	nodeCmd.AddCommand(nodeCountCmd)
+	nodeCmd.AddCommand(nodeDeduplicateCmd)
+	nodeCmd.AddCommand(nodeFindSimilarCmd)
+	nodeCmd.AddCommand(nodeFirstSeenReportCmd)
+	nodeCmd.AddCommand(nodeImportCmd)
+	Root.AddCommand(nodeCmd)
+}
+
+func startNodeDeduplicate(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	var results []*repo.MergeResult
+	if nodeFlags.DryRun {
+		results, err = nodesRepo.FindDuplicates(ctx)
+	} else {
+		results, err = nodesRepo.FindAndMergeDuplicates(ctx)
+	}
+	if err != nil {
+		exitWithError(fmt.Sprintf("deduplicate nodes: %s", err))
+		return
+	}
+
+	verb := "Removed"
+	if nodeFlags.DryRun {
+		verb = "Would remove"
+	}
+	for _, res := range results {
+		addr := net.JoinHostPort(res.Kept.IP, strconv.Itoa(res.Kept.Port))
+		fmt.Printf("%s %s: keeping %s\n", res.Kept.Net, addr, res.Kept.Node.PublicKey)
+		for _, removed := range res.Removed {
+			fmt.Printf("  %s %s\n", verb, removed.Node.PublicKey)
+		}
+	}
+	fmt.Printf("Found %d duplicate addresses\n", len(results))
+}
+
+func startNodeClean(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	report, err := nodesRepo.CleanInvalidNodes(ctx, repo.CleanOptions{
+		DryRun:        nodeFlags.DryRun,
+		ReservedPorts: nodeFlags.ReservedPorts,
+	})
+	if err != nil {
+		exitWithError(fmt.Sprintf("clean nodes: %s", err))
+		return
+	}
+
+	verb := "Removed"
+	if nodeFlags.DryRun {
+		verb = "Would remove"
+	}
+	reasons := maps.Keys(report.Addresses)
+	slices.Sort(reasons)
+	for _, reason := range reasons {
+		fmt.Printf("%s %d node addresses: %s\n", verb, report.Addresses[reason], reason)
+	}
+	fmt.Printf("%s %d nodes without any addresses left\n", verb, report.Nodes)
+}
+
+func startNodeImport(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	cfg := &config.Config{HTTPClientTimeout: nodeFlags.HTTPClientTimeout}
+	if nodeFlags.Source != "nodes.tox.chat" {
+		if u, err := url.Parse(nodeFlags.Source); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			exitWithError(fmt.Sprintf("bad source: %s", nodeFlags.Source))
+			return
+		}
+		cfg.BootstrapURL = nodeFlags.Source
+	}
+
+	tsClient, err := newBootstrapClient(cfg)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	tsClient.IncludeOfflineNodes = true
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	total, added, err := importNodes(ctx, nodesRepo, tsClient)
+	if err != nil {
+		exitWithError(fmt.Sprintf("import nodes: %s", err))
+		return
+	}
+
+	fmt.Printf("Imported %d nodes from %s (%d new)\n", total, nodeFlags.Source, added)
+}
+
+func startNodeAgeReport(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	var bounds []time.Duration
+	for _, s := range nodeFlags.Buckets {
+		bound, err := parseAge(s)
+		if err != nil {
+			exitWithError(fmt.Sprintf("bad bucket: %s", s))
+			return
+		}
+		bounds = append(bounds, bound)
+	}
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	buckets, err := nodesRepo.AgeDistribution(ctx, bounds)
+	if err != nil {
+		exitWithError(fmt.Sprintf("age distribution: %s", err))
+		return
+	}
+
+	fmt.Print(formatAgeReport(buckets))
+}
+
+// formatAgeReport renders the given age buckets as a histogram, with one line
+// per bucket.
+func formatAgeReport(buckets []*repo.AgeBucket) string {
+	const barWidth = 40
+
+	var labels []string
+	var labelWidth, maxCount int
+	for _, bucket := range buckets {
+		label := fmt.Sprintf("%s–%s", formatAge(bucket.Min), formatAge(bucket.Max))
+		if bucket.Max == 0 {
+			label = fmt.Sprintf("%s+", formatAge(bucket.Min))
+		}
+		labels = append(labels, label)
+		labelWidth = max(labelWidth, utf8.RuneCountInString(label))
+		maxCount = max(maxCount, bucket.Count)
+	}
+
+	var sb strings.Builder
+	for i, bucket := range buckets {
+		bar := 0
+		if maxCount > 0 {
+			bar = bucket.Count * barWidth / maxCount
+		}
+		padding := strings.Repeat(" ", labelWidth-utf8.RuneCountInString(labels[i]))
+		fmt.Fprintf(&sb, "%s%s  %-*s %d nodes\n", padding, labels[i], barWidth, strings.Repeat("#", bar), bucket.Count)
+	}
+
+	return sb.String()
+}
+
+func startNodeChurn(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	period, err := parseAge(nodeFlags.Period)
+	if err != nil {
+		exitWithError(fmt.Sprintf("bad period: %s", nodeFlags.Period))
+		return
+	}
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	report, err := nodesRepo.ChurnReport(ctx, period, nodeFlags.Windows)
+	if err != nil {
+		exitWithError(fmt.Sprintf("churn report: %s", err))
+		return
+	}
+
+	for _, w := range report {
+		fmt.Printf("%s – %s: %d new, %d lost, %d total, churn rate %.1f%%\n",
+			w.Start.Format(time.DateTime), w.End.Format(time.DateTime), w.New, w.Lost, w.Total, w.Rate()*100)
+	}
+}
+
+func startNodeFirstSeenReport(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	period, err := parseAge(nodeFlags.Window)
+	if err != nil {
+		exitWithError(fmt.Sprintf("bad period: %s", nodeFlags.Window))
+		return
+	}
+	if nodeFlags.BucketCount <= 0 {
+		exitWithError(fmt.Sprintf("bad number of buckets: %d", nodeFlags.BucketCount))
+		return
+	}
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	buckets, err := nodesRepo.NewNodesPerPeriod(ctx, period, period/time.Duration(nodeFlags.BucketCount))
+	if err != nil {
+		exitWithError(fmt.Sprintf("first seen report: %s", err))
+		return
+	}
+
+	if nodeFlags.JSON {
+		type bucket struct {
+			Start time.Time `json:"start"`
+			End   time.Time `json:"end"`
+			Count int       `json:"count"`
+		}
+		res := make([]*bucket, 0, len(buckets))
+		for _, b := range buckets {
+			res = append(res, &bucket{Start: b.Start.UTC(), End: b.End.UTC(), Count: b.Count})
+		}
+
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		enc.Encode(res)
+		return
+	}
+
+	fmt.Print(formatFirstSeenReport(buckets))
+}
+
+// formatFirstSeenReport renders the given buckets as a histogram, with one
+// line per bucket.
+func formatFirstSeenReport(buckets []*repo.PeriodBucket) string {
+	const barWidth = 40
+
+	var maxCount int
+	for _, bucket := range buckets {
+		maxCount = max(maxCount, bucket.Count)
+	}
+
+	var sb strings.Builder
+	for _, bucket := range buckets {
+		bar := 0
+		if maxCount > 0 {
+			bar = bucket.Count * barWidth / maxCount
+		}
+		fmt.Fprintf(&sb, "%s – %s  %-*s %d nodes\n", bucket.Start.Format(time.DateTime), bucket.End.Format(time.DateTime),
+			barWidth, strings.Repeat("#", bar), bucket.Count)
+	}
+
+	return sb.String()
+}
+
+func startNodeCapabilityMatrix(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	m, err := nodesRepo.CapabilityMatrix(ctx)
+	if err != nil {
+		exitWithError(fmt.Sprintf("capability matrix: %s", err))
+		return
+	}
+
+	fmt.Print(formatCapabilityMatrix(m))
+}
+
+// formatCapabilityMatrix renders the given matrix as a table, with a row per
+// capability and a column per status.
+func formatCapabilityMatrix(m *repo.CapabilityMatrix) string {
+	var sb strings.Builder
+	tw := tabwriter.NewWriter(&sb, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "capability\t%s\t%%_with_capability\n", strings.Join(repo.CapabilityStatuses, "\t"))
+	for _, c := range repo.Capabilities {
+		fmt.Fprintf(tw, "%s", c)
+		for _, status := range repo.CapabilityStatuses {
+			fmt.Fprintf(tw, "\t%d", m.Counts[c][status])
+		}
+		fmt.Fprintf(tw, "\t%.1f\n", m.Percent(c))
+	}
+	fmt.Fprintf(tw, "total")
+	for _, status := range repo.CapabilityStatuses {
+		fmt.Fprintf(tw, "\t%d", m.Totals[status])
+	}
+	fmt.Fprintf(tw, "\n")
+
+	tw.Flush()
+	return sb.String()
+}
+
+func startNodeCount(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	if nodeFlags.Status != "" && !slices.Contains(repo.NodeStatuses, nodeFlags.Status) {
+		exitWithError(fmt.Sprintf("bad status: %s", nodeFlags.Status))
+		return
+	}
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	count, err := nodesRepo.CountNodes(ctx, repo.NodeFilters{Status: nodeFlags.Status})
+	if err != nil {
+		exitWithError(fmt.Sprintf("count nodes: %s", err))
+		return
+	}
+
+	fmt.Println(count)
+}
+
+func startNodeFindSimilar(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	pk, err := models.ParsePublicKey(nodeFlags.Key)
+	if err != nil {
+		exitWithError(fmt.Sprintf("bad key: %s", nodeFlags.Key))
+		return
+	}
+
+	nodesRepo, close, err := openNodesRepo(ctx, nodeFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	nodes, err := nodesRepo.FindSimilar(ctx, pk, nodeFlags.Limit)
+	if err != nil {
+		exitWithError(fmt.Sprintf("find similar nodes: %s", err))
+		return
+	}
+	if len(nodes) == 0 {
+		fmt.Println("No similar nodes found")
+		return
+	}
+
+	for _, node := range nodes {
+		matches := make([]string, 0, len(node.Matches))
+		for _, match := range node.Matches {
+			matches = append(matches, string(match))
+		}
+		fmt.Printf("%s: score %d (%s)\n", node.Node.PublicKey, node.Score(), strings.Join(matches, ", "))
+	}
+}
+
+// parseAge parses a duration like time.ParseDuration does, but also accepts a
+// whole number of days with a "d" suffix.
+func parseAge(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// formatAge formats the given duration in days if it's a whole number of them.
+func formatAge(d time.Duration) string {
+	const day = 24 * time.Hour
+	if d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+	return d.String()
+}
+
+// importNodes tracks all nodes returned by the given client. It returns the
+// total number of nodes imported and how many of those were new.
+func importNodes(ctx context.Context, nodesRepo repo.NodeRepository, tsClient *toxstatus.Client) (total int, added int, err error) {
+	nodes, err := tsClient.GetNodes(ctx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("fetch nodes: %w", err)
+	}
+
+	for _, node := range nodes {
+		found, err := nodesRepo.HasNodeByPublicKey(ctx, node.PublicKey)
+		if err != nil {
+			return total, added, err
+		}
+		if _, err := nodesRepo.TrackDHTNode(ctx, node); err != nil {
+			return total, added, err
+		}
+
+		total++
+		if !found {
+			added++
+		}
+	}
+
+	return total, added, nil
+}
+
+// openNodesRepo opens the given db file for use by one of the subcommands.
+func openNodesRepo(ctx context.Context, dbFile string) (nodesRepo *repo.NodesRepo, close func(), err error) {
+	// Subcommands are short-lived, so the default pragmas of the root command
+	// are fine
+	db.RegisterPragmaHook(100000, "normal")
+
+	if err := db.CheckDir(dbFile, false); err != nil {
+		return nil, nil, fmt.Errorf("open db: %w", err)
+	}
+
+	readConn, writeConn, err := db.OpenReadWrite(ctx, dbFile, db.OpenOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("open db: %w", err)
+	}
+
+	return repo.New(readConn, writeConn), func() {
+		readConn.Close()
+		writeConn.Close()
+	}, nil
+}
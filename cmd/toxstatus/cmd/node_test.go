@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/toxstatus"
+)
+
+const testImportNodesJSON = `{"nodes": [{
+	"ipv4": "192.0.2.1",
+	"ipv6": "-",
+	"port": 33445,
+	"tcp_ports": [],
+	"public_key": "8E7D0B859922EF569298B4D261A8CCB5FEA14FB91ED412A7603A585A25698832",
+	"status_udp": true
+}, {
+	"ipv4": "192.0.2.2",
+	"ipv6": "2001:db8::2",
+	"port": 33445,
+	"tcp_ports": [],
+	"public_key": "3F0A45A268367C1BEA652F258C85F4A66DA76BCAA667A49E770BCC4917AB6A25",
+	"status_udp": false
+}]}`
+
+func TestImportNodes(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testImportNodesJSON))
+	}))
+	defer srv.Close()
+
+	readConn, writeConn, err := db.OpenReadWrite(ctx, ":memory:", db.OpenOptions{
+		Params: map[string]string{"cache": "shared"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer readConn.Close()
+	defer writeConn.Close()
+
+	nodesRepo := repo.New(readConn, writeConn)
+	tsClient := &toxstatus.Client{URL: srv.URL, IncludeOfflineNodes: true}
+
+	// Importing the same list twice should not result in any new nodes
+	for i, expectedAdded := range []int{2, 0} {
+		total, added, err := importNodes(ctx, nodesRepo, tsClient)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 2 || added != expectedAdded {
+			t.Fatalf("import %d: expected 2 nodes (%d new), got %d (%d new)", i, expectedAdded, total, added)
+		}
+	}
+
+	count, err := nodesRepo.GetNodeCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 nodes in db, got %d", count)
+	}
+}
+
+func TestFormatAgeReport(t *testing.T) {
+	const day = 24 * time.Hour
+	buckets := []*repo.AgeBucket{
+		{Min: 0, Max: 7 * day, Count: 10},
+		{Min: 7 * day, Max: 30 * day, Count: 5},
+		{Min: 30 * day, Max: 0, Count: 0},
+	}
+
+	expected := "" +
+		" 0d–7d  ######################################## 10 nodes\n" +
+		"7d–30d  ####################                     5 nodes\n" +
+		"  30d+                                           0 nodes\n"
+	if res := formatAgeReport(buckets); res != expected {
+		t.Fatalf("unexpected report:\n%s\nexpected:\n%s", res, expected)
+	}
+}
+
+func TestFormatFirstSeenReport(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	const day = 24 * time.Hour
+	buckets := []*repo.PeriodBucket{
+		{Start: start, End: start.Add(5 * day), Count: 4},
+		{Start: start.Add(5 * day), End: start.Add(10 * day), Count: 1},
+		{Start: start.Add(10 * day), End: start.Add(15 * day), Count: 0},
+	}
+
+	expected := "" +
+		"2024-01-01 00:00:00 – 2024-01-06 00:00:00  ######################################## 4 nodes\n" +
+		"2024-01-06 00:00:00 – 2024-01-11 00:00:00  ##########                               1 nodes\n" +
+		"2024-01-11 00:00:00 – 2024-01-16 00:00:00                                           0 nodes\n"
+	if res := formatFirstSeenReport(buckets); res != expected {
+		t.Fatalf("unexpected report:\n%s\nexpected:\n%s", res, expected)
+	}
+}
+
+func TestFormatCapabilityMatrix(t *testing.T) {
+	m := &repo.CapabilityMatrix{
+		Totals: map[string]int64{repo.NodeStatusUp: 3, repo.NodeStatusDown: 1},
+		Counts: map[repo.Capability]map[string]int64{
+			repo.CapabilityUDP:  {repo.NodeStatusUp: 3, repo.NodeStatusDown: 1},
+			repo.CapabilityTCP:  {repo.NodeStatusUp: 1},
+			repo.CapabilityIPv4: {repo.NodeStatusUp: 3, repo.NodeStatusDown: 1},
+			repo.CapabilityIPv6: {repo.NodeStatusUp: 2},
+		},
+	}
+
+	expected := "" +
+		"capability  up  down  unknown  %_with_capability\n" +
+		"udp         3   1     0        100.0\n" +
+		"tcp         1   0     0        25.0\n" +
+		"ipv4        3   1     0        100.0\n" +
+		"ipv6        2   0     0        50.0\n" +
+		"total       3   1     0\n"
+	if res := formatCapabilityMatrix(m); res != expected {
+		t.Fatalf("unexpected matrix:\n%s\nexpected:\n%s", res, expected)
+	}
+}
+
+func TestParseAge(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"7d":  7 * 24 * time.Hour,
+		"12h": 12 * time.Hour,
+	} {
+		res, err := parseAge(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res != expected {
+			t.Fatalf("%s: expected %s, got %s", s, expected, res)
+		}
+	}
+
+	if _, err := parseAge("7days"); err == nil {
+		t.Fatal("expected error for bad age")
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rescanCmd = &cobra.Command{
+		Use:   "rescan",
+		Short: "Manage full rescans of the network",
+		Long: "A rescan probes every known node exactly once, at the rate set with the --rescan-rate flag of the " +
+			"main command. It's run by the crawler that uses the given db, next to its normal crawling. Its " +
+			"progress is kept in the db, so it resumes if the crawler is restarted.",
+	}
+	rescanStartCmd = &cobra.Command{
+		Use:   "start",
+		Short: "Start a rescan",
+		Run:   startRescanStart,
+	}
+	rescanCancelCmd = &cobra.Command{
+		Use:   "cancel",
+		Short: "Cancel the running rescan",
+		Run:   startRescanCancel,
+	}
+	rescanStatusCmd = &cobra.Command{
+		Use:   "status",
+		Short: "Show the progress of the most recent rescan",
+		Run:   startRescanStatus,
+	}
+	rescanFlags = struct {
+		DB string
+	}{}
+)
+
+func init() {
+	rescanCmd.PersistentFlags().StringVar(&rescanFlags.DB, "db", "", "the sqlite database file to use")
+	rescanCmd.MarkPersistentFlagRequired("db")
+
+	rescanCmd.AddCommand(rescanCancelCmd)
+	rescanCmd.AddCommand(rescanStartCmd)
+	rescanCmd.AddCommand(rescanStatusCmd)
+	Root.AddCommand(rescanCmd)
+}
+
+func startRescanStart(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	nodesRepo, close, err := openNodesRepo(ctx, rescanFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	rescan, err := nodesRepo.StartRescan(ctx)
+	if err != nil {
+		exitWithError(fmt.Sprintf("start rescan: %s", err))
+		return
+	}
+
+	fmt.Printf("Started a rescan of %d nodes. It begins once the crawler notices.\n", rescan.Total)
+}
+
+func startRescanCancel(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	nodesRepo, close, err := openNodesRepo(ctx, rescanFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	if err := nodesRepo.CancelRescan(ctx); err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			exitWithError("no rescan is running")
+			return
+		}
+		exitWithError(fmt.Sprintf("cancel rescan: %s", err))
+		return
+	}
+
+	fmt.Println("Canceled the rescan")
+}
+
+func startRescanStatus(cmd *cobra.Command, args []string) {
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
+	nodesRepo, close, err := openNodesRepo(ctx, rescanFlags.DB)
+	if err != nil {
+		exitWithError(err.Error())
+		return
+	}
+	defer close()
+
+	rescan, err := nodesRepo.GetRescan(ctx)
+	if err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			fmt.Println("No rescan has been started")
+			return
+		}
+		exitWithError(fmt.Sprintf("get rescan: %s", err))
+		return
+	}
+
+	fmt.Print(formatRescan(rescan))
+}
+
+// formatRescan describes the status and progress of the given rescan.
+func formatRescan(rescan *models.Rescan) string {
+	res := fmt.Sprintf("Status: %s\nStarted: %s\n", rescan.Status(), rescan.StartedAt.Format(time.DateTime))
+	switch rescan.Status() {
+	case models.RescanStatusFinished:
+		res += fmt.Sprintf("Finished: %s\n", rescan.FinishedAt.Format(time.DateTime))
+	case models.RescanStatusCanceled:
+		res += fmt.Sprintf("Canceled: %s\n", rescan.CanceledAt.Format(time.DateTime))
+	}
+
+	var percent float64
+	if rescan.Total > 0 {
+		percent = min(float64(rescan.Probed)/float64(rescan.Total), 1) * 100
+	}
+	return res + fmt.Sprintf("Probed: %d of %d nodes (%.1f%%)\n", rescan.Probed, rescan.Total, percent)
+}
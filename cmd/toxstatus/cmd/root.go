@@ -2,8 +2,10 @@ package cmd
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
@@ -11,69 +13,131 @@ import (
 	"os"
 	"os/signal"
 //	"runtime"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/2mf/ToxStatus/internal/config"
 	"github.com/2mf/ToxStatus/internal/crawler"
 	"github.com/2mf/ToxStatus/internal/db"
 	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/2mf/ToxStatus/internal/reputation"
+	"github.com/2mf/ToxStatus/internal/transport"
 	"github.com/alexbakker/tox4go/toxstatus"
 	"github.com/lmittmann/tint"
 	"github.com/mattn/go-isatty"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
 )
 
 var (
 	Root = &cobra.Command{
-		Use:   "toxstatus",
-		Short: "Status page for the Tox network that keeps track of bootstrap nodes",
-		Run:   startRoot,
-	}
-	rootFlags = struct {
-		HTTPAddr          string
-		HTTPClientTimeout time.Duration
-		PprofAddr         string
-		ToxUDPAddr        string
-		DB                string
-		DBCacheSize       int
-		LogLevel          string
-		Workers           int
-	}{}
+		Use:     "toxstatus",
+		Short:   "Status page for the Tox network that keeps track of bootstrap nodes",
+		PreRunE: loadRootConfig,
+		Run:     startRoot,
+	}
+	rootConfig config.Config
 )
 
 func init() {
 	const maxDefaultWorkers = 2
-	Root.Flags().StringVar(&rootFlags.HTTPAddr, "http-addr", ":8003", "the network address to listen on for the HTTP server")
-	Root.Flags().DurationVar(&rootFlags.HTTPClientTimeout, "http-client-timeout", 10*time.Second, "the http client timeout for requests to nodes.tox.chat")
-	Root.Flags().StringVar(&rootFlags.PprofAddr, "pprof-addr", "", "the network address to listen of for the pprof HTTP server")
-	Root.Flags().StringVar(&rootFlags.ToxUDPAddr, "tox-udp-addr", ":33450", "the UDP network address to listen on for Tox")
-	Root.Flags().StringVar(&rootFlags.DB, "db", "", "the sqlite database file to use")
-	Root.Flags().IntVar(&rootFlags.DBCacheSize, "db-cache-size", 100000, "the sqlite cache size to use (in KB)")
-	Root.Flags().StringVar(&rootFlags.LogLevel, "log-level", "info", "the log level to use")
-	Root.Flags().IntVar(&rootFlags.Workers, "workers", 2, "the amount of workers to use")
+	Root.Flags().String("http-addr", ":8003", "the network address to listen on for the HTTP server")
+	Root.Flags().StringToString("http-cache-ttl", nil, "the amount of time to cache responses of HTTP API routes for, by route (e.g. candidates=1m,dense-ips=10m). "+
+		"Routes: "+strings.Join(crawler.CacheableRoutes, ", "))
+	Root.Flags().Duration("http-client-timeout", 10*time.Second, "the http client timeout for requests to nodes.tox.chat")
+	Root.Flags().String("bootstrap-url", "", "the URL of the nodes.tox.chat-compatible JSON list to fetch bootstrap nodes from (default: https://nodes.tox.chat/json)")
+	Root.Flags().String("bootstrap-ca-cert", "", "a PEM file with the CA certificate(s) to verify the bootstrap URL against, instead of the system CAs")
+	Root.Flags().String("pprof-addr", "", "the network address to listen of for the pprof HTTP server")
+	Root.Flags().String("tox-udp-addr", ":33450", "the UDP network address to listen on for Tox")
+	Root.Flags().String("address-family", crawler.AddressFamilyBoth, "the address family to probe nodes over: "+
+		strings.Join(crawler.AddressFamilies, ", ")+". Use this on single-stack networks to skip nodes that can't be reached")
+	Root.Flags().Bool("participate", false, "answer the getnodes and ping requests of other nodes, contributing to the DHT instead of only observing it")
+	Root.Flags().String("bind-device", "", "the network interface to bind the Tox UDP socket to, so that all Tox traffic goes through it (Linux only)")
+	Root.Flags().Bool("udp-reuseport", false, "set SO_REUSEPORT on the Tox UDP socket, so that multiple processes can bind the same port")
+	Root.Flags().Int("udp-read-buffer", transport.DefaultReadBufferSize, "the size of the buffer to read incoming Tox packets into (in bytes). Larger packets are dropped")
+	Root.Flags().Int("tox-udp-buf-size", 4194304, "the size of the OS receive buffer of the Tox UDP socket (in bytes). The OS may cap it. 0 keeps the OS default")
+	Root.Flags().String("db", "", "the sqlite database file to use")
+	Root.Flags().Bool("create-db-dir", false, "create the directory of the database file if it doesn't exist")
+	Root.Flags().Int("db-cache-size", 100000, "the sqlite cache size to use (in KB)")
+	Root.Flags().String("db-synchronous", "normal", "the sqlite synchronous mode to use: off, normal, full or extra. "+
+		"With off, writes are fastest, but an OS crash or power loss may corrupt the db. "+
+		"With normal, such an event may roll back the most recent transactions. "+
+		"full and extra trade write throughput for durability")
+	Root.Flags().Int("db-busy-retries", db.DefaultBusyRetries, "the number of times to retry a db write that fails because the db is busy")
+	Root.Flags().String("reputation-feed", "", "a file with IP ranges (one CIDR per line) to flag nodes in the HTTP API with, maintained by an external source")
+	Root.Flags().Duration("reputation-feed-reload", 5*time.Minute, "the interval at which to check the reputation feed for changes")
+	Root.Flags().Bool("reputation-exclude", false, "leave nodes flagged by the reputation feed out of the HTTP API")
+	Root.Flags().String("admin-token-file", "", "a file with the bearer token that grants access to the /admin endpoints of the HTTP API. They're disabled without it")
+	Root.Flags().Bool("anonymize-ips", false, "mask the last octet of IPv4 addresses and the last 80 bits of IPv6 addresses in the HTTP API, and leave out reverse DNS names (disables the /json bootstrap list)")
+	Root.Flags().Int("db-write-batch-size", crawler.DefaultResultBatchSize, "the maximum number of probe results to write to the db in a single transaction")
+	Root.Flags().Duration("db-write-flush-interval", crawler.DefaultResultFlushInterval, "the maximum amount of time to hold probe results before writing them to the db")
+	Root.Flags().Int("rescan-rate", crawler.DefaultRescanRate, "the maximum number of probes per second to send for a rescan started with the rescan command")
+	Root.Flags().Duration("shutdown-flush-timeout", crawler.DefaultShutdownFlushTimeout, "the maximum amount of time to spend writing pending probe results to the db on shutdown")
+	Root.Flags().String("debug-dump-file", "", "the file to append a dump of the in-memory crawler state to on SIGUSR1 (default \"toxstatus-dump-<pid>.log\")")
+	Root.Flags().String("log-level", "info", "the log level to use")
+	Root.Flags().Bool("log-source", false, "add the source file and line of the log statement to log entries (adds overhead)")
+	Root.Flags().Int("workers", 2, "the amount of workers to use")
+	Root.Flags().Bool("dry-run", false, "validate the configuration, db and connectivity to nodes.tox.chat, then exit without starting the crawler")
 	Root.MarkFlagRequired("db")
 }
 
+// loadRootConfig constructs the configuration of the root command from its
+// flags and validates it.
+func loadRootConfig(cmd *cobra.Command, args []string) error {
+	v := viper.New()
+	if err := v.BindPFlags(cmd.Flags()); err != nil {
+		return err
+	}
+
+	cfg, err := config.LoadFromViper(v)
+	if err != nil {
+		return err
+	}
+	if errs := cfg.Validate(); len(errs) != 0 {
+		return fmt.Errorf("bad configuration: %w", errors.Join(errs...))
+	}
+
+	rootConfig = cfg
+	return nil
+}
+
 func startRoot(cmd *cobra.Command, args []string) {
 	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer cancel()
 
-	var level slog.Level
-	if err := level.UnmarshalText([]byte(rootFlags.LogLevel)); err != nil {
-		fmt.Fprintf(os.Stderr, "bad log level: %s\n", rootFlags.LogLevel)
-		os.Exit(1)
+	logger := newLogger(os.Stderr, &rootConfig)
+	db.RegisterPragmaHook(rootConfig.DBCacheSize, rootConfig.DBSynchronous)
+	tsClient, err := newBootstrapClient(&rootConfig)
+	if err != nil {
+		logErrorAndExit(logger, "Unable to initialize bootstrap client", slog.Any("err", err))
 		return
 	}
 
-	logger := slog.New(tint.NewHandler(os.Stderr, &tint.Options{
-		Level:   level,
-		NoColor: !isatty.IsTerminal(os.Stderr.Fd()),
-	}))
+	if rootConfig.DryRun {
+		errs := checkRoot(ctx, &rootConfig, tsClient)
+		for _, err := range errs {
+			logger.Error("Dry run check failed", slog.Any("err", err))
+		}
+		if len(errs) != 0 {
+			os.Exit(1)
+		}
+
+		logger.Info("Dry run checks passed")
+		return
+	}
+
+	if err := db.CheckDir(rootConfig.DB, rootConfig.CreateDBDir); err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			logErrorAndExit(logger, "Unable to open db", slog.Any("err", err),
+				slog.String("hint", "create the directory or pass --create-db-dir"))
+		}
+		logErrorAndExit(logger, "Unable to open db", slog.Any("err", err))
+	}
 
-	db.RegisterPragmaHook(rootFlags.DBCacheSize)
-	readConn, writeConn, err := db.OpenReadWrite(ctx, rootFlags.DB, db.OpenOptions{})
+	readConn, writeConn, err := db.OpenReadWrite(ctx, rootConfig.DB, db.OpenOptions{})
 	if err != nil {
 		logErrorAndExit(logger, "Unable to open db", slog.Any("err", err))
 	}
@@ -82,10 +146,10 @@ func startRoot(cmd *cobra.Command, args []string) {
 		writeConn.Close()
 	}()
 
-	if rootFlags.PprofAddr != "" {
+	if rootConfig.PprofAddr != "" {
 		logger.Info("Starting pprof server")
 
-		l, err := net.Listen("tcp", rootFlags.PprofAddr)
+		l, err := net.Listen("tcp", rootConfig.PprofAddr)
 		if err != nil {
 			logErrorAndExit(logger, "Unable to start pprof server", slog.Any("err", err))
 			return
@@ -105,12 +169,88 @@ func startRoot(cmd *cobra.Command, args []string) {
 		}()
 	}
 
-	nodesRepo := repo.New(readConn, writeConn)
+	// If we were started by a previous instance as part of a graceful restart,
+	// take over its sockets instead of binding new ones
+	sockets, err := transport.InheritSockets()
+	if err != nil {
+		logErrorAndExit(logger, "Unable to inherit sockets", slog.Any("err", err))
+		return
+	}
+	if sockets != nil {
+		logger.Info("Inherited sockets from previous instance",
+			slog.String("tox_udp_addr", sockets.ToxUDP.LocalAddr().String()),
+			slog.String("http_addr", sockets.HTTP.Addr().String()))
+	} else {
+		sockOpts := transport.SocketOptions{
+			BindDevice: rootConfig.BindDevice,
+			ReusePort:  rootConfig.UDPReusePort,
+		}
+		sockets, err = transport.ListenSockets(rootConfig.ToxUDPAddr, rootConfig.HTTPAddr, sockOpts)
+		if sockOpts.ReusePort && errors.Is(err, errors.ErrUnsupported) {
+			logger.Warn("SO_REUSEPORT is not supported on this system, binding the Tox UDP socket without it",
+				slog.Any("err", err))
+			sockOpts.ReusePort = false
+			sockets, err = transport.ListenSockets(rootConfig.ToxUDPAddr, rootConfig.HTTPAddr, sockOpts)
+		}
+		if err != nil {
+			logErrorAndExit(logger, "Unable to bind sockets", slog.Any("err", err))
+			return
+		}
+	}
+
+	if rootConfig.ToxUDPBufSize > 0 {
+		bufSize, err := transport.SetRecvBufSize(sockets.ToxUDP, rootConfig.ToxUDPBufSize)
+		if err != nil {
+			logErrorAndExit(logger, "Unable to set UDP receive buffer size", slog.Any("err", err))
+			return
+		}
+		if bufSize < rootConfig.ToxUDPBufSize {
+			logger.Warn("UDP receive buffer size was capped by the OS (see net.core.rmem_max on Linux)",
+				slog.Int("requested", rootConfig.ToxUDPBufSize),
+				slog.Int("actual", bufSize))
+		} else {
+			logger.Info("Set UDP receive buffer size", slog.Int("size", bufSize))
+		}
+	}
+
+	var feed *reputation.Feed
+	if rootConfig.ReputationFeed != "" {
+		if feed, err = reputation.Load(rootConfig.ReputationFeed); err != nil {
+			logErrorAndExit(logger, "Unable to load reputation feed", slog.Any("err", err))
+			return
+		}
+		logger.Info("Loaded reputation feed", slog.Int("ranges", feed.Len()))
+	}
+
+	var adminToken string
+	if rootConfig.AdminTokenFile != "" {
+		if adminToken, err = config.LoadAdminToken(rootConfig.AdminTokenFile); err != nil {
+			logErrorAndExit(logger, "Unable to load admin token", slog.Any("err", err))
+			return
+		}
+	}
+
+	nodesRepo := repo.New(readConn, db.NewRetryDB(writeConn, db.RetryOptions{
+		Logger:  logger,
+		Retries: rootConfig.DBBusyRetries,
+	}))
 	cr, err := crawler.New(nodesRepo, crawler.CrawlerOptions{
-		Logger:     logger,
-		HTTPAddr:   rootFlags.HTTPAddr,
-		ToxUDPAddr: rootFlags.ToxUDPAddr,
-		Workers:    rootFlags.Workers,
+		Logger:               logger,
+		ToxUDPConn:           sockets.ToxUDP,
+		UDPReadBufferSize:    rootConfig.UDPReadBuffer,
+		ReputationFeed:       feed,
+		ReputationFeedReload: rootConfig.ReputationFeedReload,
+		ReputationExclude:    rootConfig.ReputationExclude,
+		AnonymizeIPs:         rootConfig.AnonymizeIPs,
+		AdminToken:           adminToken,
+		ResultBatchSize:      rootConfig.DBWriteBatchSize,
+		ResultFlushInterval:  rootConfig.DBWriteFlushInterval,
+		ShutdownFlushTimeout: rootConfig.ShutdownFlushTimeout,
+		RescanRate:           rootConfig.RescanRate,
+		HTTPCacheTTLs:        rootConfig.HTTPCacheTTL,
+		AddressFamily:        rootConfig.AddressFamily,
+		Participate:          rootConfig.Participate,
+		Workers:              rootConfig.Workers,
 	})
 	if err != nil {
 		logErrorAndExit(logger, "Unable to initialize Tox crawler", slog.Any("err", err))
@@ -119,12 +259,11 @@ func startRoot(cmd *cobra.Command, args []string) {
 
 	logger.Info("Querying nodes.tox.chat for bootstrap nodes")
 
-	// Kick off by bootstrapping from nodes in the nodes.tox.chat list
-	tsClient := toxstatus.Client{HTTPClient: &http.Client{Timeout: rootFlags.HTTPClientTimeout}}
+	// Kick off by bootstrapping from nodes in the nodes.tox.chat list. If that
+	// fails, the crawler falls back to the nodes we already know about.
 	bsNodes, err := tsClient.GetNodes(ctx)
 	if err != nil {
-		logErrorAndExit(logger, "Unable to fetch nodes from", slog.Any("err", err))
-		return
+		logger.Warn("Unable to fetch nodes from nodes.tox.chat", slog.Any("err", err))
 	}
 
 	for _, node := range bsNodes {
@@ -134,6 +273,14 @@ func startRoot(cmd *cobra.Command, args []string) {
 			slog.String("addr", node.Addr().String()))
 	}
 
+	// The HTTP server has its own lifecycle, so that it can be restarted
+	// without interrupting the crawler
+	httpServer := cr.NewHTTPServer()
+	if err := httpServer.Start(sockets.HTTP); err != nil {
+		logErrorAndExit(logger, "Unable to start HTTP server", slog.Any("err", err))
+		return
+	}
+
 	var wg sync.WaitGroup
 	wg.Add(1)
 	go func() {
@@ -146,13 +293,121 @@ func startRoot(cmd *cobra.Command, args []string) {
 		}
 	}()
 
-	<-ctx.Done()
+	// On SIGHUP, start a new instance that takes over our sockets and shut down
+	// once it's running
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+
+	// On SIGUSR1, dump the in-memory state of the crawler for debugging
+	dumpChan := make(chan os.Signal, 1)
+	notifyDumpSignal(dumpChan)
+	defer signal.Stop(dumpChan)
+	dumpFile := rootConfig.DebugDumpFile
+	if dumpFile == "" {
+		dumpFile = defaultDumpFile()
+	}
+
+	for ctx.Err() == nil {
+		select {
+		case <-ctx.Done():
+		case <-dumpChan:
+			if err := writeStateDump(cr, dumpFile); err != nil {
+				logger.Error("Unable to dump crawler state", slog.Any("err", err))
+				continue
+			}
+			logger.Info("Dumped crawler state", slog.String("file", dumpFile))
+		case <-hupChan:
+			logger.Info("Starting new instance for graceful restart")
+			proc, err := sockets.Exec()
+			if err != nil {
+				logger.Error("Unable to start new instance", slog.Any("err", err))
+				continue
+			}
+
+			logger.Info("Started new instance", slog.Int("pid", proc.Pid))
+			cancel()
+		}
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := httpServer.Stop(shutdownCtx); err != nil {
+		logger.Error("Unable to shut down HTTP server", slog.Any("err", err))
+	}
+	cancelShutdown()
+
 	logger.Info("Stopping Tox crawler")
 	wg.Wait()
 
 	logger.Info("Bye!")
 }
 
+// checkRoot performs everything the root command does to initialize, without
+// starting the HTTP server or the crawler. It opens the db, applying the
+// schema, checks it and tests connectivity to nodes.tox.chat. All problems
+// found are returned.
+func checkRoot(ctx context.Context, cfg *config.Config, tsClient *toxstatus.Client) []error {
+	var errs []error
+	if err := db.CheckDir(cfg.DB, cfg.CreateDBDir); err != nil {
+		errs = append(errs, fmt.Errorf("open db: %w", err))
+	} else {
+		readConn, writeConn, err := db.OpenReadWrite(ctx, cfg.DB, db.OpenOptions{})
+		if err == nil {
+			if err := db.CheckSchema(ctx, readConn); err != nil {
+				errs = append(errs, fmt.Errorf("check db: %w", err))
+			}
+			readConn.Close()
+			writeConn.Close()
+		} else {
+			errs = append(errs, fmt.Errorf("open db: %w", err))
+		}
+	}
+
+	bsNodes, err := tsClient.GetNodes(ctx)
+	if err == nil {
+		if len(bsNodes) == 0 {
+			errs = append(errs, errors.New("fetch bootstrap nodes: no online nodes returned"))
+		}
+	} else {
+		errs = append(errs, fmt.Errorf("fetch bootstrap nodes: %w", err))
+	}
+
+	return errs
+}
+
+// newBootstrapClient constructs the client that is used to fetch the list of
+// bootstrap nodes.
+func newBootstrapClient(cfg *config.Config) (*toxstatus.Client, error) {
+	httpTransport := http.DefaultTransport.(*http.Transport).Clone()
+	if cfg.BootstrapCACert != "" {
+		pool, err := config.LoadCertPool(cfg.BootstrapCACert)
+		if err != nil {
+			return nil, fmt.Errorf("load bootstrap ca cert: %w", err)
+		}
+		httpTransport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+
+	return &toxstatus.Client{
+		HTTPClient: &http.Client{
+			Timeout:   cfg.HTTPClientTimeout,
+			Transport: httpTransport,
+		},
+		URL: cfg.BootstrapURL,
+	}, nil
+}
+
+func newLogger(f *os.File, cfg *config.Config) *slog.Logger {
+	// The log level has already been validated by loadRootConfig
+	var level slog.Level
+	level.UnmarshalText([]byte(cfg.LogLevel))
+
+	return slog.New(tint.NewHandler(f, &tint.Options{
+		Level:     level,
+		NoColor:   !isatty.IsTerminal(f.Fd()),
+		AddSource: cfg.LogSource,
+	}))
+}
+
 func logErrorAndExit(logger *slog.Logger, msg string, args ...any) {
 	logger.Error(msg, args...)
 	os.Exit(1)
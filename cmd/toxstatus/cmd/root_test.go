@@ -0,0 +1,170 @@
+package cmd
+
+import (
+	"context"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/config"
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/alexbakker/tox4go/toxstatus"
+)
+
+const testNodesJSON = `{"nodes": [{
+	"ipv4": "192.0.2.1",
+	"ipv6": "-",
+	"port": 33445,
+	"tcp_ports": [],
+	"public_key": "8E7D0B859922EF569298B4D261A8CCB5FEA14FB91ED412A7603A585A25698832",
+	"status_udp": true
+}]}`
+
+func init() {
+	db.RegisterPragmaHook(2000, "normal")
+}
+
+func runCheckRoot(t *testing.T, cfg *config.Config, handler http.HandlerFunc) []error {
+	srv := httptest.NewServer(handler)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	errsChan := make(chan []error, 1)
+	go func() {
+		errsChan <- checkRoot(ctx, cfg, &toxstatus.Client{URL: srv.URL})
+	}()
+
+	select {
+	case errs := <-errsChan:
+		return errs
+	case <-ctx.Done():
+		t.Fatal("dry run checks blocked")
+		return nil
+	}
+}
+
+func TestCheckRoot(t *testing.T) {
+	cfg := &config.Config{DB: filepath.Join(t.TempDir(), "toxstatus.db")}
+	errs := runCheckRoot(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testNodesJSON))
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestCheckRootErrors(t *testing.T) {
+	cfg := &config.Config{DB: filepath.Join(t.TempDir(), "nonexistent", "toxstatus.db")}
+	errs := runCheckRoot(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	})
+	if len(errs) != 2 {
+		t.Fatalf("expected 2 errors, got: %v", errs)
+	}
+	if !strings.Contains(errs[0].Error(), "open db") {
+		t.Fatalf("expected db error, got: %v", errs[0])
+	}
+	if !strings.Contains(errs[1].Error(), "fetch bootstrap nodes") {
+		t.Fatalf("expected bootstrap error, got: %v", errs[1])
+	}
+}
+
+func TestCheckRootDBDir(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "nonexistent")
+	cfg := &config.Config{DB: filepath.Join(dir, "toxstatus.db")}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testNodesJSON))
+	}
+
+	errs := runCheckRoot(t, cfg, handler)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), dir) {
+		t.Fatalf("expected db dir error mentioning %s, got: %v", dir, errs)
+	}
+
+	cfg.CreateDBDir = true
+	if errs := runCheckRoot(t, cfg, handler); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+	if _, err := os.Stat(cfg.DB); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckRootNoNodes(t *testing.T) {
+	cfg := &config.Config{DB: filepath.Join(t.TempDir(), "toxstatus.db")}
+	errs := runCheckRoot(t, cfg, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"nodes": []}`))
+	})
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "no online nodes") {
+		t.Fatalf("expected no nodes error, got: %v", errs)
+	}
+}
+
+func TestBootstrapCACert(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testNodesJSON))
+	}))
+	defer srv.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caData := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := os.WriteFile(caFile, caData, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config.Config{
+		HTTPClientTimeout: 10 * time.Second,
+		BootstrapURL:      srv.URL,
+	}
+
+	// Without the CA certificate, the server's certificate can't be verified
+	tsClient, err := newBootstrapClient(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tsClient.GetNodes(context.Background()); err == nil {
+		t.Fatal("expected certificate verification error")
+	}
+
+	cfg.BootstrapCACert = caFile
+	if tsClient, err = newBootstrapClient(cfg); err != nil {
+		t.Fatal(err)
+	}
+	nodes, err := tsClient.GetNodes(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 1 {
+		t.Fatalf("expected 1 node, got %d", len(nodes))
+	}
+}
+
+func TestLoggerSource(t *testing.T) {
+	for _, addSource := range []bool{false, true} {
+		f, err := os.CreateTemp(t.TempDir(), "log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+
+		logger := newLogger(f, &config.Config{LogLevel: "info", LogSource: addSource})
+		logger.With("worker", 1).Info("Test message")
+
+		out, err := os.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		hasSource := strings.Contains(string(out), "root_test.go:")
+		if hasSource != addSource {
+			t.Fatalf("expected source in log output: %t, got: %s", addSource, out)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+// Package clock abstracts the passing of time, so that time-dependent logic
+// can be tested without waiting for the real clock.
+package clock
+
+import "time"
+
+// Clock tells the time and creates timers. Real is the implementation backed
+// by the system clock. Fake is a controllable implementation for tests.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	After(d time.Duration) <-chan time.Time
+	NewTicker(d time.Duration) Ticker
+}
+
+// Ticker is the equivalent of time.Ticker for a Clock.
+type Ticker interface {
+	C() <-chan time.Time
+	Reset(d time.Duration)
+	Stop()
+}
+
+// Real is the Clock backed by the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) Since(t time.Time) time.Duration {
+	return time.Since(t)
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+type realTicker struct {
+	t *time.Ticker
+}
+
+func (t realTicker) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTicker) Reset(d time.Duration) {
+	t.t.Reset(d)
+}
+
+func (t realTicker) Stop() {
+	t.t.Stop()
+}
@@ -0,0 +1,150 @@
+package clock
+
+import (
+	"slices"
+	"sync"
+	"time"
+)
+
+// Fake is a Clock for use in tests. Its time only moves when Advance is
+// called, which fires all timers and tickers that are due. It's safe for
+// concurrent use.
+type Fake struct {
+	m       sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+type fakeWaiter struct {
+	When time.Time
+	// Period is the interval of a ticker. It's 0 for a one-shot timer.
+	Period time.Duration
+	C      chan time.Time
+}
+
+// NewFake returns a fake clock that's set to the given time.
+func NewFake(now time.Time) *Fake {
+	f := &Fake{now: now}
+	f.cond = sync.NewCond(&f.m)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return f.now
+}
+
+func (f *Fake) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	c := make(chan time.Time, 1)
+	if d <= 0 {
+		c <- f.now
+		return c
+	}
+
+	f.addWaiter(&fakeWaiter{When: f.now.Add(d), C: c})
+	return c
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	w := &fakeWaiter{When: f.now.Add(d), Period: d, C: make(chan time.Time, 1)}
+	f.addWaiter(w)
+	return &fakeTicker{f: f, w: w}
+}
+
+// Advance moves the time of the clock forward by the given duration, and fires
+// the timers and tickers that are due. Like with the real clock, a ticker that
+// has an undelivered tick drops the ones that follow.
+func (f *Fake) Advance(d time.Duration) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	f.now = f.now.Add(d)
+	f.waiters = slices.DeleteFunc(f.waiters, func(w *fakeWaiter) bool {
+		if w.When.After(f.now) {
+			return false
+		}
+
+		select {
+		case w.C <- f.now:
+		default:
+		}
+
+		if w.Period == 0 {
+			return true
+		}
+		for !w.When.After(f.now) {
+			w.When = w.When.Add(w.Period)
+		}
+		return false
+	})
+}
+
+// BlockUntil blocks until at least n timers and tickers are waiting on the
+// clock. This lets tests wait for the code under test to start waiting,
+// before advancing the clock.
+func (f *Fake) BlockUntil(n int) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+func (f *Fake) addWaiter(w *fakeWaiter) {
+	f.waiters = append(f.waiters, w)
+	f.cond.Broadcast()
+}
+
+func (f *Fake) removeWaiter(w *fakeWaiter) {
+	f.waiters = slices.DeleteFunc(f.waiters, func(o *fakeWaiter) bool {
+		return o == w
+	})
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.w.C
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("clock: non-positive interval for Ticker.Reset")
+	}
+
+	t.f.m.Lock()
+	defer t.f.m.Unlock()
+
+	t.w.When = t.f.now.Add(d)
+	t.w.Period = d
+	if !slices.Contains(t.f.waiters, t.w) {
+		t.f.addWaiter(t.w)
+	}
+}
+
+func (t *fakeTicker) Stop() {
+	t.f.m.Lock()
+	defer t.f.m.Unlock()
+
+	t.f.removeWaiter(t.w)
+}
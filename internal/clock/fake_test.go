@@ -0,0 +1,88 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFakeAfter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+
+	c := f.After(time.Minute)
+	f.Advance(59 * time.Second)
+	select {
+	case <-c:
+		t.Fatal("timer fired early")
+	default:
+	}
+
+	f.Advance(time.Second)
+	select {
+	case now := <-c:
+		if !now.Equal(start.Add(time.Minute)) {
+			t.Fatalf("unexpected time: %s", now)
+		}
+	default:
+		t.Fatal("timer didn't fire")
+	}
+
+	if d := f.Since(start); d != time.Minute {
+		t.Fatalf("unexpected time since start: %s", d)
+	}
+}
+
+func TestFakeTicker(t *testing.T) {
+	f := NewFake(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	ticker := f.NewTicker(time.Second)
+
+	// Ticks that aren't received in time are dropped
+	f.Advance(3 * time.Second)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-ticker.C():
+			if i > 0 {
+				t.Fatal("received dropped tick")
+			}
+		default:
+			if i == 0 {
+				t.Fatal("ticker didn't fire")
+			}
+		}
+	}
+
+	ticker.Reset(10 * time.Second)
+	f.Advance(time.Second)
+	select {
+	case <-ticker.C():
+		t.Fatal("ticker fired before the reset interval")
+	default:
+	}
+
+	ticker.Stop()
+	f.Advance(time.Minute)
+	select {
+	case <-ticker.C():
+		t.Fatal("stopped ticker fired")
+	default:
+	}
+}
+
+func TestFakeBlockUntil(t *testing.T) {
+	f := NewFake(time.Now())
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-f.After(time.Second)
+	}()
+
+	f.BlockUntil(1)
+	f.Advance(time.Second)
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for timer")
+	}
+}
@@ -0,0 +1,212 @@
+package config
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/crawler"
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/2mf/ToxStatus/internal/transport"
+	"github.com/spf13/viper"
+)
+
+// Config holds the configuration of the main toxstatus command. The mapstructure
+// tags match the names of the command line flags.
+type Config struct {
+	HTTPAddr             string                   `mapstructure:"http-addr"`
+	HTTPClientTimeout    time.Duration            `mapstructure:"http-client-timeout"`
+	HTTPCacheTTL         map[string]time.Duration `mapstructure:"http-cache-ttl"`
+	BootstrapURL         string                   `mapstructure:"bootstrap-url"`
+	BootstrapCACert      string                   `mapstructure:"bootstrap-ca-cert"`
+	PprofAddr            string                   `mapstructure:"pprof-addr"`
+	ToxUDPAddr           string                   `mapstructure:"tox-udp-addr"`
+	UDPReadBuffer        int                      `mapstructure:"udp-read-buffer"`
+	ToxUDPBufSize        int                      `mapstructure:"tox-udp-buf-size"`
+	BindDevice           string                   `mapstructure:"bind-device"`
+	UDPReusePort         bool                     `mapstructure:"udp-reuseport"`
+	AddressFamily        string                   `mapstructure:"address-family"`
+	Participate          bool                     `mapstructure:"participate"`
+	ReputationFeed       string                   `mapstructure:"reputation-feed"`
+	ReputationFeedReload time.Duration            `mapstructure:"reputation-feed-reload"`
+	ReputationExclude    bool                     `mapstructure:"reputation-exclude"`
+	AnonymizeIPs         bool                     `mapstructure:"anonymize-ips"`
+	AdminTokenFile       string                   `mapstructure:"admin-token-file"`
+	DB                   string                   `mapstructure:"db"`
+	CreateDBDir          bool                     `mapstructure:"create-db-dir"`
+	DBCacheSize          int                      `mapstructure:"db-cache-size"`
+	DBSynchronous        string                   `mapstructure:"db-synchronous"`
+	DBBusyRetries        int                      `mapstructure:"db-busy-retries"`
+	DBWriteBatchSize     int                      `mapstructure:"db-write-batch-size"`
+	DBWriteFlushInterval time.Duration            `mapstructure:"db-write-flush-interval"`
+	RescanRate           int                      `mapstructure:"rescan-rate"`
+	ShutdownFlushTimeout time.Duration            `mapstructure:"shutdown-flush-timeout"`
+	DebugDumpFile        string                   `mapstructure:"debug-dump-file"`
+	LogLevel             string                   `mapstructure:"log-level"`
+	LogSource            bool                     `mapstructure:"log-source"`
+	Workers              int                      `mapstructure:"workers"`
+	DryRun               bool                     `mapstructure:"dry-run"`
+}
+
+// LoadFromViper reads the configuration from the given Viper instance. It does
+// not validate the configuration. Use Validate for that.
+func LoadFromViper(v *viper.Viper) (Config, error) {
+	var cfg Config
+	if err := v.Unmarshal(&cfg); err != nil {
+		return Config{}, fmt.Errorf("unmarshal config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+// Validate checks the configuration for bad values and conflicting settings. It
+// returns all problems found, or nil if the configuration is valid.
+func (c *Config) Validate() []error {
+	var errs []error
+	if c.DB == "" {
+		errs = append(errs, errors.New("no db file specified"))
+	}
+	if c.DBCacheSize <= 0 {
+		errs = append(errs, fmt.Errorf("bad db cache size: %d (must be positive)", c.DBCacheSize))
+	}
+	if !slices.Contains(db.SynchronousModes, c.DBSynchronous) {
+		errs = append(errs, fmt.Errorf("bad db synchronous mode: %s (must be one of: %s)",
+			c.DBSynchronous, strings.Join(db.SynchronousModes, ", ")))
+	}
+	if c.DBBusyRetries < 0 {
+		errs = append(errs, fmt.Errorf("bad db busy retries: %d (must not be negative)", c.DBBusyRetries))
+	}
+	if c.DBWriteBatchSize <= 0 {
+		errs = append(errs, fmt.Errorf("bad db write batch size: %d (must be positive)", c.DBWriteBatchSize))
+	}
+	if c.DBWriteFlushInterval <= 0 {
+		errs = append(errs, fmt.Errorf("bad db write flush interval: %s (must be positive)", c.DBWriteFlushInterval))
+	}
+	if c.RescanRate <= 0 {
+		errs = append(errs, fmt.Errorf("bad rescan rate: %d (must be positive)", c.RescanRate))
+	}
+	if c.ShutdownFlushTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("bad shutdown flush timeout: %s (must be positive)", c.ShutdownFlushTimeout))
+	}
+	if c.HTTPClientTimeout <= 0 {
+		errs = append(errs, fmt.Errorf("bad http client timeout: %s (must be positive)", c.HTTPClientTimeout))
+	}
+	for route, ttl := range c.HTTPCacheTTL {
+		if !slices.Contains(crawler.CacheableRoutes, route) {
+			errs = append(errs, fmt.Errorf("bad http cache route: %s (must be one of: %s)",
+				route, strings.Join(crawler.CacheableRoutes, ", ")))
+		} else if ttl < 0 {
+			errs = append(errs, fmt.Errorf("bad http cache ttl for %s: %s (must not be negative)", route, ttl))
+		}
+	}
+	if c.BootstrapURL != "" {
+		if u, err := url.Parse(c.BootstrapURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf("bad bootstrap url: %s", c.BootstrapURL))
+		}
+	}
+	if c.BootstrapCACert != "" {
+		if _, err := LoadCertPool(c.BootstrapCACert); err != nil {
+			errs = append(errs, fmt.Errorf("bad bootstrap ca cert: %w", err))
+		}
+	}
+	if c.AdminTokenFile != "" {
+		if _, err := LoadAdminToken(c.AdminTokenFile); err != nil {
+			errs = append(errs, fmt.Errorf("bad admin token file: %w", err))
+		}
+	}
+	if c.BindDevice != "" && !transport.BindDeviceSupported {
+		errs = append(errs, fmt.Errorf("bad bind device: %s (binding to a device is only supported on Linux)", c.BindDevice))
+	}
+	if c.ReputationFeed != "" {
+		if c.ReputationFeedReload <= 0 {
+			errs = append(errs, fmt.Errorf("bad reputation feed reload interval: %s (must be positive)", c.ReputationFeedReload))
+		}
+	} else if c.ReputationExclude {
+		errs = append(errs, errors.New("reputation exclude requires a reputation feed"))
+	}
+	if c.UDPReadBuffer <= 0 {
+		errs = append(errs, fmt.Errorf("bad udp read buffer size: %d (must be positive)", c.UDPReadBuffer))
+	}
+	if c.ToxUDPBufSize < 0 {
+		errs = append(errs, fmt.Errorf("bad tox udp receive buffer size: %d (must not be negative)", c.ToxUDPBufSize))
+	}
+	if !slices.Contains(crawler.AddressFamilies, c.AddressFamily) {
+		errs = append(errs, fmt.Errorf("bad address family: %s (must be one of: %s)",
+			c.AddressFamily, strings.Join(crawler.AddressFamilies, ", ")))
+	}
+	if c.Workers < 2 || c.Workers%2 != 0 {
+		errs = append(errs, fmt.Errorf("bad number of workers: %d (must be a multiple of 2)", c.Workers))
+	}
+
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("bad log level: %s", c.LogLevel))
+	}
+
+	if err := validateAddr(c.HTTPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("bad http addr: %w", err))
+	}
+	if err := validateAddr(c.ToxUDPAddr); err != nil {
+		errs = append(errs, fmt.Errorf("bad tox udp addr: %w", err))
+	}
+	if c.PprofAddr != "" {
+		if err := validateAddr(c.PprofAddr); err != nil {
+			errs = append(errs, fmt.Errorf("bad pprof addr: %w", err))
+		} else if c.PprofAddr == c.HTTPAddr {
+			errs = append(errs, fmt.Errorf("pprof addr conflicts with http addr: %s", c.PprofAddr))
+		}
+	}
+
+	return errs
+}
+
+// LoadCertPool reads the PEM-encoded CA certificates in the given file into a
+// new certificate pool.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no PEM-encoded certificates found in: %s", file)
+	}
+
+	return pool, nil
+}
+
+// LoadAdminToken reads the token for the admin endpoints of the HTTP API from
+// the given file. Leading and trailing whitespace is ignored.
+func LoadAdminToken(file string) (string, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("no token found in: %s", file)
+	}
+
+	return token, nil
+}
+
+func validateAddr(addr string) error {
+	_, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if _, err := net.LookupPort("tcp", port); err != nil {
+		return err
+	}
+
+	return nil
+}
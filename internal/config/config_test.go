@@ -0,0 +1,185 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func validConfig() Config {
+	return Config{
+		HTTPAddr:             ":8003",
+		HTTPClientTimeout:    10 * time.Second,
+		ToxUDPAddr:           ":33450",
+		UDPReadBuffer:        2048,
+		ToxUDPBufSize:        4194304,
+		AddressFamily:        "both",
+		DB:                   "toxstatus.db",
+		DBCacheSize:          100000,
+		DBSynchronous:        "normal",
+		DBBusyRetries:        5,
+		DBWriteBatchSize:     1000,
+		DBWriteFlushInterval: time.Second,
+		RescanRate:           50,
+		ShutdownFlushTimeout: 5 * time.Second,
+		LogLevel:             "info",
+		Workers:              2,
+	}
+}
+
+func TestValidate(t *testing.T) {
+	cases := []struct {
+		Name   string
+		Modify func(c *Config)
+		Error  string
+	}{
+		{Name: "valid", Modify: func(c *Config) {}},
+		{Name: "valid pprof", Modify: func(c *Config) { c.PprofAddr = "localhost:6060" }},
+		{Name: "no db", Modify: func(c *Config) { c.DB = "" }, Error: "no db file"},
+		{Name: "zero cache size", Modify: func(c *Config) { c.DBCacheSize = 0 }, Error: "bad db cache size"},
+		{Name: "bad synchronous mode", Modify: func(c *Config) { c.DBSynchronous = "NORMAL; DROP TABLE node" }, Error: "bad db synchronous mode"},
+		{Name: "negative db busy retries", Modify: func(c *Config) { c.DBBusyRetries = -1 }, Error: "bad db busy retries"},
+		{Name: "zero db write batch size", Modify: func(c *Config) { c.DBWriteBatchSize = 0 }, Error: "bad db write batch size"},
+		{Name: "zero db write flush interval", Modify: func(c *Config) { c.DBWriteFlushInterval = 0 }, Error: "bad db write flush interval"},
+		{Name: "valid http cache ttl", Modify: func(c *Config) {
+			c.HTTPCacheTTL = map[string]time.Duration{"candidates": time.Minute, "transports": 0}
+		}},
+		{Name: "bad http cache route", Modify: func(c *Config) {
+			c.HTTPCacheTTL = map[string]time.Duration{"export": time.Minute}
+		}, Error: "bad http cache route"},
+		{Name: "negative http cache ttl", Modify: func(c *Config) {
+			c.HTTPCacheTTL = map[string]time.Duration{"candidates": -time.Minute}
+		}, Error: "bad http cache ttl"},
+		{Name: "zero rescan rate", Modify: func(c *Config) { c.RescanRate = 0 }, Error: "bad rescan rate"},
+		{Name: "zero shutdown flush timeout", Modify: func(c *Config) { c.ShutdownFlushTimeout = 0 }, Error: "bad shutdown flush timeout"},
+		{Name: "zero http client timeout", Modify: func(c *Config) { c.HTTPClientTimeout = 0 }, Error: "bad http client timeout"},
+		{Name: "valid bootstrap url", Modify: func(c *Config) { c.BootstrapURL = "https://nodes.example.com/json" }},
+		{Name: "bad bootstrap url", Modify: func(c *Config) { c.BootstrapURL = "nodes.example.com/json" }, Error: "bad bootstrap url"},
+		{Name: "missing bootstrap ca cert", Modify: func(c *Config) { c.BootstrapCACert = "/nonexistent/ca.pem" }, Error: "bad bootstrap ca cert"},
+		{Name: "bad bootstrap ca cert", Modify: func(c *Config) { c.BootstrapCACert = writeTempFile(t, "not a certificate") }, Error: "no PEM-encoded certificates"},
+		{Name: "valid admin token file", Modify: func(c *Config) { c.AdminTokenFile = writeTempFile(t, "secret\n") }},
+		{Name: "empty admin token file", Modify: func(c *Config) { c.AdminTokenFile = writeTempFile(t, " \n") }, Error: "no token found"},
+		{Name: "valid reputation feed", Modify: func(c *Config) {
+			c.ReputationFeed, c.ReputationFeedReload, c.ReputationExclude = "feed.txt", time.Minute, true
+		}},
+		{Name: "zero reputation feed reload", Modify: func(c *Config) { c.ReputationFeed = "feed.txt" }, Error: "bad reputation feed reload interval"},
+		{Name: "reputation exclude without feed", Modify: func(c *Config) { c.ReputationExclude = true }, Error: "requires a reputation feed"},
+		{Name: "negative tox udp receive buffer", Modify: func(c *Config) { c.ToxUDPBufSize = -1 }, Error: "bad tox udp receive buffer size"},
+		{Name: "zero udp read buffer", Modify: func(c *Config) { c.UDPReadBuffer = 0 }, Error: "bad udp read buffer size"},
+		{Name: "ipv4 only", Modify: func(c *Config) { c.AddressFamily = "ipv4" }},
+		{Name: "bad address family", Modify: func(c *Config) { c.AddressFamily = "ipx" }, Error: "bad address family"},
+		{Name: "one worker", Modify: func(c *Config) { c.Workers = 1 }, Error: "bad number of workers"},
+		{Name: "odd workers", Modify: func(c *Config) { c.Workers = 3 }, Error: "bad number of workers"},
+		{Name: "bad log level", Modify: func(c *Config) { c.LogLevel = "loud" }, Error: "bad log level"},
+		{Name: "bad http addr", Modify: func(c *Config) { c.HTTPAddr = "8003" }, Error: "bad http addr"},
+		{Name: "bad tox udp addr", Modify: func(c *Config) { c.ToxUDPAddr = ":nope" }, Error: "bad tox udp addr"},
+		{Name: "bad pprof addr", Modify: func(c *Config) { c.PprofAddr = "localhost" }, Error: "bad pprof addr"},
+		{Name: "pprof conflict", Modify: func(c *Config) { c.PprofAddr = c.HTTPAddr }, Error: "conflicts with http addr"},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			cfg := validConfig()
+			tc.Modify(&cfg)
+
+			errs := cfg.Validate()
+			if tc.Error == "" {
+				if len(errs) != 0 {
+					t.Fatalf("unexpected errors: %v", errs)
+				}
+				return
+			}
+
+			if len(errs) != 1 {
+				t.Fatalf("expected 1 error, got: %v", errs)
+			}
+			if !strings.Contains(errs[0].Error(), tc.Error) {
+				t.Fatalf("expected error containing '%s', got: %v", tc.Error, errs[0])
+			}
+		})
+	}
+}
+
+func writeTempFile(t *testing.T, data string) string {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestValidateMultipleErrors(t *testing.T) {
+	var cfg Config
+	if errs := cfg.Validate(); len(errs) < 2 {
+		t.Fatalf("expected multiple errors, got: %v", errs)
+	}
+}
+
+func TestLoadFromViper(t *testing.T) {
+	v := viper.New()
+	v.Set("http-addr", ":8080")
+	v.Set("http-client-timeout", "30s")
+	v.Set("http-cache-ttl", map[string]any{"candidates": "1m", "dense-ips": "10m"})
+	v.Set("pprof-addr", "localhost:6060")
+	v.Set("tox-udp-addr", ":33445")
+	v.Set("udp-read-buffer", 4096)
+	v.Set("tox-udp-buf-size", 1048576)
+	v.Set("address-family", "ipv6")
+	v.Set("db", "/var/lib/toxstatus/toxstatus.db")
+	v.Set("db-cache-size", 2000)
+	v.Set("db-synchronous", "off")
+	v.Set("db-busy-retries", 3)
+	v.Set("db-write-batch-size", 500)
+	v.Set("db-write-flush-interval", "2s")
+	v.Set("rescan-rate", 20)
+	v.Set("shutdown-flush-timeout", "10s")
+	v.Set("log-level", "debug")
+	v.Set("workers", 4)
+
+	cfg, err := LoadFromViper(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := Config{
+		HTTPAddr:             ":8080",
+		HTTPClientTimeout:    30 * time.Second,
+		HTTPCacheTTL:         map[string]time.Duration{"candidates": time.Minute, "dense-ips": 10 * time.Minute},
+		PprofAddr:            "localhost:6060",
+		ToxUDPAddr:           ":33445",
+		UDPReadBuffer:        4096,
+		ToxUDPBufSize:        1048576,
+		AddressFamily:        "ipv6",
+		DB:                   "/var/lib/toxstatus/toxstatus.db",
+		DBCacheSize:          2000,
+		DBSynchronous:        "off",
+		DBBusyRetries:        3,
+		DBWriteBatchSize:     500,
+		DBWriteFlushInterval: 2 * time.Second,
+		RescanRate:           20,
+		ShutdownFlushTimeout: 10 * time.Second,
+		LogLevel:             "debug",
+		Workers:              4,
+	}
+	if !reflect.DeepEqual(cfg, expected) {
+		t.Fatalf("expected config %+v, got %+v", expected, cfg)
+	}
+	if errs := cfg.Validate(); len(errs) != 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+}
+
+func TestLoadFromViperBadType(t *testing.T) {
+	v := viper.New()
+	v.Set("workers", "many")
+
+	if _, err := LoadFromViper(v); err == nil {
+		t.Fatal("expected error for non-numeric workers")
+	}
+}
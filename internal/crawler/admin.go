@@ -0,0 +1,125 @@
+package crawler
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/dht"
+)
+
+// requireAdmin only passes requests on to the given handler if they carry the
+// admin token in their Authorization header.
+func (c *Crawler) requireAdmin(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(c.opts.AdminToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeHTTPError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+// rawNode is everything that is known about a node, for debugging.
+type rawNode struct {
+	ID   int64        `json:"id"`
+	Node *models.Node `json:"node"`
+	// AddressIDs holds the db IDs of the addresses of the node, in the same
+	// order as node.addresses
+	AddressIDs []int64 `json:"address_ids"`
+	// BootstrapNode is set if the node is in the list of nodes the crawler
+	// was bootstrapped from
+	BootstrapNode bool `json:"bootstrap_node"`
+	// RecentProbes are the probe results of the node that are still in the
+	// in-memory buffer of recent results, oldest first
+	RecentProbes []*rawProbe `json:"recent_probes"`
+}
+
+type rawProbe struct {
+	Time time.Time `json:"time"`
+	Kind string    `json:"kind"`
+	Net  string    `json:"net"`
+	Addr string    `json:"addr"`
+}
+
+// handleAdminNode routes the admin requests for a single node, identified by
+// the public key in the path: /admin/nodes/{public_key}/...
+func (c *Crawler) handleAdminNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/admin/nodes/")
+	pkStr, sub, _ := strings.Cut(rest, "/")
+	pk, err := models.ParsePublicKey(pkStr)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad public key: %s", pkStr))
+		return
+	}
+
+	switch sub {
+	case "raw":
+		c.handleAdminNodeRaw(w, r, pk)
+	default:
+		writeHTTPError(w, http.StatusNotFound, "not found")
+	}
+}
+
+// handleAdminNodeRaw reports everything that is known about the given node:
+// the full db rows of the node and its addresses, and the state the crawler
+// keeps about it in memory. IP addresses are never anonymized here.
+func (c *Crawler) handleAdminNodeRaw(w http.ResponseWriter, r *http.Request, pk *dht.PublicKey) {
+	node, err := c.repo.GetNodeByPublicKey(r.Context(), pk)
+	if err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			writeHTTPError(w, http.StatusNotFound, "node not found")
+			return
+		}
+		c.logger.Error("Unable to obtain node", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	c.checkReputation(node)
+
+	res := &rawNode{
+		ID:           node.ID,
+		Node:         node,
+		AddressIDs:   []int64{},
+		RecentProbes: []*rawProbe{},
+		BootstrapNode: slices.ContainsFunc(c.bootstrapNodes(), func(bsNode *dht.Node) bool {
+			return *bsNode.PublicKey == *pk
+		}),
+	}
+	for _, addr := range node.Addresses {
+		res.AddressIDs = append(res.AddressIDs, addr.ID)
+	}
+	for _, probe := range c.results.recent.Items() {
+		if *probe.Node.PublicKey != *pk {
+			continue
+		}
+
+		kind := "ping"
+		if probe.Kind == repo.ProbeKindPong {
+			kind = "pong"
+		}
+		res.RecentProbes = append(res.RecentProbes, &rawProbe{
+			Time: probe.Time.UTC(),
+			Kind: kind,
+			Net:  probe.Node.Type.Net(),
+			Addr: probe.Node.Addr().String(),
+		})
+	}
+
+	writeHTTPJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,127 @@
+package crawler
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CacheableRoutes are the names of the HTTP API routes that responses can be
+// cached for, with the root path of the API stripped. The export is streamed
+// and can be huge, so it's not cacheable.
+var CacheableRoutes = []string{"bootstrap-health", "candidates", "capabilities", "dense-ips", "json", "transports"}
+
+// maxCacheEntries is the maximum number of responses kept in the cache. The
+// query string is part of the cache key, so without a limit, clients could
+// grow the cache without bounds.
+const maxCacheEntries = 1000
+
+type responseCache struct {
+	m       sync.Mutex
+	entries map[string]*cachedResponse
+}
+
+type cachedResponse struct {
+	Header  http.Header
+	Body    []byte
+	Expires time.Time
+}
+
+func newResponseCache() *responseCache {
+	return &responseCache{entries: make(map[string]*cachedResponse)}
+}
+
+func (c *responseCache) get(key string, now time.Time) *cachedResponse {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	res, ok := c.entries[key]
+	if !ok || !now.Before(res.Expires) {
+		return nil
+	}
+	return res
+}
+
+func (c *responseCache) put(key string, res *cachedResponse, now time.Time) {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if len(c.entries) >= maxCacheEntries {
+		maps.DeleteFunc(c.entries, func(key string, res *cachedResponse) bool {
+			return !now.Before(res.Expires)
+		})
+		if len(c.entries) >= maxCacheEntries {
+			return
+		}
+	}
+	c.entries[key] = res
+}
+
+// responseRecorder captures a response, so that it can be cached.
+type responseRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(b)
+}
+
+// cached wraps the handler of the given route to cache its successful
+// responses for the TTL configured for the route, if any. Responses are served
+// with a Cache-Control header that lets clients and proxies cache them for the
+// remainder of the TTL as well.
+func (c *Crawler) cached(route string, h http.HandlerFunc) http.HandlerFunc {
+	ttl := c.opts.HTTPCacheTTLs[route]
+	if ttl <= 0 {
+		return h
+	}
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			h(w, r)
+			return
+		}
+
+		now := c.opts.Clock.Now()
+		key := r.URL.RequestURI()
+		res := c.cache.get(key, now)
+		if res == nil {
+			rec := &responseRecorder{header: make(http.Header)}
+			h(rec, r)
+
+			// Only cache successful responses, so that a transient error
+			// doesn't stick around for the whole TTL
+			if rec.status != http.StatusOK {
+				maps.Copy(w.Header(), rec.header)
+				w.WriteHeader(rec.status)
+				w.Write(rec.body.Bytes())
+				return
+			}
+
+			res = &cachedResponse{Header: rec.header, Body: rec.body.Bytes(), Expires: now.Add(ttl)}
+			c.cache.put(key, res, now)
+		}
+
+		maps.Copy(w.Header(), res.Header)
+		maxAge := int(res.Expires.Sub(now).Seconds())
+		w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", maxAge))
+		w.WriteHeader(http.StatusOK)
+		w.Write(res.Body)
+	}
+}
@@ -7,19 +7,34 @@ import (
 	"fmt"
 	"log/slog"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/2mf/ToxStatus/internal/clock"
+	"github.com/2mf/ToxStatus/internal/models"
 	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/2mf/ToxStatus/internal/reputation"
+	"github.com/2mf/ToxStatus/internal/transport"
 	"github.com/alexbakker/tox4go/bootstrap"
 	"github.com/alexbakker/tox4go/dht"
 	"github.com/alexbakker/tox4go/dht/ping"
-	"github.com/alexbakker/tox4go/transport"
+	toxtransport "github.com/alexbakker/tox4go/transport"
 )
 
+const (
+	AddressFamilyBoth = "both"
+	AddressFamilyIPv4 = "ipv4"
+	AddressFamilyIPv6 = "ipv6"
+)
+
+// AddressFamilies are the address families that the crawler can be restricted
+// to probing nodes over.
+var AddressFamilies = []string{AddressFamilyBoth, AddressFamilyIPv4, AddressFamilyIPv6}
+
 type Crawler struct {
-	repo   *repo.NodesRepo
+	repo   repo.NodeRepository
 	opts   CrawlerOptions
 	logger *slog.Logger
 
@@ -27,7 +42,20 @@ type Crawler struct {
 	ident *dht.Identity
 	pings *ping.Set
 
+	results    *resultWriter
+	cache      *responseCache
+	events     *eventHub
+	addrStates *addrStates
+
+	// bsNodes is the list of nodes the crawler was bootstrapped from. It's set
+	// once when the crawler is started, and guarded by m because the HTTP API
+	// may already be serving by then.
+	bsNodes []*dht.Node
+
 	started        atomic.Bool
+	panics         atomic.Uint64
+	served         atomic.Uint64
+	tp             atomic.Pointer[transport.UDPTransport]
 	sendChan       chan *dhtPacket
 	sendInfoChan   chan *infoPacket
 	handleChan     chan *dhtPacket
@@ -36,10 +64,64 @@ type Crawler struct {
 }
 
 type CrawlerOptions struct {
-	Logger     *slog.Logger
-	HTTPAddr   string
-	ToxUDPAddr string
-	Workers    int
+	Logger *slog.Logger
+	// ToxUDPConn is the UDP socket to use for Tox. The crawler takes ownership
+	// of it and closes it once it stops running.
+	ToxUDPConn *net.UDPConn
+	// UDPReadBufferSize is the size of the buffer that incoming Tox packets
+	// are read into. Defaults to transport.DefaultReadBufferSize.
+	UDPReadBufferSize int
+	// ReputationFeed is used to flag nodes in the HTTP API. It's optional.
+	ReputationFeed *reputation.Feed
+	// ReputationFeedReload is the interval at which the reputation feed is
+	// checked for changes.
+	ReputationFeedReload time.Duration
+	// ReputationExclude leaves nodes flagged by the reputation feed out of the
+	// HTTP API entirely.
+	ReputationExclude bool
+	// AnonymizeIPs masks the host part of all IP addresses in the HTTP API,
+	// as described in models.AnonymizeIP. Reverse DNS names are left out,
+	// because they often contain the full IP address. The full addresses are
+	// still used for probing. The nodes.tox.chat-compatible document isn't
+	// served, because a bootstrap list of masked addresses is useless.
+	AnonymizeIPs bool
+	// AdminToken is the bearer token that grants access to the admin
+	// endpoints of the HTTP API. The admin endpoints are disabled if it's
+	// empty.
+	AdminToken string
+	// ResultBatchSize is the maximum number of probe results to write to the
+	// db in a single transaction. Defaults to DefaultResultBatchSize.
+	ResultBatchSize int
+	// ResultFlushInterval is the maximum amount of time that probe results
+	// are held before they're written to the db. Defaults to
+	// DefaultResultFlushInterval.
+	ResultFlushInterval time.Duration
+	// ShutdownFlushTimeout is the maximum amount of time that is spent
+	// writing pending probe results to the db once the crawler is stopped.
+	// Results that aren't written by then are lost. Defaults to
+	// DefaultShutdownFlushTimeout.
+	ShutdownFlushTimeout time.Duration
+	// HTTPCacheTTLs holds the amount of time that responses of the HTTP API
+	// are cached for, by route name. See CacheableRoutes. Responses of routes
+	// not present here are not cached.
+	HTTPCacheTTLs map[string]time.Duration
+	// AddressFamily restricts the crawler to probing nodes over the given
+	// address family. Nodes are still tracked if they're only reachable over
+	// the other family, but they're never queried. Defaults to
+	// AddressFamilyBoth.
+	AddressFamily string
+	// RescanRate is the maximum number of probes per second sent for a
+	// rescan. Rescan probes go through the same transmitters as all other
+	// probes. Defaults to DefaultRescanRate.
+	RescanRate int
+	// Participate makes the crawler answer the getnodes and ping requests of
+	// other nodes, instead of only observing the DHT. See
+	// handleGetNodesPacket.
+	Participate bool
+	// Clock is used for all time calculations and timers of the crawler.
+	// Defaults to clock.Real.
+	Clock   clock.Clock
+	Workers int
 }
 
 type infoPacket struct {
@@ -57,7 +139,7 @@ type rawPacket struct {
 	Addr *net.UDPAddr
 }
 
-func New(nodesRepo *repo.NodesRepo, opts CrawlerOptions) (*Crawler, error) {
+func New(nodesRepo repo.NodeRepository, opts CrawlerOptions) (*Crawler, error) {
 	ident, err := dht.NewIdentity(dht.IdentityOptions{
 		// Large cache for precomputed shared keys to improve performance
 		SharedKeyCacheSize: 10000,
@@ -69,6 +151,17 @@ func New(nodesRepo *repo.NodesRepo, opts CrawlerOptions) (*Crawler, error) {
 	if opts.Workers < 2 || opts.Workers%2 != 0 {
 		return nil, fmt.Errorf("bad number of workers: %d (must be a multiple of 2)", opts.Workers)
 	}
+	if opts.RescanRate == 0 {
+		opts.RescanRate = DefaultRescanRate
+	}
+	if opts.Clock == nil {
+		opts.Clock = clock.Real
+	}
+	if opts.AddressFamily == "" {
+		opts.AddressFamily = AddressFamilyBoth
+	} else if !slices.Contains(AddressFamilies, opts.AddressFamily) {
+		return nil, fmt.Errorf("bad address family: %s", opts.AddressFamily)
+	}
 
 	c := &Crawler{
 		repo:           nodesRepo,
@@ -76,6 +169,10 @@ func New(nodesRepo *repo.NodesRepo, opts CrawlerOptions) (*Crawler, error) {
 		logger:         opts.Logger,
 		ident:          ident,
 		pings:          ping.NewSet(ping.DefaultTimeout),
+		results:        newResultWriter(nodesRepo, opts.Logger, opts.Clock, opts.ResultBatchSize, opts.ResultFlushInterval, opts.ShutdownFlushTimeout),
+		cache:          newResponseCache(),
+		events:         newEventHub(),
+		addrStates:     newAddrStates(),
 		sendChan:       make(chan *dhtPacket),
 		sendInfoChan:   make(chan *infoPacket),
 		handleChan:     make(chan *dhtPacket),
@@ -86,12 +183,24 @@ func New(nodesRepo *repo.NodesRepo, opts CrawlerOptions) (*Crawler, error) {
 	return c, nil
 }
 
+// Run starts the crawler and blocks until the context is canceled. The crawler
+// is bootstrapped from the given nodes, or from the nodes in the db if none of
+// them are usable. Run fails if there are no nodes to bootstrap from at all.
 func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 	if !c.started.CompareAndSwap(false, true) {
 		return errors.New("attempt to start crawler twice")
 	}
+	c.m.Lock()
+	c.bsNodes = bsNodes
+	c.m.Unlock()
+
+	seeds, err := c.seedNodes(ctx, bsNodes)
+	if err != nil {
+		c.opts.ToxUDPConn.Close()
+		return err
+	}
 
-	tp, err := transport.NewUDPTransport("udp", c.opts.ToxUDPAddr, func(data []byte, addr *net.UDPAddr) {
+	tp := transport.NewUDPTransport(c.opts.ToxUDPConn, func(data []byte, addr *net.UDPAddr) {
 		// We need to copy the packet data, because once this function returns,
 		// the backing buffer will be reused for the next packet, so the
 		// contents of the data slice will get overwritten.
@@ -103,10 +212,8 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 			return
 		case c.recvChan <- &rawPacket{Data: cdata, Addr: addr}:
 		}
-	})
-	if err != nil {
-		return fmt.Errorf("tox udp transport: %w", err)
-	}
+	}, transport.UDPTransportOptions{ReadBufferSize: c.opts.UDPReadBufferSize})
+	c.tp.Store(tp)
 
 	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
@@ -123,13 +230,11 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 
 	workers := c.opts.Workers / 2
 	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func(i int) {
-			var total uint64
-			logger := c.logger.With(slog.Int("worker", i))
+		var total uint64
+		logger := c.logger.With(slog.Int("worker", i))
+		c.goSupervised(ctx, &wg, fmt.Sprintf("packet transmitter %d", i), func() {
 			defer func() {
 				logger.Info("Stopping packet transmitter", slog.Uint64("packets", total))
-				wg.Done()
 			}()
 
 			logger.Info("Starting packet transmitter")
@@ -164,17 +269,15 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 
 				total++
 			}
-		}(i)
+		})
 	}
 
 	for i := 0; i < workers; i++ {
-		wg.Add(1)
-		go func(i int) {
-			var total uint64
-			logger := c.logger.With(slog.Int("worker", i))
+		var total uint64
+		logger := c.logger.With(slog.Int("worker", i))
+		c.goSupervised(ctx, &wg, fmt.Sprintf("packet receiver %d", i), func() {
 			defer func() {
 				logger.Info("Stopping packet receiver", slog.Uint64("packets", total))
-				wg.Done()
 			}()
 
 			logger.Info("Starting packet receiver")
@@ -198,13 +301,10 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 
 				total++
 			}
-		}(i)
+		})
 	}
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
+	c.goSupervised(ctx, &wg, "packet handler", func() {
 		for {
 			select {
 			case <-ctx.Done():
@@ -225,25 +325,22 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 				}
 			}
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	})
 
-		c.logger.Info("Bootstrapping...", slog.Int("nodes", len(bsNodes)))
+	c.goSupervised(ctx, &wg, "crawler", func() {
+		c.logger.Info("Bootstrapping...", slog.Int("nodes", len(seeds)))
 
-		for _, bsNode := range bsNodes {
+		for _, bsNode := range seeds {
 			if err := ctx.Err(); err != nil {
 				return
 			}
 
-			logger := slog.With(
+			logger := c.logger.With(
 				slog.String("public_key", bsNode.PublicKey.String()),
 				slog.String("addr", bsNode.Addr().String()),
 			)
 
-			if !isGlobalUnicast(bsNode.IP) {
+			if !models.IsGlobalUnicast(bsNode.IP) {
 				logger.Debug("Node ip is not a global unicast address")
 				continue
 			}
@@ -262,7 +359,7 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 		select {
 		case <-ctx.Done():
 			return
-		case <-time.After(2 * time.Second):
+		case <-c.opts.Clock.After(2 * time.Second):
 		}
 
 		// TODO: Remove nodes that we haven't successfully pinged in a while
@@ -301,15 +398,44 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(5 * time.Second):
+			case <-c.opts.Clock.After(5 * time.Second):
 			}
 		}
-	}()
+	})
 
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	c.goSupervised(ctx, &wg, "result writer", func() {
+		c.results.Run(ctx)
+	})
 
+	c.goSupervised(ctx, &wg, "rescanner", func() {
+		c.runRescans(ctx)
+	})
+
+	c.goSupervised(ctx, &wg, "address state tracker", func() {
+		c.trackAddrStates(ctx)
+	})
+
+	if c.opts.ReputationFeed != nil {
+		c.goSupervised(ctx, &wg, "reputation feed reloader", func() {
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-c.opts.Clock.After(c.opts.ReputationFeedReload):
+				}
+
+				reloaded, err := c.opts.ReputationFeed.Reload()
+				if err != nil {
+					c.logger.Error("Unable to reload reputation feed", slog.Any("err", err))
+				} else if reloaded {
+					c.logger.Info("Reloaded reputation feed", slog.Int("ranges", c.opts.ReputationFeed.Len()))
+				}
+			}
+		})
+	}
+
+	c.goSupervised(ctx, &wg, "stats logger", func() {
+		var truncated uint64
 		for {
 			count, err := c.repo.GetNodeCount(ctx)
 			if err == nil {
@@ -318,18 +444,26 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 				c.logger.Error("Unable to query db for total number of nodes", slog.Any("err", err))
 			}
 
+			// Packets that don't fit in the read buffer are dropped by the
+			// transport. Warn about it, because it may indicate that the
+			// buffer is too small.
+			if n := tp.TruncatedPackets(); n > truncated {
+				c.logger.Warn("Dropped truncated packets",
+					slog.Uint64("count", n-truncated),
+					slog.Uint64("total", n),
+					slog.Int("read_buffer_size", c.opts.UDPReadBufferSize))
+				truncated = n
+			}
+
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(1 * time.Second):
+			case <-c.opts.Clock.After(1 * time.Second):
 			}
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	})
 
+	c.goSupervised(ctx, &wg, "pinger", func() {
 		for {
 			const retryPingDelay = 10 * time.Second
 			nodes, err := c.repo.GetUnresponsiveDHTNodes(ctx, retryPingDelay)
@@ -358,15 +492,12 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(1 * time.Second):
+			case <-c.opts.Clock.After(1 * time.Second):
 			}
 		}
-	}()
-
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
+	})
 
+	c.goSupervised(ctx, &wg, "bootstrap info requester", func() {
 		for {
 			reqTimes := make(map[int64]time.Time)
 			nodes, err := c.repo.GetNodesWithStaleBootstrapInfo(ctx)
@@ -378,6 +509,9 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 							c.logger.Error("Unable to convert db node address to dht node", slog.Any("err", err))
 							continue
 						}
+						if !c.probesFamily(dhtNode.IP) {
+							continue
+						}
 
 						packet := infoPacket{
 							Packet: new(bootstrap.InfoRequestPacket),
@@ -388,7 +522,7 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 						case <-ctx.Done():
 							return
 						case c.sendInfoChan <- &packet:
-							reqTimes[node.ID] = time.Now()
+							reqTimes[node.ID] = c.opts.Clock.Now()
 						}
 					}
 				}
@@ -403,10 +537,10 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 			select {
 			case <-ctx.Done():
 				return
-			case <-time.After(1 * time.Second):
+			case <-c.opts.Clock.After(1 * time.Second):
 			}
 		}
-	}()
+	})
 
 	select {
 	case err = <-listenErrChan:
@@ -416,18 +550,60 @@ func (c *Crawler) Run(ctx context.Context, bsNodes []*dht.Node) error {
 	}
 
 	wg.Wait()
+	// Disconnect the clients of the event stream, which would otherwise wait
+	// for events forever
+	c.events.close()
 	tp.Close()
 	<-listenErrChan
 	return err
 }
 
+// bootstrapNodes returns the list of nodes the crawler was bootstrapped from,
+// or nil if it hasn't been started yet.
+func (c *Crawler) bootstrapNodes() []*dht.Node {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.bsNodes
+}
+
+// seedNodes returns the given bootstrap nodes if any of them are usable.
+// Otherwise, it falls back to the nodes in the db that have responded to us
+// before, so that a broken bootstrap node list doesn't leave the crawler with
+// nothing to do.
+func (c *Crawler) seedNodes(ctx context.Context, bsNodes []*dht.Node) ([]*dht.Node, error) {
+	if slices.ContainsFunc(bsNodes, func(node *dht.Node) bool {
+		return models.IsGlobalUnicast(node.IP)
+	}) {
+		return bsNodes, nil
+	}
+
+	nodes, err := c.repo.GetResponsiveDHTNodes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("obtain responsive dht nodes: %w", err)
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no usable bootstrap nodes (got %d) and no responsive nodes in the db", len(bsNodes))
+	}
+
+	c.logger.Warn("No usable bootstrap nodes, falling back to responsive nodes from the db",
+		slog.Int("bootstrap_nodes", len(bsNodes)),
+		slog.Int("db_nodes", len(nodes)))
+	return nodes, nil
+}
+
 func (c *Crawler) handleDHTPacket(ctx context.Context, packet dht.Packet, node *dht.Node) error {
 	var err error
 	switch packet := packet.(type) {
 	case *dht.GetNodesPacket:
+		if c.opts.Participate {
+			err = c.handleGetNodesPacket(ctx, node, packet)
+		}
 	case *dht.SendNodesPacket:
 		err = c.handleSendNodesPacket(ctx, node, packet)
 	case *dht.PingRequestPacket:
+		if c.opts.Participate {
+			err = c.handlePingRequestPacket(ctx, node, packet)
+		}
 	case *dht.PingResponsePacket:
 	default:
 		err = fmt.Errorf("unsupported dht packet type: %d", packet.ID())
@@ -457,9 +633,15 @@ func (c *Crawler) handleSendNodesPacket(ctx context.Context, node *dht.Node, pac
 	c.m.Unlock()
 
 	// Insert/update the known nodes list
-	if err := c.repo.PongDHTNode(ctx, node); err != nil {
+	now := c.opts.Clock.Now()
+	if err := c.results.Write(ctx, &repo.ProbeResult{
+		Node: node,
+		Kind: repo.ProbeKindPong,
+		Time: now,
+	}); err != nil {
 		return fmt.Errorf("update node pong time: %w", err)
 	}
+	c.markPong(ctx, node, now)
 
 	var errs []error
 	for _, packetNode := range packet.Nodes {
@@ -472,7 +654,7 @@ func (c *Crawler) handleSendNodesPacket(ctx context.Context, node *dht.Node, pac
 			slog.String("net", packetNode.Type.Net()),
 			slog.String("addr", packetNode.Addr().String()))
 
-		if !isGlobalUnicast(packetNode.IP) {
+		if !models.IsGlobalUnicast(packetNode.IP) {
 			logger.Debug("Node ip is not a global unicast address")
 			continue
 		}
@@ -509,8 +691,27 @@ func (c *Crawler) handleBootstrapInfoPacket(ctx context.Context, addr *net.UDPAd
 	return c.repo.UpdateNodeInfo(ctx, addr, packet.MOTD, packet.Version)
 }
 
-// getNodes queries the given DHT node to search for the given publicKey.
+// probesFamily reports whether the crawler probes nodes over the address
+// family of the given IP.
+func (c *Crawler) probesFamily(ip net.IP) bool {
+	switch c.opts.AddressFamily {
+	case AddressFamilyIPv4:
+		return ip.To4() != nil
+	case AddressFamilyIPv6:
+		return ip.To4() == nil
+	default:
+		return true
+	}
+}
+
+// getNodes queries the given DHT node to search for the given publicKey. Nodes
+// that are only reachable over an address family that the crawler doesn't
+// probe are skipped.
 func (c *Crawler) getNodes(ctx context.Context, node *dht.Node, publicKey *dht.PublicKey) error {
+	if !c.probesFamily(node.IP) {
+		return nil
+	}
+
 	c.logger.Debug("Querying node",
 		slog.String("public_key", node.PublicKey.String()),
 		slog.String("net", node.Type.Net()),
@@ -524,7 +725,11 @@ func (c *Crawler) getNodes(ctx context.Context, node *dht.Node, publicKey *dht.P
 	}
 	c.m.Unlock()
 
-	if err := c.repo.PingDHTNode(ctx, node); err != nil {
+	if err := c.results.Write(ctx, &repo.ProbeResult{
+		Node: node,
+		Kind: repo.ProbeKindPing,
+		Time: c.opts.Clock.Now(),
+	}); err != nil {
 		return fmt.Errorf("track node ping: %s", err)
 	}
 
@@ -542,7 +747,7 @@ func (c *Crawler) getNodes(ctx context.Context, node *dht.Node, publicKey *dht.P
 	return nil
 }
 
-func (c *Crawler) sendPacket(tp transport.Transport, packet dht.Packet, destNode *dht.Node) error {
+func (c *Crawler) sendPacket(tp toxtransport.Transport, packet dht.Packet, destNode *dht.Node) error {
 	c.logger.Debug("Sending packet",
 		slog.String("public_key", destNode.PublicKey.String()),
 		slog.String("net", destNode.Type.Net()),
@@ -562,7 +767,7 @@ func (c *Crawler) sendPacket(tp transport.Transport, packet dht.Packet, destNode
 	return tp.SendPacket(packetBytes, destNode.Addr().(*net.UDPAddr))
 }
 
-func (c *Crawler) sendInfoPacket(tp transport.Transport, packet bootstrap.Packet, addr *net.UDPAddr) error {
+func (c *Crawler) sendInfoPacket(tp toxtransport.Transport, packet bootstrap.Packet, addr *net.UDPAddr) error {
 	c.logger.Debug("Sending bootstrap info request packet",
 		slog.String("addr", addr.String()),
 		slog.String("packet_type", packet.ID().String()))
@@ -604,9 +809,17 @@ func (c *Crawler) receivePacket(ctx context.Context, data []byte, addr *net.UDPA
 		return fmt.Errorf("unmarshal encrypted packet: %w", err)
 	}
 
-	// We're only interested in sendnodes packets
+	// We're only interested in sendnodes packets, unless we're participating
+	// in the DHT, in which case we also answer getnodes and ping requests
 	logger = logger.With(slog.String("packet_type", encryptedPacket.Type.String()))
-	if encryptedPacket.Type != dht.PacketTypeSendNodes {
+	switch encryptedPacket.Type {
+	case dht.PacketTypeSendNodes:
+	case dht.PacketTypeGetNodes, dht.PacketTypePingRequest:
+		if !c.opts.Participate {
+			logger.Debug("Ignoring DHT query")
+			return nil
+		}
+	default:
 		logger.Debug("Ignoring non-sendnodes packet")
 		return nil
 	}
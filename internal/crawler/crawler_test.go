@@ -0,0 +1,249 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/2mf/ToxStatus/internal/repo/mock"
+	"github.com/alexbakker/tox4go/bootstrap"
+	"github.com/alexbakker/tox4go/dht"
+	testifymock "github.com/stretchr/testify/mock"
+)
+
+func initMockCrawler(t *testing.T) (*Crawler, *mock.MockNodeRepository) {
+	nodesRepo := new(mock.MockNodeRepository)
+	t.Cleanup(func() { nodesRepo.AssertExpectations(t) })
+
+	c, err := New(nodesRepo, CrawlerOptions{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Workers: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c, nodesRepo
+}
+
+func TestHandleBootstrapInfoPacket(t *testing.T) {
+	c, nodesRepo := initMockCrawler(t)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 33445}
+	nodesRepo.On("UpdateNodeInfo", testifymock.Anything, addr, "hello", uint32(1000)).Return(nil)
+
+	packet := &bootstrap.InfoResponsePacket{MOTD: "hello", Version: 1000}
+	if err := c.handleBootstrapInfoPacket(ctx, addr, packet); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandleBootstrapInfoPacketError(t *testing.T) {
+	c, nodesRepo := initMockCrawler(t)
+
+	dbErr := errors.New("database is locked")
+	nodesRepo.On("UpdateNodeInfo", testifymock.Anything, testifymock.Anything, testifymock.Anything, testifymock.Anything).Return(dbErr)
+
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 33445}
+	if err := c.handleBootstrapInfoPacket(ctx, addr, &bootstrap.InfoResponsePacket{}); !errors.Is(err, dbErr) {
+		t.Fatalf("expected db error, got: %v", err)
+	}
+}
+
+func TestCandidatesRepoError(t *testing.T) {
+	c, nodesRepo := initMockCrawler(t)
+	nodesRepo.On("GetOnlineNodes", testifymock.Anything).Return(nil, errors.New("database is locked"))
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/candidates", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+}
+
+func TestGoSupervisedPanic(t *testing.T) {
+	c, _ := initMockCrawler(t)
+
+	var wg sync.WaitGroup
+	var runs int
+	c.goSupervised(ctx, &wg, "test", func() {
+		runs++
+		if runs == 1 {
+			panic("oops")
+		}
+	})
+	wg.Wait()
+
+	if runs != 2 {
+		t.Fatalf("unexpected number of runs: %d", runs)
+	}
+	if c.Panics() != 1 {
+		t.Fatalf("unexpected number of panics: %d", c.Panics())
+	}
+}
+
+func TestAddressFamily(t *testing.T) {
+	c := initCrawler(t)
+	c.opts.AddressFamily = AddressFamilyIPv4
+
+	node := generateDHTNode(t)
+	node.Type = dht.NodeTypeUDPIP6
+	node.IP = net.ParseIP("2001:db8::1")
+
+	// The node is only reachable over IPv6, so it should be skipped without
+	// ever reaching the transmitter, which isn't running here
+	if err := c.getNodes(ctx, node, c.ident.PublicKey); err != nil {
+		t.Fatal(err)
+	}
+	if size := c.pings.Size(); size != 0 {
+		t.Fatalf("unexpected number of pings in flight: %d", size)
+	}
+	if n := len(c.results.resultChan); n != 0 {
+		t.Fatalf("unexpected number of probe results: %d", n)
+	}
+
+	if _, err := New(c.repo, CrawlerOptions{Workers: 2, AddressFamily: "ipx"}); err == nil {
+		t.Fatal("expected error for bad address family")
+	}
+}
+
+func TestSeedNodes(t *testing.T) {
+	c, nodesRepo := initMockCrawler(t)
+
+	bsNode := generateDHTNode(t)
+	bsNode.IP = net.ParseIP("1.1.1.1")
+	dbNode := generateDHTNode(t)
+	dbNode.IP = net.ParseIP("8.8.8.8")
+
+	seeds, err := c.seedNodes(ctx, []*dht.Node{bsNode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds) != 1 || seeds[0] != bsNode {
+		t.Fatalf("unexpected seeds: %v", seeds)
+	}
+
+	// An empty or unusable bootstrap list falls back to the db
+	badNode := generateDHTNode(t)
+	badNode.IP = net.ParseIP("127.0.0.1")
+	nodesRepo.On("GetResponsiveDHTNodes", testifymock.Anything).Return([]*dht.Node{dbNode}, nil).Once()
+	seeds, err = c.seedNodes(ctx, []*dht.Node{badNode})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seeds) != 1 || seeds[0] != dbNode {
+		t.Fatalf("unexpected seeds: %v", seeds)
+	}
+
+	// No seeds from any source is fatal
+	nodesRepo.On("GetResponsiveDHTNodes", testifymock.Anything).Return(nil, nil).Once()
+	if _, err = c.seedNodes(ctx, nil); err == nil {
+		t.Fatal("expected error for missing seeds")
+	}
+}
+
+func TestParticipate(t *testing.T) {
+	c := initCrawler(t)
+
+	askerIdent, err := dht.NewIdentity(dht.IdentityOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	askerAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 33445}
+
+	var pongs []*dht.Node
+	for i := 0; i < maxSendNodes+2; i++ {
+		node := generateDHTNode(t)
+		if i == 0 {
+			node.PublicKey = askerIdent.PublicKey
+		}
+		pongs = append(pongs, node)
+		c.results.recent.Add(&repo.ProbeResult{Node: node, Kind: repo.ProbeKindPong})
+		c.results.recent.Add(&repo.ProbeResult{Node: node, Kind: repo.ProbeKindPing})
+	}
+	target := generateDHTNode(t).PublicKey
+
+	encrypt := func(packet dht.Packet) []byte {
+		encPacket, err := askerIdent.EncryptPacket(packet, c.ident.PublicKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := encPacket.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Queries are ignored by default. The context is canceled, so that
+	// receivePacket fails instead of blocking if it passes the packet on.
+	canceledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := c.receivePacket(canceledCtx, encrypt(&dht.PingRequestPacket{PingID: 1}), askerAddr); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.receivePacket(canceledCtx, encrypt(&dht.GetNodesPacket{PublicKey: target, PingID: 1}), askerAddr); err != nil {
+		t.Fatal(err)
+	}
+
+	handlerCtx, stopHandler := context.WithCancel(ctx)
+	defer stopHandler()
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		for {
+			select {
+			case <-handlerCtx.Done():
+				return
+			case packet := <-c.handleChan:
+				if err := c.handleDHTPacket(handlerCtx, packet.Packet, packet.Node); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+	}()
+
+	c.opts.Participate = true
+	if err := c.receivePacket(ctx, encrypt(&dht.GetNodesPacket{PublicKey: target, PingID: 2}), askerAddr); err != nil {
+		t.Fatal(err)
+	}
+	packet := <-c.sendChan
+	res, ok := packet.Packet.(*dht.SendNodesPacket)
+	if !ok || *packet.Node.PublicKey != *askerIdent.PublicKey || packet.Node.Addr().String() != askerAddr.String() || res.PingID != 2 {
+		t.Fatalf("unexpected response: %+v", packet)
+	}
+
+	expected := slices.Clone(pongs[1:])
+	slices.SortFunc(expected, func(a, b *dht.Node) int {
+		return bytes.Compare(target.DistanceTo(a.PublicKey)[:], target.DistanceTo(b.PublicKey)[:])
+	})
+	if !slices.Equal(res.Nodes, expected[:maxSendNodes]) {
+		t.Fatalf("unexpected nodes: %v", res.Nodes)
+	}
+
+	if err := c.receivePacket(ctx, encrypt(&dht.PingRequestPacket{PingID: 3}), askerAddr); err != nil {
+		t.Fatal(err)
+	}
+	packet = <-c.sendChan
+	if res, ok := packet.Packet.(*dht.PingResponsePacket); !ok || res.PingID != 3 {
+		t.Fatalf("unexpected response: %+v", packet)
+	}
+
+	// Queries are counted once they're handled
+	stopHandler()
+	<-handlerDone
+	if c.ServedQueries() != 2 {
+		t.Fatalf("unexpected number of served queries: %d", c.ServedQueries())
+	}
+}
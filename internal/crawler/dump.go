@@ -0,0 +1,47 @@
+package crawler
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/repo"
+)
+
+// DumpState writes a human-readable snapshot of the in-memory state of the
+// crawler to the given writer, for debugging issues on a running instance.
+func (c *Crawler) DumpState(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	fmt.Fprintf(tw, "== Crawler ==\n")
+	fmt.Fprintf(tw, "started:\t%t\n", c.started.Load())
+	fmt.Fprintf(tw, "workers:\t%d\n", c.opts.Workers)
+	fmt.Fprintf(tw, "recovered panics:\t%d\n", c.Panics())
+	fmt.Fprintf(tw, "served queries:\t%d\n", c.ServedQueries())
+	if tp := c.tp.Load(); tp != nil {
+		fmt.Fprintf(tw, "truncated packets:\t%d\n", tp.TruncatedPackets())
+	}
+
+	// The channels between the workers are unbuffered, so the result writer
+	// has the only queue with a depth worth reporting
+	fmt.Fprintf(tw, "\n== Queues ==\n")
+	fmt.Fprintf(tw, "probe results:\t%d/%d\n", len(c.results.resultChan), cap(c.results.resultChan))
+
+	c.m.Lock()
+	inFlight := c.pings.Size()
+	c.m.Unlock()
+	fmt.Fprintf(tw, "\n== Probes ==\n")
+	fmt.Fprintf(tw, "in flight:\t%d\n", inFlight)
+
+	fmt.Fprintf(tw, "\n== Recent probe results ==\n")
+	for _, res := range c.results.recent.Items() {
+		kind := "ping"
+		if res.Kind == repo.ProbeKindPong {
+			kind = "pong"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", res.Time.UTC().Format(time.RFC3339Nano), kind, res.Node.PublicKey, res.Node.Addr())
+	}
+
+	return tw.Flush()
+}
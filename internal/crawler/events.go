@@ -0,0 +1,451 @@
+package crawler
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/debug"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/dht"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// eventBufferSize is the number of events that can be queued for a single
+	// subscriber. Subscribers that fall further behind are disconnected.
+	eventBufferSize = 64
+	// eventWriteTimeout is the maximum amount of time that writing a single
+	// event to a client may take.
+	eventWriteTimeout = 10 * time.Second
+	// recentEventsSize is the number of events that are kept around for
+	// clients of the SSE stream that reconnect.
+	recentEventsSize = 256
+	// sseHeartbeatInterval is the interval at which a comment is sent to
+	// idle SSE clients, so that proxies don't drop the connection.
+	sseHeartbeatInterval = 20 * time.Second
+)
+
+// NodeEvent is published whenever an address of a node goes up or down. An
+// address goes up when it responds to us while it wasn't up, and down once it
+// hasn't responded for repo.NodeTimeout.
+type NodeEvent struct {
+	// ID is unique for the lifetime of the crawler, and increases with every
+	// event
+	ID        uint64    `json:"id"`
+	PublicKey string    `json:"public_key"`
+	Net       string    `json:"net"`
+	Addr      string    `json:"addr"`
+	State     string    `json:"state"`
+	Time      time.Time `json:"time"`
+	// ReputationFlagged is set if the node is flagged by the reputation feed,
+	// as in models.Node
+	ReputationFlagged bool `json:"reputation_flagged"`
+}
+
+// eventHub passes node events on to all of its subscribers. Publishing never
+// blocks, so that a slow subscriber can't hold up the crawler.
+type eventHub struct {
+	m      sync.Mutex
+	lastID uint64
+	subs   map[*eventSub]struct{}
+	recent *debug.Ring[*NodeEvent]
+	closed bool
+}
+
+type eventSub struct {
+	ch chan *NodeEvent
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		subs:   make(map[*eventSub]struct{}),
+		recent: debug.NewRing[*NodeEvent](recentEventsSize),
+	}
+}
+
+// subscribe returns a new subscription. Its channel is closed once the hub is
+// closed, or if the subscriber doesn't keep up with the events.
+func (h *eventHub) subscribe() *eventSub {
+	sub, _ := h.subscribeAfter(0)
+	return sub
+}
+
+// subscribeAfter is like subscribe, but also returns the recent events with an
+// ID higher than the given one, oldest first. Together with the events of the
+// subscription, there are no gaps or duplicates, unless the missed events have
+// already been dropped from the buffer of recent events.
+func (h *eventHub) subscribeAfter(lastID uint64) (*eventSub, []*NodeEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	var missed []*NodeEvent
+	if lastID > 0 {
+		for _, ev := range h.recent.Items() {
+			if ev.ID > lastID {
+				missed = append(missed, ev)
+			}
+		}
+	}
+
+	sub := &eventSub{ch: make(chan *NodeEvent, eventBufferSize)}
+	if h.closed {
+		close(sub.ch)
+	} else {
+		h.subs[sub] = struct{}{}
+	}
+	return sub, missed
+}
+
+func (h *eventHub) unsubscribe(sub *eventSub) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if _, ok := h.subs[sub]; ok {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// publish assigns an ID to the given event and sends it to all subscribers.
+// Subscribers whose buffer is full are dropped.
+func (h *eventHub) publish(ev *NodeEvent) {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	if h.closed {
+		return
+	}
+
+	h.lastID++
+	ev.ID = h.lastID
+	h.recent.Add(ev)
+	for sub := range h.subs {
+		select {
+		case sub.ch <- ev:
+		default:
+			delete(h.subs, sub)
+			close(sub.ch)
+		}
+	}
+}
+
+// close drops all subscribers. Nothing is published after it's called.
+func (h *eventHub) close() {
+	h.m.Lock()
+	defer h.m.Unlock()
+
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		close(sub.ch)
+	}
+}
+
+// upAddr is an address that is currently up, as tracked by addrStates.
+type upAddr struct {
+	node     *dht.Node
+	lastPong time.Time
+}
+
+// addrStates keeps track of the addresses that are currently up, so that the
+// crawler can tell when they go up or down.
+type addrStates struct {
+	m  sync.Mutex
+	up map[string]*upAddr
+}
+
+func newAddrStates() *addrStates {
+	return &addrStates{up: make(map[string]*upAddr)}
+}
+
+func addrStateKey(node *dht.Node) string {
+	return node.PublicKey.String() + "/" + node.Type.Net() + "/" + node.Addr().String()
+}
+
+// pong records a response of the given address. It reports whether the
+// address just went up.
+func (s *addrStates) pong(node *dht.Node, t time.Time) bool {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	key := addrStateKey(node)
+	addr, ok := s.up[key]
+	if !ok {
+		s.up[key] = &upAddr{node: node, lastPong: t}
+		return true
+	}
+	if t.After(addr.lastPong) {
+		addr.lastPong = t
+	}
+	return false
+}
+
+// expire forgets the addresses that haven't responded for repo.NodeTimeout
+// as of now, and returns them.
+func (s *addrStates) expire(now time.Time) []*upAddr {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	var res []*upAddr
+	for key, addr := range s.up {
+		if now.Sub(addr.lastPong) >= repo.NodeTimeout {
+			delete(s.up, key)
+			res = append(res, addr)
+		}
+	}
+	return res
+}
+
+// newNodeEvent creates an event for the given address. If there's a reputation
+// feed, the node is checked against it, which means looking up its other
+// addresses in the db.
+func (c *Crawler) newNodeEvent(ctx context.Context, node *dht.Node, state string, t time.Time) *NodeEvent {
+	ev := &NodeEvent{
+		PublicKey: node.PublicKey.String(),
+		Net:       node.Type.Net(),
+		Addr:      node.Addr().String(),
+		State:     state,
+		Time:      t.UTC(),
+	}
+
+	feed := c.opts.ReputationFeed
+	if feed == nil {
+		return ev
+	}
+	if feed.Contains(node.IP) {
+		ev.ReputationFlagged = true
+		return ev
+	}
+
+	dbNode, err := c.repo.GetNodeByPublicKey(ctx, node.PublicKey)
+	if err != nil {
+		if !errors.Is(err, repo.ErrNotFound) {
+			// Rather than risk leaking a node that should be excluded
+			c.logger.Error("Unable to obtain node", slog.Any("err", err))
+			ev.ReputationFlagged = true
+		}
+		return ev
+	}
+	c.checkReputation(dbNode)
+	ev.ReputationFlagged = dbNode.ReputationFlagged
+	return ev
+}
+
+// markPong publishes an up event if the given address wasn't up before it
+// responded to us at the given time.
+func (c *Crawler) markPong(ctx context.Context, node *dht.Node, t time.Time) {
+	if c.addrStates.pong(node, t) {
+		c.events.publish(c.newNodeEvent(ctx, node, repo.NodeStatusUp, t))
+	}
+}
+
+// trackAddrStates publishes a down event for every address that stops
+// responding, until the context is canceled. The addresses that are already
+// up according to the db are loaded first, so that a restart doesn't cause a
+// burst of up events.
+func (c *Crawler) trackAddrStates(ctx context.Context) {
+	nodes, err := c.repo.GetOnlineNodes(ctx)
+	if err != nil {
+		c.logger.Error("Unable to obtain online nodes", slog.Any("err", err))
+	}
+	for _, node := range nodes {
+		for _, addr := range node.Addresses {
+			dhtNode, err := addr.DHTNode()
+			if err != nil {
+				c.logger.Error("Unable to convert db node address to dht node", slog.Any("err", err))
+				continue
+			}
+			c.addrStates.pong(dhtNode, addr.LastPongAt)
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.opts.Clock.After(1 * time.Second):
+		}
+
+		now := c.opts.Clock.Now()
+		for _, addr := range c.addrStates.expire(now) {
+			c.events.publish(c.newNodeEvent(ctx, addr.node, repo.NodeStatusDown, now))
+		}
+	}
+}
+
+// streamsStopKey is the context key of the channel that is closed once the
+// HTTP server shuts down. See streamsStop.
+type streamsStopKey struct{}
+
+// streamsStop returns the channel that is closed once the HTTP server that the
+// request with the given context came in on shuts down. Long-lived streams stop
+// when it's closed, because the server doesn't wait for them. It returns nil,
+// which blocks forever, if there's no such channel.
+func streamsStop(ctx context.Context) <-chan struct{} {
+	ch, _ := ctx.Value(streamsStopKey{}).(chan struct{})
+	return ch
+}
+
+// eventExcluded reports whether the given event is about a node that the
+// reputation feed excludes from the HTTP API.
+func (c *Crawler) eventExcluded(ev *NodeEvent) bool {
+	return ev.ReputationFlagged && c.opts.ReputationExclude
+}
+
+// publicEvent returns a copy of the given event with the IP address masked if
+// IP anonymization is enabled.
+func (c *Crawler) publicEvent(ev *NodeEvent) *NodeEvent {
+	if !c.opts.AnonymizeIPs {
+		return ev
+	}
+
+	res := *ev
+	if host, port, err := net.SplitHostPort(ev.Addr); err == nil {
+		res.Addr = net.JoinHostPort(c.publicIP(host), port)
+	}
+	return &res
+}
+
+// handleEvents streams the node events to a WebSocket client as JSON messages,
+// until either side closes the connection, or the crawler or the HTTP server
+// stops. Any origin is allowed, because the stream is read-only and public.
+// Events about nodes that the reputation feed excludes are left out.
+func (c *Crawler) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	stop := streamsStop(r.Context())
+	srv := websocket.Server{
+		Handshake: func(*websocket.Config, *http.Request) error { return nil },
+		Handler: func(ws *websocket.Conn) {
+			defer ws.Close()
+
+			sub := c.events.subscribe()
+			defer c.events.unsubscribe(sub)
+
+			// We don't expect any messages from the client, but we need to
+			// read to notice when it goes away
+			gone := make(chan struct{})
+			go func() {
+				defer close(gone)
+				io.Copy(io.Discard, ws)
+			}()
+
+			for {
+				select {
+				case <-gone:
+					return
+				case <-stop:
+					return
+				case ev, ok := <-sub.ch:
+					if !ok {
+						return
+					}
+					if c.eventExcluded(ev) {
+						continue
+					}
+					ws.SetWriteDeadline(time.Now().Add(eventWriteTimeout))
+					if err := websocket.JSON.Send(ws, c.publicEvent(ev)); err != nil {
+						return
+					}
+				}
+			}
+		},
+	}
+	srv.ServeHTTP(w, r)
+}
+
+// handleEventsSSE streams the same events as handleEvents as Server-Sent
+// Events. A client that reconnects with the Last-Event-ID header first gets the
+// events it missed, as far as they're still in the buffer of recent events.
+// Idle connections get a heartbeat comment every 20 seconds. Every write gets
+// the same deadline as the events of handleEvents, so that a stalled client
+// can't hold up its handler forever.
+func (c *Crawler) handleEventsSSE(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil {
+		writeHTTPError(w, http.StatusInternalServerError, "streaming not supported")
+		return
+	}
+
+	var lastID uint64
+	if s := r.Header.Get("Last-Event-ID"); s != "" {
+		var err error
+		if lastID, err = strconv.ParseUint(s, 10, 64); err != nil {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad Last-Event-ID: %s", s))
+			return
+		}
+	}
+
+	sub, missed := c.events.subscribeAfter(lastID)
+	defer c.events.unsubscribe(sub)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(msg string) error {
+		if err := rc.SetWriteDeadline(time.Now().Add(eventWriteTimeout)); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(w, msg); err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+	writeEvent := func(ev *NodeEvent) error {
+		if c.eventExcluded(ev) {
+			return nil
+		}
+		data, err := json.Marshal(c.publicEvent(ev))
+		if err != nil {
+			return err
+		}
+		return write(fmt.Sprintf("id: %d\ndata: %s\n\n", ev.ID, data))
+	}
+	for _, ev := range missed {
+		if err := writeEvent(ev); err != nil {
+			return
+		}
+	}
+	if err := write(""); err != nil {
+		return
+	}
+
+	stop := streamsStop(r.Context())
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-stop:
+			return
+		case <-c.opts.Clock.After(sseHeartbeatInterval):
+			if err := write(": heartbeat\n\n"); err != nil {
+				return
+			}
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return
+			}
+			if err := writeEvent(ev); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package crawler
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/clock"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"golang.org/x/net/websocket"
+)
+
+func TestEventHubSlowSubscriber(t *testing.T) {
+	hub := newEventHub()
+	slow, fast := hub.subscribe(), hub.subscribe()
+
+	for i := 0; i < eventBufferSize+1; i++ {
+		hub.publish(&NodeEvent{})
+		<-fast.ch
+	}
+
+	// The slow subscriber gets the events that fit in its buffer, after which
+	// its channel is closed
+	for i := 0; i < eventBufferSize; i++ {
+		if ev := <-slow.ch; ev.ID != uint64(i+1) {
+			t.Fatalf("unexpected event id: %d (expected %d)", ev.ID, i+1)
+		}
+	}
+	if _, ok := <-slow.ch; ok {
+		t.Fatal("expected the slow subscriber to be dropped")
+	}
+
+	hub.close()
+	if _, ok := <-fast.ch; ok {
+		t.Fatal("expected the subscriber to be dropped once the hub is closed")
+	}
+	if _, ok := <-hub.subscribe().ch; ok {
+		t.Fatal("expected new subscribers to be dropped once the hub is closed")
+	}
+}
+
+func TestAddrStates(t *testing.T) {
+	states := newAddrStates()
+	node := generateDHTNode(t)
+	now := time.Now()
+
+	if !states.pong(node, now) {
+		t.Fatal("expected the address to go up")
+	}
+	if states.pong(node, now.Add(time.Minute)) {
+		t.Fatal("expected the address to stay up")
+	}
+
+	// The timeout counts from the last pong
+	if addrs := states.expire(now.Add(repo.NodeTimeout)); len(addrs) != 0 {
+		t.Fatalf("expected no addresses to go down, got: %v", addrs)
+	}
+	addrs := states.expire(now.Add(time.Minute + repo.NodeTimeout))
+	if len(addrs) != 1 || addrs[0].node != node {
+		t.Fatalf("expected the address to go down, got: %v", addrs)
+	}
+
+	if !states.pong(node, now.Add(time.Hour)) {
+		t.Fatal("expected the address to go up again")
+	}
+}
+
+// dialEvents connects to the WebSocket feed of the given crawler, and waits for
+// the handler to subscribe, so that no events are missed.
+func dialEvents(t *testing.T, c *Crawler) *websocket.Conn {
+	srv := httptest.NewServer(c.newHTTPHandler())
+	t.Cleanup(srv.Close)
+
+	ws, err := websocket.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/api/v1/events", "", srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+
+	for {
+		c.events.m.Lock()
+		n := len(c.events.subs)
+		c.events.m.Unlock()
+		if n > 0 {
+			return ws
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	c := initCrawler(t)
+	ws := dialEvents(t, c)
+
+	node := generateDHTNode(t)
+	c.markPong(ctx, node, time.Now())
+	// A second pong doesn't change the state of the address
+	c.markPong(ctx, node, time.Now())
+
+	var ev NodeEvent
+	if err := websocket.JSON.Receive(ws, &ev); err != nil {
+		t.Fatal(err)
+	}
+	if ev.ID != 1 || ev.PublicKey != node.PublicKey.String() || ev.Addr != node.Addr().String() ||
+		ev.Net != node.Type.Net() || ev.State != repo.NodeStatusUp {
+		t.Fatalf("unexpected event: %+v", ev)
+	}
+
+	// Stopping the crawler disconnects the client
+	c.events.close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &ev); err == nil {
+		t.Fatalf("expected the connection to be closed, got: %+v", ev)
+	}
+}
+
+func TestEventsReputation(t *testing.T) {
+	c := initCrawler(t)
+
+	// The node is flagged through an address the db knows about, rather than
+	// through the one it's seen on
+	flagged, clean := generateDHTNode(t), generateDHTNode(t)
+	if _, err := c.repo.TrackDHTNode(ctx, flagged); err != nil {
+		t.Fatal(err)
+	}
+	c.opts.ReputationFeed = newReputationFeed(t, flagged.IP)
+	flaggedAddr := *flagged
+	flaggedAddr.IP = net.IPv4(192, 0, 2, 1)
+
+	for _, exclude := range []bool{false, true} {
+		c.opts.ReputationExclude = exclude
+		c.addrStates = newAddrStates()
+		ws := dialEvents(t, c)
+
+		c.markPong(ctx, &flaggedAddr, time.Now())
+		c.markPong(ctx, clean, time.Now())
+
+		var ev NodeEvent
+		if err := websocket.JSON.Receive(ws, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if exclude {
+			if ev.PublicKey != clean.PublicKey.String() || ev.ReputationFlagged {
+				t.Fatalf("expected the flagged node to be excluded, got: %+v", ev)
+			}
+			continue
+		}
+		if ev.PublicKey != flagged.PublicKey.String() || !ev.ReputationFlagged {
+			t.Fatalf("expected the node to be flagged, got: %+v", ev)
+		}
+		if err := websocket.JSON.Receive(ws, &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.PublicKey != clean.PublicKey.String() || ev.ReputationFlagged {
+			t.Fatalf("expected the node not to be flagged, got: %+v", ev)
+		}
+
+		// Close the first connection, so that the next one is waited for
+		ws.Close()
+		for {
+			c.events.m.Lock()
+			n := len(c.events.subs)
+			c.events.m.Unlock()
+			if n == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestEventsSSE(t *testing.T) {
+	c := initCrawler(t)
+	fake := clock.NewFake(time.Now())
+	c.opts.Clock = fake
+
+	for _, pk := range []string{"a", "b", "c"} {
+		c.events.publish(&NodeEvent{PublicKey: pk, State: repo.NodeStatusUp})
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := c.NewHTTPServer()
+	if err := srv.Start(l); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Stop(ctx)
+
+	// A client of our own, so that its idle connections can be closed
+	// before stopping the server, which would wait for them otherwise
+	client := &http.Client{Transport: &http.Transport{}}
+	get := func(lastID string) *http.Response {
+		req, err := http.NewRequest(http.MethodGet, "http://"+l.Addr().String()+"/api/v1/events/sse", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Last-Event-ID", lastID)
+		res, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := get("x"); res.StatusCode != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	} else {
+		res.Body.Close()
+	}
+
+	res := get("1")
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("unexpected content type: %s", ct)
+	}
+
+	r := bufio.NewReader(res.Body)
+	readMessage := func() []string {
+		var lines []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if line == "\n" {
+				return lines
+			}
+			lines = append(lines, strings.TrimSuffix(line, "\n"))
+		}
+	}
+	readEvent := func(id string, pk string) {
+		msg := readMessage()
+		if len(msg) != 2 || msg[0] != "id: "+id {
+			t.Fatalf("unexpected message: %q", msg)
+		}
+		var ev NodeEvent
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(msg[1], "data: ")), &ev); err != nil {
+			t.Fatal(err)
+		}
+		if ev.PublicKey != pk {
+			t.Fatalf("unexpected event: %+v", ev)
+		}
+	}
+
+	// The events that were missed are replayed first
+	readEvent("2", "b")
+	readEvent("3", "c")
+
+	fake.BlockUntil(1)
+	fake.Advance(sseHeartbeatInterval)
+	if msg := readMessage(); len(msg) != 1 || !strings.HasPrefix(msg[0], ":") {
+		t.Fatalf("expected a heartbeat, got: %q", msg)
+	}
+
+	c.events.publish(&NodeEvent{PublicKey: "d", State: repo.NodeStatusDown})
+	readEvent("4", "d")
+
+	// Stopping the server ends the stream, without waiting for the timeout
+	client.CloseIdleConnections()
+	stopCtx, cancel := context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	if err := srv.Stop(stopCtx); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); err != nil {
+		t.Fatal(err)
+	}
+}
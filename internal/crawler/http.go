@@ -0,0 +1,954 @@
+package crawler
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/dht"
+)
+
+// HTTPServer serves the HTTP API of a crawler. Its lifecycle is separate from
+// that of the crawler, so that it can be stopped and started again (on a
+// different listener, for example) without interrupting the crawl.
+type HTTPServer struct {
+	c *Crawler
+
+	m    sync.Mutex
+	srv  *http.Server
+	done chan struct{}
+}
+
+// NewHTTPServer returns a server for the HTTP API of the crawler. It isn't
+// serving yet.
+func (c *Crawler) NewHTTPServer() *HTTPServer {
+	return &HTTPServer{c: c}
+}
+
+// Start serves the HTTP API on the given listener in the background. The server
+// takes ownership of the listener and closes it once it's stopped. It fails if
+// the server is already running, in which case the listener is left alone.
+func (s *HTTPServer) Start(l net.Listener) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.srv != nil {
+		return errors.New("http server is already running")
+	}
+
+	// Event streams never finish on their own, so they're told to stop once
+	// the server shuts down
+	streamsStop := make(chan struct{})
+	srv := &http.Server{
+		Handler: s.c.newHTTPHandler(),
+		BaseContext: func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), streamsStopKey{}, streamsStop)
+		},
+	}
+	srv.RegisterOnShutdown(func() { close(streamsStop) })
+	done := make(chan struct{})
+	s.srv, s.done = srv, done
+
+	go func() {
+		defer close(done)
+
+		s.c.logger.Info("Starting HTTP server", slog.String("addr", l.Addr().String()))
+		if err := srv.Serve(l); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			s.c.logger.Error("Unable to run HTTP server", slog.Any("err", err))
+		}
+	}()
+
+	return nil
+}
+
+// Stop gracefully shuts down the server, waiting for active requests until the
+// given context is done. It does nothing if the server isn't running. The
+// server can be started again afterwards.
+func (s *HTTPServer) Stop(ctx context.Context) error {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	if s.srv == nil {
+		return nil
+	}
+
+	s.c.logger.Info("Stopping HTTP server")
+	err := s.srv.Shutdown(ctx)
+	<-s.done
+	s.srv, s.done = nil, nil
+	return err
+}
+
+func (c *Crawler) newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/candidates", c.cached("candidates", c.handleCandidates))
+	mux.HandleFunc("/api/v1/bootstrap-health", c.cached("bootstrap-health", c.handleBootstrapHealth))
+	mux.HandleFunc("/api/v1/capabilities", c.cached("capabilities", c.handleCapabilities))
+	mux.HandleFunc("/api/v1/dense-ips", c.cached("dense-ips", c.handleDenseIPs))
+	mux.HandleFunc("/api/v1/events", c.handleEvents)
+	mux.HandleFunc("/api/v1/events/sse", c.handleEventsSSE)
+	mux.HandleFunc("/api/v1/export", c.handleExport)
+	mux.HandleFunc("/api/v1/nodes", c.handleNodes)
+	mux.HandleFunc("/api/v1/nodes/", c.handleNode)
+	mux.HandleFunc("/api/v1/rescan/status", c.handleRescanStatus)
+	mux.HandleFunc("/api/v1/transports", c.cached("transports", c.handleTransports))
+	mux.HandleFunc("/json", c.cached("json", c.handleNodesJSON))
+	if c.opts.AdminToken != "" {
+		mux.HandleFunc("/admin/nodes/", c.requireAdmin(c.handleAdminNode))
+	}
+	return mux
+}
+
+type capabilities struct {
+	Features capabilityFeatures `json:"features"`
+}
+
+type capabilityFeatures struct {
+	GeoIP       bool `json:"geoip"`
+	ASN         bool `json:"asn"`
+	TCPProbing  bool `json:"tcp_probing"`
+	OnionChecks bool `json:"onion_checks"`
+	IPv6        bool `json:"ipv6"`
+	History     bool `json:"history"`
+	Webhooks    bool `json:"webhooks"`
+	Export      bool `json:"export"`
+	// AnonymizedIPs is set if the IP addresses in API responses are masked
+	AnonymizedIPs bool `json:"anonymized_ips"`
+}
+
+// handleCapabilities reports which optional features are available on this
+// instance, so that clients can adapt to differently configured instances.
+func (c *Crawler) handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	writeHTTPJSON(w, http.StatusOK, &capabilities{
+		Features: capabilityFeatures{
+			IPv6:          c.crawlsIPv6(),
+			Export:        true,
+			AnonymizedIPs: c.opts.AnonymizeIPs,
+		},
+	})
+}
+
+// crawlsIPv6 reports whether the crawler probes IPv6 nodes. This is the case
+// unless it's restricted to IPv4, or the Tox UDP socket is bound to a specific
+// IPv4 address.
+func (c *Crawler) crawlsIPv6() bool {
+	if c.opts.AddressFamily == AddressFamilyIPv4 {
+		return false
+	}
+	addr := c.opts.ToxUDPConn.LocalAddr().(*net.UDPAddr)
+	return addr.IP == nil || addr.IP.IsUnspecified() || addr.IP.To4() == nil
+}
+
+// handleCandidates lists the nodes that are online and have been known to us
+// for at least min_age (default: 24h), but are not in the list of nodes the
+// crawler was bootstrapped from. These are candidates for inclusion in the
+// nodes.tox.chat list.
+func (c *Crawler) handleCandidates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	minAge := 24 * time.Hour
+	if s := r.URL.Query().Get("min_age"); s != "" {
+		var err error
+		if minAge, err = time.ParseDuration(s); err != nil || minAge < 0 {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad min_age: %s", s))
+			return
+		}
+	}
+
+	nodes, err := c.repo.GetOnlineNodes(r.Context())
+	if err != nil {
+		c.logger.Error("Unable to obtain online nodes", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	bsNodes := c.bootstrapNodes()
+	bsKeys := make(map[dht.PublicKey]struct{}, len(bsNodes))
+	for _, node := range bsNodes {
+		bsKeys[*node.PublicKey] = struct{}{}
+	}
+
+	candidates := []*models.Node{}
+	for _, node := range nodes {
+		if _, ok := bsKeys[*node.PublicKey]; ok {
+			continue
+		}
+		if !c.checkReputation(node) {
+			continue
+		}
+		if c.opts.Clock.Since(node.CreatedAt) < minAge {
+			continue
+		}
+		c.anonymizeNode(node)
+		candidates = append(candidates, node)
+	}
+
+	slices.SortFunc(candidates, func(a, b *models.Node) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	writeHTTPJSON(w, http.StatusOK, candidates)
+}
+
+// nodesJSON is the document served by nodes.tox.chat/json.
+type nodesJSON struct {
+	LastScan    int64            `json:"last_scan"`
+	LastRefresh int64            `json:"last_refresh"`
+	Nodes       []*nodesJSONNode `json:"nodes"`
+}
+
+type nodesJSONNode struct {
+	IPv4       string `json:"ipv4"`
+	IPv6       string `json:"ipv6"`
+	Port       int    `json:"port"`
+	TCPPorts   []int  `json:"tcp_ports"`
+	PublicKey  string `json:"public_key"`
+	Maintainer string `json:"maintainer"`
+	Location   string `json:"location"`
+	StatusUDP  bool   `json:"status_udp"`
+	StatusTCP  bool   `json:"status_tcp"`
+	Version    string `json:"version"`
+	MOTD       string `json:"motd"`
+	LastPing   int64  `json:"last_ping"`
+}
+
+// handleNodesJSON renders the online nodes in the format of nodes.tox.chat/json,
+// so that existing Tox tooling can be pointed at this instance instead. Only
+// the addresses that responded to us recently are included. Maintainers and
+// locations aren't tracked, so those fields are always empty. The nodes.tox.chat
+// list only has a single UDP port per node, shared by its IPv4 and IPv6
+// address, so if a node is online at multiple ports, the IPv4 address that
+// responded most recently picks the port, and the IPv6 address is left out if
+// it isn't online at that port. The list is meant for bootstrapping, which
+// masked IP addresses are useless for, so it isn't served if IP anonymization
+// is enabled.
+func (c *Crawler) handleNodesJSON(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if c.opts.AnonymizeIPs {
+		writeHTTPError(w, http.StatusNotFound, "not available with IP anonymization enabled")
+		return
+	}
+
+	nodes, err := c.repo.GetOnlineNodes(r.Context())
+	if err != nil {
+		c.logger.Error("Unable to obtain online nodes", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	// We scan continuously, so the list is as fresh as the moment it's rendered
+	now := c.opts.Clock.Now().Unix()
+	res := nodesJSON{LastScan: now, LastRefresh: now, Nodes: []*nodesJSONNode{}}
+	for _, node := range nodes {
+		if !c.checkReputation(node) {
+			continue
+		}
+		res.Nodes = append(res.Nodes, newNodesJSONNode(node))
+	}
+
+	slices.SortFunc(res.Nodes, func(a, b *nodesJSONNode) int {
+		return strings.Compare(a.PublicKey, b.PublicKey)
+	})
+
+	writeHTTPJSON(w, http.StatusOK, &res)
+}
+
+func newNodesJSONNode(node *models.Node) *nodesJSONNode {
+	res := &nodesJSONNode{
+		IPv4:      "-",
+		IPv6:      "-",
+		TCPPorts:  []int{},
+		PublicKey: strings.ToUpper(node.PublicKey.String()),
+	}
+	if node.MOTD != nil {
+		res.MOTD = *node.MOTD
+	}
+	if node.Version != 0 {
+		res.Version = strconv.FormatUint(uint64(node.Version), 10)
+	}
+
+	var udp4, udp6 *models.NodeAddress
+	for _, addr := range node.Addresses {
+		res.LastPing = max(res.LastPing, addr.LastPongAt.Unix())
+
+		switch addr.Net {
+		case "tcp4", "tcp6":
+			res.StatusTCP = true
+			if !slices.Contains(res.TCPPorts, addr.Port) {
+				res.TCPPorts = append(res.TCPPorts, addr.Port)
+			}
+		case "udp4":
+			if udp4 == nil || addr.LastPongAt.After(udp4.LastPongAt) {
+				udp4 = addr
+			}
+		}
+	}
+
+	// The port is shared by both IP addresses, so the IPv4 one picks it
+	for _, addr := range node.Addresses {
+		if addr.Net != "udp6" || (udp4 != nil && addr.Port != udp4.Port) {
+			continue
+		}
+		if udp6 == nil || addr.LastPongAt.After(udp6.LastPongAt) {
+			udp6 = addr
+		}
+	}
+	if udp4 != nil {
+		res.StatusUDP, res.IPv4, res.Port = true, udp4.IP, udp4.Port
+	}
+	if udp6 != nil {
+		res.StatusUDP, res.IPv6, res.Port = true, udp6.IP, udp6.Port
+	}
+	slices.Sort(res.TCPPorts)
+
+	return res
+}
+
+// The statuses of nodes and node addresses in the bootstrap health report
+const (
+	bootstrapStatusUp        = "up"
+	bootstrapStatusStale     = "stale"
+	bootstrapStatusDown      = "down"
+	bootstrapStatusUntracked = "untracked"
+	bootstrapStatusUnknown   = "unknown"
+)
+
+type bootstrapHealth struct {
+	PublicKey string `json:"public_key"`
+	Status    string `json:"status"`
+	// Addresses are the addresses advertised in the nodes.tox.chat list
+	Addresses []*bootstrapHealthAddr `json:"addresses"`
+	// UnadvertisedAddresses are the online addresses of the node that are
+	// not in the nodes.tox.chat list
+	UnadvertisedAddresses []*bootstrapHealthAddr `json:"unadvertised_addresses"`
+	Problems              []string               `json:"problems"`
+}
+
+type bootstrapHealthAddr struct {
+	Net    string `json:"net"`
+	Addr   string `json:"addr"`
+	Status string `json:"status"`
+}
+
+// handleBootstrapHealth checks the nodes from the nodes.tox.chat list that the
+// crawler was bootstrapped from against what the crawler has seen of them. A
+// node is up if any of its advertised addresses is. Every advertised address
+// that isn't up, and every online address that isn't advertised, is reported
+// as a problem, so that the list can be corrected. Addresses of an address
+// family that the crawler doesn't probe are unknown, rather than down.
+func (c *Crawler) handleBootstrapHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// The list has an entry per address, so group them by node
+	var keys []dht.PublicKey
+	advertised := make(map[dht.PublicKey][]*dht.Node)
+	for _, node := range c.bootstrapNodes() {
+		if _, ok := advertised[*node.PublicKey]; !ok {
+			keys = append(keys, *node.PublicKey)
+		}
+		advertised[*node.PublicKey] = append(advertised[*node.PublicKey], node)
+	}
+
+	res := make([]*bootstrapHealth, 0, len(keys))
+	for _, pk := range keys {
+		node, err := c.repo.GetNodeByPublicKey(r.Context(), &pk)
+		if err != nil && !errors.Is(err, repo.ErrNotFound) {
+			c.logger.Error("Unable to obtain node", slog.Any("err", err))
+			writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+			return
+		}
+
+		known := make(map[string]*models.NodeAddress)
+		if node != nil {
+			for _, addr := range node.Addresses {
+				known[addr.Net+"/"+net.JoinHostPort(addr.IP, strconv.Itoa(addr.Port))] = addr
+			}
+		}
+
+		health := &bootstrapHealth{
+			PublicKey:             pk.String(),
+			Status:                bootstrapStatusDown,
+			Addresses:             []*bootstrapHealthAddr{},
+			UnadvertisedAddresses: []*bootstrapHealthAddr{},
+			Problems:              []string{},
+		}
+		var unknown int
+		for _, bsNode := range advertised[pk] {
+			key := bsNode.Type.Net() + "/" + bsNode.Addr().String()
+			addr := &bootstrapHealthAddr{
+				Net:    bsNode.Type.Net(),
+				Addr:   net.JoinHostPort(c.publicIP(bsNode.IP.String()), strconv.Itoa(bsNode.Port)),
+				Status: c.addressStatus(known[key]),
+			}
+			delete(known, key)
+
+			// Addresses of a family that isn't probed can't be judged
+			if !c.probesFamily(bsNode.IP) {
+				addr.Status = bootstrapStatusUnknown
+			}
+
+			health.Addresses = append(health.Addresses, addr)
+			if addr.Status == bootstrapStatusUnknown {
+				unknown++
+			} else if addr.Status == bootstrapStatusUp {
+				health.Status = bootstrapStatusUp
+			} else {
+				health.Problems = append(health.Problems,
+					fmt.Sprintf("advertised %s address %s is %s", addressFamily(bsNode.IP), addr.Addr, addr.Status))
+			}
+		}
+		if unknown == len(advertised[pk]) {
+			health.Status = bootstrapStatusUnknown
+		}
+		for _, addr := range known {
+			if c.addressStatus(addr) == bootstrapStatusUp {
+				health.UnadvertisedAddresses = append(health.UnadvertisedAddresses, &bootstrapHealthAddr{
+					Net:    addr.Net,
+					Addr:   net.JoinHostPort(c.publicIP(addr.IP), strconv.Itoa(addr.Port)),
+					Status: bootstrapStatusUp,
+				})
+			}
+		}
+		slices.SortFunc(health.UnadvertisedAddresses, func(a, b *bootstrapHealthAddr) int {
+			return strings.Compare(a.Addr, b.Addr)
+		})
+		for _, addr := range health.UnadvertisedAddresses {
+			health.Problems = append(health.Problems, fmt.Sprintf("online at unadvertised address %s", addr.Addr))
+		}
+
+		res = append(res, health)
+	}
+
+	writeHTTPJSON(w, http.StatusOK, res)
+}
+
+// addressStatus returns the bootstrap health status of the given node address,
+// which may be nil if it isn't tracked.
+func (c *Crawler) addressStatus(addr *models.NodeAddress) string {
+	switch {
+	case addr == nil:
+		return bootstrapStatusUntracked
+	case addr.LastPongAt.IsZero():
+		return bootstrapStatusDown
+	case c.opts.Clock.Since(addr.LastPongAt) >= repo.NodeTimeout:
+		return bootstrapStatusStale
+	default:
+		return bootstrapStatusUp
+	}
+}
+
+func addressFamily(ip net.IP) string {
+	if ip.To4() != nil {
+		return "IPv4"
+	}
+	return "IPv6"
+}
+
+type denseIP struct {
+	IP         string   `json:"ip"`
+	PublicKeys []string `json:"public_keys"`
+}
+
+// handleDenseIPs reports the IP addresses that are shared by more than
+// threshold (default: 3) distinct nodes.
+func (c *Crawler) handleDenseIPs(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	threshold := 3
+	if s := r.URL.Query().Get("threshold"); s != "" {
+		var err error
+		if threshold, err = strconv.Atoi(s); err != nil || threshold < 1 {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad threshold: %s", s))
+			return
+		}
+	}
+
+	ips, err := c.repo.GetDenseIPs(r.Context(), threshold)
+	if err != nil {
+		c.logger.Error("Unable to obtain dense IPs", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	res := make([]*denseIP, 0, len(ips))
+	for _, ip := range ips {
+		entry := &denseIP{IP: c.publicIP(ip.IP)}
+		for _, pk := range ip.PublicKeys {
+			entry.PublicKeys = append(entry.PublicKeys, pk.String())
+		}
+		res = append(res, entry)
+	}
+
+	writeHTTPJSON(w, http.StatusOK, res)
+}
+
+type listedNode struct {
+	PublicKey  string                `json:"public_key"`
+	Status     string                `json:"status"`
+	CreatedAt  time.Time             `json:"created_at"`
+	LastSeenAt time.Time             `json:"last_seen_at"`
+	Addresses  []*models.NodeAddress `json:"addresses"`
+}
+
+const (
+	defaultNodesPerPage = 100
+	maxNodesPerPage     = 1000
+)
+
+// listStatuses maps the values of the status parameter of the node listing to
+// the statuses of the repo.
+var listStatuses = map[string]string{"online": repo.NodeStatusUp, "offline": repo.NodeStatusDown}
+
+// handleNodes lists a page of the known nodes with their addresses and whether
+// they're up or down. The page is selected with the page (default: 1) and
+// per_page (default: 100, at most 1000) parameters, and the sort order with the
+// sort parameter: last_seen (default) or first_seen, most recent first. The
+// nodes can be filtered with the status (online or offline), net (udp or tcp)
+// and family (ipv4 or ipv6) parameters, which are combined as described in
+// repo.NodeFilters. The total number of matching nodes is sent in the
+// X-Total-Count header. Nodes that are excluded by the reputation feed are
+// left out before paging, so they don't count towards the total either. Use
+// the export to get all nodes at once.
+func (c *Crawler) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	page := 1
+	if s := query.Get("page"); s != "" {
+		var err error
+		if page, err = strconv.Atoi(s); err != nil || page < 1 {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad page: %s", s))
+			return
+		}
+	}
+	perPage := defaultNodesPerPage
+	if s := query.Get("per_page"); s != "" {
+		var err error
+		if perPage, err = strconv.Atoi(s); err != nil || perPage < 1 || perPage > maxNodesPerPage {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad per_page: %s (must be between 1 and %d)", s, maxNodesPerPage))
+			return
+		}
+	}
+	sort := query.Get("sort")
+	if sort != "" && !slices.Contains(repo.NodeSorts, sort) {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad sort: %s (must be one of: %s)", sort, strings.Join(repo.NodeSorts, ", ")))
+		return
+	}
+
+	var filters repo.NodeFilters
+	if s := query.Get("status"); s != "" {
+		var ok bool
+		if filters.Status, ok = listStatuses[s]; !ok {
+			writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad status: %s (must be online or offline)", s))
+			return
+		}
+	}
+	if filters.Net = query.Get("net"); filters.Net != "" && !slices.Contains(repo.NodeNets, filters.Net) {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad net: %s (must be one of: %s)", filters.Net, strings.Join(repo.NodeNets, ", ")))
+		return
+	}
+	if filters.Family = query.Get("family"); filters.Family != "" && !slices.Contains(repo.NodeFamilies, filters.Family) {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad family: %s (must be one of: %s)", filters.Family, strings.Join(repo.NodeFamilies, ", ")))
+		return
+	}
+
+	// The reputation feed can't be checked by the db, so if it excludes
+	// nodes, all matching nodes are obtained to page through them here
+	opts := repo.PageOptions{
+		Sort:    sort,
+		Limit:   perPage,
+		Offset:  (page - 1) * perPage,
+		Filters: filters,
+	}
+	excluding := c.opts.ReputationExclude && c.opts.ReputationFeed != nil
+	if excluding {
+		opts.Limit, opts.Offset = -1, 0
+	}
+	nodes, total, err := c.repo.GetNodesPage(r.Context(), opts)
+	if err != nil {
+		c.logger.Error("Unable to obtain nodes", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if excluding {
+		nodes = slices.DeleteFunc(nodes, func(node *models.Node) bool {
+			return !c.checkReputation(node)
+		})
+		total = int64(len(nodes))
+		offset := min(len(nodes), (page-1)*perPage)
+		nodes = nodes[offset:min(len(nodes), offset+perPage)]
+	}
+
+	res := make([]*listedNode, 0, len(nodes))
+	for _, node := range nodes {
+		if !c.checkReputation(node) {
+			continue
+		}
+		c.anonymizeNode(node)
+		res = append(res, &listedNode{
+			PublicKey:  node.PublicKey.String(),
+			Status:     c.nodeStatus(node),
+			CreatedAt:  node.CreatedAt.UTC(),
+			LastSeenAt: node.LastSeenAt.UTC(),
+			Addresses:  node.Addresses,
+		})
+	}
+
+	w.Header().Set("X-Total-Count", strconv.FormatInt(total, 10))
+	writeHTTPJSON(w, http.StatusOK, res)
+}
+
+// nodeStatus returns repo.NodeStatusUp if one of the addresses of the given
+// node responded to us within repo.NodeTimeout, and repo.NodeStatusDown
+// otherwise.
+func (c *Crawler) nodeStatus(node *models.Node) string {
+	for _, addr := range node.Addresses {
+		if c.addressUp(addr) {
+			return repo.NodeStatusUp
+		}
+	}
+	return repo.NodeStatusDown
+}
+
+// addressUp reports whether the given node address responded to us within
+// repo.NodeTimeout.
+func (c *Crawler) addressUp(addr *models.NodeAddress) bool {
+	return !addr.LastPongAt.IsZero() && c.opts.Clock.Since(addr.LastPongAt) < repo.NodeTimeout
+}
+
+// handleNode routes the requests for a single node, identified by the public
+// key in the path: /api/v1/nodes/{public_key}[/...]. The node is looked up here
+// for all routes, so that none of them can miss the reputation check: nodes
+// that are excluded by the reputation feed aren't found.
+func (c *Crawler) handleNode(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rest := strings.TrimPrefix(r.URL.Path, "/api/v1/nodes/")
+	pkStr, sub, _ := strings.Cut(rest, "/")
+	pk, err := models.ParsePublicKey(pkStr)
+	if err != nil {
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("bad public key: %s", pkStr))
+		return
+	}
+
+	var handle func(w http.ResponseWriter, r *http.Request, node *models.Node)
+	switch sub {
+	case "":
+		handle = c.handleNodeDetail
+	case "addresses":
+		handle = c.handleNodeAddresses
+	default:
+		writeHTTPError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	node, err := c.repo.GetNodeByPublicKey(r.Context(), pk)
+	if err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			writeHTTPError(w, http.StatusNotFound, "node not found")
+			return
+		}
+		c.logger.Error("Unable to obtain node", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+	if !c.checkReputation(node) {
+		writeHTTPError(w, http.StatusNotFound, "node not found")
+		return
+	}
+
+	c.anonymizeNode(node)
+	handle(w, r, node)
+}
+
+type nodeDetail struct {
+	Node   *models.Node `json:"node"`
+	Status string       `json:"status"`
+	// AddressStatuses holds whether each of the addresses of the node is up
+	// or down, in the same order as node.addresses
+	AddressStatuses []string `json:"address_statuses"`
+	// Ports are the distinct ports that the node has been seen on, sorted
+	Ports []int `json:"ports"`
+	// LastResponseAt is the last time that any of the addresses of the node
+	// responded to us, or null if none ever did
+	LastResponseAt *time.Time `json:"last_response_at"`
+}
+
+// handleNodeDetail reports everything we know about the given node: all
+// addresses it has been seen at, newest first, whether each of them is up, and
+// when it was first discovered (the created_at field of the node).
+func (c *Crawler) handleNodeDetail(w http.ResponseWriter, r *http.Request, node *models.Node) {
+	slices.SortStableFunc(node.Addresses, func(a, b *models.NodeAddress) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	res := &nodeDetail{
+		Node:            node,
+		Status:          c.nodeStatus(node),
+		AddressStatuses: []string{},
+		Ports:           []int{},
+	}
+	var lastResponse time.Time
+	for _, addr := range node.Addresses {
+		status := repo.NodeStatusDown
+		if c.addressUp(addr) {
+			status = repo.NodeStatusUp
+		}
+		res.AddressStatuses = append(res.AddressStatuses, status)
+		if !slices.Contains(res.Ports, addr.Port) {
+			res.Ports = append(res.Ports, addr.Port)
+		}
+		if addr.LastPongAt.After(lastResponse) {
+			lastResponse = addr.LastPongAt
+		}
+	}
+	slices.Sort(res.Ports)
+	if !lastResponse.IsZero() {
+		lastResponse = lastResponse.UTC()
+		res.LastResponseAt = &lastResponse
+	}
+
+	writeHTTPJSON(w, http.StatusOK, res)
+}
+
+// handleNodeAddresses lists all addresses that the given node has been seen at,
+// newest first. The created_at and last_seen_at fields of each address say
+// when the node was first and last seen at it.
+func (c *Crawler) handleNodeAddresses(w http.ResponseWriter, r *http.Request, node *models.Node) {
+	addrs := slices.Clone(node.Addresses)
+	slices.SortStableFunc(addrs, func(a, b *models.NodeAddress) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	writeHTTPJSON(w, http.StatusOK, addrs)
+}
+
+// handleRescanStatus reports the progress of the most recent rescan. Rescans
+// are started and canceled with the rescan subcommand.
+func (c *Crawler) handleRescanStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	rescan, err := c.repo.GetRescan(r.Context())
+	if err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			writeHTTPJSON(w, http.StatusOK, map[string]string{"status": "none"})
+			return
+		}
+		c.logger.Error("Unable to obtain rescan", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	writeHTTPJSON(w, http.StatusOK, rescan)
+}
+
+type transportStats struct {
+	Total     int `json:"total"`
+	UDPOnly   int `json:"udp_only"`
+	TCPOnly   int `json:"tcp_only"`
+	UDPAndTCP int `json:"udp_and_tcp"`
+	IPv4Only  int `json:"ipv4_only"`
+	IPv6Only  int `json:"ipv6_only"`
+	DualStack int `json:"dual_stack"`
+}
+
+// handleTransports summarizes over which transports and address families the
+// online nodes are reachable. A node counts towards a transport or address
+// family if at least one of its online addresses uses it.
+func (c *Crawler) handleTransports(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	nodes, err := c.repo.GetOnlineNodes(r.Context())
+	if err != nil {
+		c.logger.Error("Unable to obtain online nodes", slog.Any("err", err))
+		writeHTTPError(w, http.StatusInternalServerError, "internal server error")
+		return
+	}
+
+	var stats transportStats
+	for _, node := range nodes {
+		if !c.checkReputation(node) {
+			continue
+		}
+
+		var udp, tcp, ipv4, ipv6 bool
+		for _, addr := range node.Addresses {
+			switch addr.Net {
+			case "udp4":
+				udp, ipv4 = true, true
+			case "udp6":
+				udp, ipv6 = true, true
+			case "tcp4":
+				tcp, ipv4 = true, true
+			case "tcp6":
+				tcp, ipv6 = true, true
+			}
+		}
+
+		stats.Total++
+		switch {
+		case udp && tcp:
+			stats.UDPAndTCP++
+		case udp:
+			stats.UDPOnly++
+		case tcp:
+			stats.TCPOnly++
+		}
+		switch {
+		case ipv4 && ipv6:
+			stats.DualStack++
+		case ipv4:
+			stats.IPv4Only++
+		case ipv6:
+			stats.IPv6Only++
+		}
+	}
+
+	writeHTTPJSON(w, http.StatusOK, &stats)
+}
+
+// handleExport streams the full node table to the client as newline-delimited
+// JSON, optionally gzip-compressed. The nodes are written as they're read from
+// the db, so memory usage stays bounded for large databases.
+func (c *Crawler) handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeHTTPError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	switch format := query.Get("format"); format {
+	case "", "ndjson":
+	default:
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("unsupported format: %s", format))
+		return
+	}
+
+	var gzipped bool
+	switch compress := query.Get("compress"); compress {
+	case "", "none":
+	case "gzip":
+		gzipped = true
+	default:
+		writeHTTPError(w, http.StatusBadRequest, fmt.Sprintf("unsupported compression: %s", compress))
+		return
+	}
+
+	filename := fmt.Sprintf("toxstatus-nodes-%s.ndjson", c.opts.Clock.Now().UTC().Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+
+	var out io.Writer = w
+	if gzipped {
+		w.Header().Set("Content-Encoding", "gzip")
+		gw := gzip.NewWriter(w)
+		defer gw.Close()
+		out = gw
+	}
+
+	enc := json.NewEncoder(out)
+	if err := c.repo.ForEachNode(r.Context(), func(node *models.Node) error {
+		if !c.checkReputation(node) {
+			return nil
+		}
+		c.anonymizeNode(node)
+		return enc.Encode(node)
+	}); err != nil {
+		// The response headers have already been sent at this point, so all
+		// we can do is log the error and cut the export short
+		c.logger.Error("Unable to export nodes", slog.Any("err", err))
+	}
+}
+
+// checkReputation flags the given node if any of its addresses is in a range
+// of the reputation feed. It reports whether the node should be included in API
+// responses.
+func (c *Crawler) checkReputation(node *models.Node) bool {
+	if c.opts.ReputationFeed == nil {
+		return true
+	}
+
+	for _, addr := range node.Addresses {
+		if ip := net.ParseIP(addr.IP); ip != nil && c.opts.ReputationFeed.Contains(ip) {
+			node.ReputationFlagged = true
+			break
+		}
+	}
+
+	return !node.ReputationFlagged || !c.opts.ReputationExclude
+}
+
+// publicIP returns the given IP address as it's shown in API responses.
+func (c *Crawler) publicIP(ip string) string {
+	if !c.opts.AnonymizeIPs {
+		return ip
+	}
+	return models.AnonymizeIP(ip)
+}
+
+// anonymizeNode masks the addresses of the given node for API responses, if
+// IP anonymization is enabled. Reputation checks must be done before this.
+func (c *Crawler) anonymizeNode(node *models.Node) {
+	if !c.opts.AnonymizeIPs {
+		return
+	}
+
+	for _, addr := range node.Addresses {
+		addr.IP = models.AnonymizeIP(addr.IP)
+		addr.Ptr = nil
+	}
+}
+
+func writeHTTPJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeHTTPError(w http.ResponseWriter, status int, msg string) {
+	writeHTTPJSON(w, status, struct {
+		Error string `json:"error"`
+	}{Error: msg})
+}
@@ -0,0 +1,1120 @@
+package crawler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/clock"
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/2mf/ToxStatus/internal/reputation"
+	"github.com/alexbakker/tox4go/dht"
+	"github.com/alexbakker/tox4go/toxstatus"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var ctx = context.Background()
+
+func init() {
+	db.RegisterPragmaHook(2000, "normal")
+}
+
+func initCrawler(t *testing.T) *Crawler {
+	readConn, writeConn, err := db.OpenReadWrite(ctx, ":memory:", db.OpenOptions{
+		Params: map[string]string{"cache": "shared"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		readConn.Close()
+		writeConn.Close()
+	})
+
+	c, err := New(repo.New(readConn, writeConn), CrawlerOptions{
+		Logger:  slog.New(slog.NewTextHandler(io.Discard, nil)),
+		Workers: 2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+func generateDHTNode(t *testing.T) *dht.Node {
+	ip := make([]byte, 4)
+	if _, err := rand.Read(ip); err != nil {
+		t.Fatal(err)
+	}
+
+	ident, err := dht.NewIdentity(dht.IdentityOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &dht.Node{
+		Type:      dht.NodeTypeUDPIP4,
+		PublicKey: ident.PublicKey,
+		IP:        net.IP(ip),
+		Port:      33445,
+	}
+}
+
+func TestExportGzip(t *testing.T) {
+	c := initCrawler(t)
+
+	keys := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		node := generateDHTNode(t)
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+		keys[node.PublicKey.String()] = true
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/export?format=ndjson&compress=gzip", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	res := rec.Result()
+	if res.StatusCode != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", res.StatusCode)
+	}
+	if enc := res.Header.Get("Content-Encoding"); enc != "gzip" {
+		t.Fatalf("unexpected content encoding: %s", enc)
+	}
+
+	gr, err := gzip.NewReader(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var count int
+	scanner := bufio.NewScanner(gr)
+	for scanner.Scan() {
+		var node struct {
+			PublicKey string `json:"public_key"`
+			Addresses []struct {
+				IP string `json:"ip"`
+			} `json:"addresses"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &node); err != nil {
+			t.Fatal(err)
+		}
+		if !keys[node.PublicKey] {
+			t.Fatalf("unexpected node in export: %s", node.PublicKey)
+		}
+		if len(node.Addresses) != 1 {
+			t.Fatalf("unexpected number of addresses: %d", len(node.Addresses))
+		}
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if count != len(keys) {
+		t.Fatalf("expected %d nodes, got %d", len(keys), count)
+	}
+}
+
+func TestExportBadFormat(t *testing.T) {
+	c := initCrawler(t)
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/export?format=xml", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+}
+
+func TestCandidates(t *testing.T) {
+	c := initCrawler(t)
+
+	var nodes []*dht.Node
+	for i := 0; i < 3; i++ {
+		node := generateDHTNode(t)
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	// The first two nodes are online, but the first one is a bootstrap node
+	for _, node := range nodes[:2] {
+		if err := c.repo.PongDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.bsNodes = nodes[:1]
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/candidates?min_age=0s", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	var res []struct {
+		PublicKey string `json:"public_key"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].PublicKey != nodes[1].PublicKey.String() {
+		t.Fatalf("unexpected candidates: %v", res)
+	}
+
+	// With the default minimum age, none of the freshly tracked nodes qualify
+	req = httptest.NewRequest(http.MethodGet, "/api/v1/candidates", nil)
+	rec = httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	res = nil
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 0 {
+		t.Fatalf("unexpected candidates: %v", res)
+	}
+}
+
+func TestNodesJSON(t *testing.T) {
+	c := initCrawler(t)
+
+	var nodes []*dht.Node
+	for i := 0; i < 3; i++ {
+		node := generateDHTNode(t)
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	// Only the first two nodes are online
+	for _, node := range nodes[:2] {
+		if err := c.repo.PongDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	srv := httptest.NewServer(c.newHTTPHandler())
+	defer srv.Close()
+
+	// The document has to be parseable by the same client we use to fetch
+	// the nodes.tox.chat list
+	tsClient := toxstatus.Client{URL: srv.URL + "/json"}
+	res, err := tsClient.GetNodes(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 nodes, got: %v", res)
+	}
+	for _, node := range res {
+		i := slices.IndexFunc(nodes[:2], func(n *dht.Node) bool {
+			return *n.PublicKey == *node.PublicKey
+		})
+		if i == -1 {
+			t.Fatalf("unexpected node: %s", node.PublicKey)
+		}
+		if !node.IP.Equal(nodes[i].IP) || node.Port != nodes[i].Port || node.Type != dht.NodeTypeUDPIP4 {
+			t.Fatalf("unexpected address of node %s: %s:%d", node.PublicKey, node.IP, node.Port)
+		}
+	}
+
+	httpRes, err := http.Get(srv.URL + "/json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer httpRes.Body.Close()
+
+	var doc map[string]any
+	if err := json.NewDecoder(httpRes.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"last_scan", "last_refresh", "nodes"} {
+		if _, ok := doc[key]; !ok {
+			t.Fatalf("missing key %s in document", key)
+		}
+	}
+	node := doc["nodes"].([]any)[0].(map[string]any)
+	for _, key := range []string{
+		"ipv4", "ipv6", "port", "tcp_ports", "public_key", "maintainer", "location",
+		"status_udp", "status_tcp", "version", "motd", "last_ping",
+	} {
+		if _, ok := node[key]; !ok {
+			t.Fatalf("missing key %s in node: %v", key, node)
+		}
+	}
+	if node["ipv6"] != "-" || node["status_udp"] != true || node["status_tcp"] != false {
+		t.Fatalf("unexpected node: %v", node)
+	}
+
+	// Masked addresses can't be bootstrapped from
+	c.opts.AnonymizeIPs = true
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/json", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code with anonymized IPs: %d", rec.Code)
+	}
+}
+
+func TestNodesJSONDualStack(t *testing.T) {
+	pk := generateDHTNode(t).PublicKey
+	now := time.Now()
+	node := &models.Node{PublicKey: pk}
+	node.Addresses = []*models.NodeAddress{
+		{Net: "udp4", IP: "192.0.2.1", Port: 33445, LastPongAt: now},
+		{Net: "udp6", IP: "2001:db8::1", Port: 443, LastPongAt: now.Add(time.Second)},
+	}
+
+	// The IPv6 address isn't online at the port of the IPv4 address
+	res := newNodesJSONNode(node)
+	if res.IPv4 != "192.0.2.1" || res.IPv6 != "-" || res.Port != 33445 {
+		t.Fatalf("unexpected node: %+v", res)
+	}
+
+	node.Addresses = append(node.Addresses, &models.NodeAddress{Net: "udp6", IP: "2001:db8::2", Port: 33445, LastPongAt: now})
+	res = newNodesJSONNode(node)
+	if res.IPv4 != "192.0.2.1" || res.IPv6 != "2001:db8::2" || res.Port != 33445 {
+		t.Fatalf("unexpected node: %+v", res)
+	}
+
+	// Without an IPv4 address, the IPv6 one picks the port
+	node.Addresses = node.Addresses[1:2]
+	res = newNodesJSONNode(node)
+	if res.IPv4 != "-" || res.IPv6 != "2001:db8::1" || res.Port != 443 {
+		t.Fatalf("unexpected node: %+v", res)
+	}
+}
+
+func TestDenseIPs(t *testing.T) {
+	c := initCrawler(t)
+
+	// Three nodes share an IP, one of them on two different ports
+	shared := generateDHTNode(t)
+	keys := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		node := generateDHTNode(t)
+		node.IP = shared.IP
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+		keys[node.PublicKey.String()] = true
+
+		if i == 0 {
+			node.Port++
+			if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if _, err := c.repo.TrackDHTNode(ctx, generateDHTNode(t)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Threshold string
+		Count     int
+	}{{"2", 1}, {"3", 0}} {
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/dense-ips?threshold="+tc.Threshold, nil)
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", rec.Code)
+		}
+
+		var res []struct {
+			IP         string   `json:"ip"`
+			PublicKeys []string `json:"public_keys"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if len(res) != tc.Count {
+			t.Fatalf("threshold %s: expected %d dense ips, got: %v", tc.Threshold, tc.Count, res)
+		}
+		if tc.Count == 0 {
+			continue
+		}
+
+		if res[0].IP != shared.IP.String() || len(res[0].PublicKeys) != len(keys) {
+			t.Fatalf("unexpected dense ip: %v", res[0])
+		}
+		for _, pk := range res[0].PublicKeys {
+			if !keys[pk] {
+				t.Fatalf("unexpected public key: %s", pk)
+			}
+		}
+	}
+}
+
+// newReputationFeed returns a reputation feed that flags the given IPs.
+func newReputationFeed(t *testing.T, ips ...net.IP) *reputation.Feed {
+	var lines []string
+	for _, ip := range ips {
+		lines = append(lines, ip.String())
+	}
+
+	feedFile := filepath.Join(t.TempDir(), "feed.txt")
+	if err := os.WriteFile(feedFile, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	feed, err := reputation.Load(feedFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return feed
+}
+
+func TestExportReputation(t *testing.T) {
+	c := initCrawler(t)
+
+	flagged, clean := generateDHTNode(t), generateDHTNode(t)
+	for _, node := range []*dht.Node{flagged, clean} {
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.opts.ReputationFeed = newReputationFeed(t, flagged.IP)
+
+	for _, exclude := range []bool{false, true} {
+		c.opts.ReputationExclude = exclude
+
+		req := httptest.NewRequest(http.MethodGet, "/api/v1/export", nil)
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, req)
+
+		res := make(map[string]bool)
+		dec := json.NewDecoder(rec.Body)
+		for dec.More() {
+			var node struct {
+				PublicKey         string `json:"public_key"`
+				ReputationFlagged bool   `json:"reputation_flagged"`
+			}
+			if err := dec.Decode(&node); err != nil {
+				t.Fatal(err)
+			}
+			res[node.PublicKey] = node.ReputationFlagged
+		}
+
+		if isFlagged, ok := res[clean.PublicKey.String()]; !ok || isFlagged {
+			t.Fatalf("exclude %t: expected clean node to be exported unflagged: %v", exclude, res)
+		}
+		isFlagged, ok := res[flagged.PublicKey.String()]
+		if exclude && ok {
+			t.Fatalf("expected flagged node to be excluded: %v", res)
+		}
+		if !exclude && !isFlagged {
+			t.Fatalf("expected node to be flagged: %v", res)
+		}
+	}
+}
+
+func TestTransports(t *testing.T) {
+	c := initCrawler(t)
+
+	ipv4 := generateDHTNode(t)
+	dualStack := generateDHTNode(t)
+	offline := generateDHTNode(t)
+	nodes := []*dht.Node{ipv4, dualStack, offline}
+
+	ipv6 := *dualStack
+	ipv6.Type = dht.NodeTypeUDPIP6
+	ipv6.IP = net.ParseIP("2001:db8::1")
+	nodes = append(nodes, &ipv6)
+
+	for _, node := range nodes {
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+		if node != offline {
+			if err := c.repo.PongDHTNode(ctx, node); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/transports", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	var res transportStats
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := transportStats{Total: 2, UDPOnly: 2, IPv4Only: 1, DualStack: 1}
+	if res != expected {
+		t.Fatalf("unexpected transport stats: %+v (expected %+v)", res, expected)
+	}
+}
+
+func TestNodeAddresses(t *testing.T) {
+	c := initCrawler(t)
+
+	node := generateDHTNode(t)
+	var ips []string
+	for i := 0; i < 3; i++ {
+		node.IP = net.IPv4(192, 0, 2, byte(i+1))
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+		ips = append(ips, node.IP.String())
+
+		// Make sure the addresses don't share a creation time
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/nodes/"+node.PublicKey.String()+"/addresses", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	var res []struct {
+		IP         string  `json:"ip"`
+		CreatedAt  string  `json:"created_at"`
+		LastSeenAt *string `json:"last_seen_at"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != len(ips) {
+		t.Fatalf("expected %d addresses, got: %v", len(ips), res)
+	}
+	for i, addr := range res {
+		if expected := ips[len(ips)-1-i]; addr.IP != expected {
+			t.Fatalf("address %d: expected %s, got %s", i, expected, addr.IP)
+		}
+	}
+
+	for path, status := range map[string]int{
+		"/api/v1/nodes/" + generateDHTNode(t).PublicKey.String() + "/addresses": http.StatusNotFound,
+		"/api/v1/nodes/" + node.PublicKey.String() + "/bogus":                   http.StatusNotFound,
+		"/api/v1/nodes/abcd/addresses":                                          http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != status {
+			t.Fatalf("%s: expected status code %d, got %d", path, status, rec.Code)
+		}
+	}
+
+	// The address history of a node that the reputation feed excludes isn't
+	// served either
+	c.opts.ReputationFeed, c.opts.ReputationExclude = newReputationFeed(t, net.ParseIP(ips[0])), true
+	rec = httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Fatalf("expected excluded node not to be found, got status code %d", rec.Code)
+	}
+}
+
+func TestNodes(t *testing.T) {
+	c := initCrawler(t)
+
+	get := func(path string) ([]map[string]any, string) {
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: unexpected status code: %d", path, rec.Code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Fatalf("%s: unexpected content type: %s", path, ct)
+		}
+
+		var res []map[string]any
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res, rec.Header().Get("X-Total-Count")
+	}
+
+	if res, total := get("/api/v1/nodes"); res == nil || len(res) != 0 || total != "0" {
+		t.Fatalf("expected an empty list, got: %v (total: %s)", res, total)
+	}
+
+	up, down := generateDHTNode(t), generateDHTNode(t)
+	for _, node := range []*dht.Node{up, down} {
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.repo.PongDHTNode(ctx, up); err != nil {
+		t.Fatal(err)
+	}
+
+	res, total := get("/api/v1/nodes")
+	if len(res) != 2 || total != "2" {
+		t.Fatalf("expected 2 nodes, got: %v (total: %s)", res, total)
+	}
+	expected := map[string]string{
+		up.PublicKey.String():   repo.NodeStatusUp,
+		down.PublicKey.String(): repo.NodeStatusDown,
+	}
+	for _, node := range res {
+		for _, key := range []string{"public_key", "status", "created_at", "last_seen_at", "addresses"} {
+			if _, ok := node[key]; !ok {
+				t.Fatalf("missing key %s in node: %v", key, node)
+			}
+		}
+		pk := node["public_key"].(string)
+		if status := node["status"]; status != expected[pk] {
+			t.Fatalf("node %s: expected status %s, got %v", pk, expected[pk], status)
+		}
+
+		addrs := node["addresses"].([]any)
+		if len(addrs) != 1 {
+			t.Fatalf("node %s: expected 1 address, got: %v", pk, addrs)
+		}
+		addr := addrs[0].(map[string]any)
+		for _, key := range []string{"ip", "port", "net", "last_ping_at", "last_pong_at"} {
+			if _, ok := addr[key]; !ok {
+				t.Fatalf("missing key %s in address: %v", key, addr)
+			}
+		}
+	}
+
+	// The page is small enough to only fit one of the nodes, but the total
+	// still counts both of them
+	for _, path := range []string{"/api/v1/nodes?per_page=1", "/api/v1/nodes?per_page=1&page=2&sort=first_seen"} {
+		res, total := get(path)
+		if len(res) != 1 || total != "2" {
+			t.Fatalf("%s: expected 1 node, got: %v (total: %s)", path, res, total)
+		}
+	}
+	if res, _ := get("/api/v1/nodes?page=3&per_page=1"); len(res) != 0 {
+		t.Fatalf("expected an empty page, got: %v", res)
+	}
+
+	for path, pk := range map[string]string{
+		"/api/v1/nodes?status=online":                      up.PublicKey.String(),
+		"/api/v1/nodes?status=offline&net=udp&family=ipv4": down.PublicKey.String(),
+	} {
+		res, total := get(path)
+		if len(res) != 1 || total != "1" || res[0]["public_key"] != pk {
+			t.Fatalf("%s: expected node %s, got: %v (total: %s)", path, pk, res, total)
+		}
+	}
+	if res, total := get("/api/v1/nodes?net=tcp"); len(res) != 0 || total != "0" {
+		t.Fatalf("expected no tcp nodes, got: %v (total: %s)", res, total)
+	}
+
+	// Nodes excluded by the reputation feed count towards neither the page
+	// nor the total
+	c.opts.ReputationFeed, c.opts.ReputationExclude = newReputationFeed(t, up.IP), true
+	if res, total := get("/api/v1/nodes?per_page=1"); len(res) != 1 || total != "1" || res[0]["public_key"] != down.PublicKey.String() {
+		t.Fatalf("expected only node %s, got: %v (total: %s)", down.PublicKey, res, total)
+	}
+	if res, _ := get("/api/v1/nodes?per_page=1&page=2"); len(res) != 0 {
+		t.Fatalf("expected an empty page, got: %v", res)
+	}
+	c.opts.ReputationFeed, c.opts.ReputationExclude = nil, false
+
+	for _, query := range []string{
+		"page=0", "page=x", "per_page=0", "per_page=1001", "sort=uptime",
+		"status=up", "net=sctp", "family=ipv5",
+	} {
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nodes?"+query, nil))
+		if rec.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected status code %d, got %d", query, http.StatusBadRequest, rec.Code)
+		}
+		var res struct {
+			Error string `json:"error"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil || res.Error == "" {
+			t.Fatalf("%s: expected an error body, got: %v", query, err)
+		}
+	}
+}
+
+func TestNodeDetail(t *testing.T) {
+	c := initCrawler(t)
+
+	// The node is seen at two IPs and two ports, but only the last address
+	// responds
+	node := generateDHTNode(t)
+	for _, addr := range []struct {
+		IP   net.IP
+		Port int
+	}{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 33445},
+		{IP: net.IPv4(192, 0, 2, 1), Port: 443},
+		{IP: net.IPv4(192, 0, 2, 2), Port: 33445},
+	} {
+		node.IP, node.Port = addr.IP, addr.Port
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+
+		// Make sure the addresses don't share a creation time
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := c.repo.PongDHTNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nodes/"+node.PublicKey.String(), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	var res struct {
+		Node struct {
+			PublicKey string `json:"public_key"`
+			CreatedAt string `json:"created_at"`
+			Addresses []struct {
+				IP   string `json:"ip"`
+				Port int    `json:"port"`
+			} `json:"addresses"`
+		} `json:"node"`
+		Status          string   `json:"status"`
+		AddressStatuses []string `json:"address_statuses"`
+		Ports           []int    `json:"ports"`
+		LastResponseAt  *string  `json:"last_response_at"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Node.PublicKey != node.PublicKey.String() || res.Node.CreatedAt == "" {
+		t.Fatalf("unexpected node: %+v", res.Node)
+	}
+	if res.Status != repo.NodeStatusUp || res.LastResponseAt == nil {
+		t.Fatalf("unexpected status: %s (last response: %v)", res.Status, res.LastResponseAt)
+	}
+	if len(res.Node.Addresses) != 3 || res.Node.Addresses[0].IP != "192.0.2.2" {
+		t.Fatalf("unexpected addresses: %+v", res.Node.Addresses)
+	}
+	if expected := []string{repo.NodeStatusUp, repo.NodeStatusDown, repo.NodeStatusDown}; !slices.Equal(res.AddressStatuses, expected) {
+		t.Fatalf("expected address statuses %v, got %v", expected, res.AddressStatuses)
+	}
+	if expected := []int{443, 33445}; !slices.Equal(res.Ports, expected) {
+		t.Fatalf("expected ports %v, got %v", expected, res.Ports)
+	}
+
+	// A node flagged by the reputation feed is reported as such, unless the
+	// feed excludes it, in which case it isn't found
+	c.opts.ReputationFeed = newReputationFeed(t, net.IPv4(192, 0, 2, 1))
+	for _, exclude := range []bool{false, true} {
+		c.opts.ReputationExclude = exclude
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nodes/"+node.PublicKey.String(), nil))
+		if exclude {
+			if rec.Code != http.StatusNotFound {
+				t.Fatalf("expected excluded node not to be found, got status code %d", rec.Code)
+			}
+			continue
+		}
+
+		var res struct {
+			Node struct {
+				ReputationFlagged bool `json:"reputation_flagged"`
+			} `json:"node"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		if !res.Node.ReputationFlagged {
+			t.Fatal("expected node to be flagged")
+		}
+	}
+	c.opts.ReputationFeed, c.opts.ReputationExclude = nil, false
+
+	for path, status := range map[string]int{
+		"/api/v1/nodes/" + generateDHTNode(t).PublicKey.String(): http.StatusNotFound,
+		"/api/v1/nodes/abcd":                       http.StatusBadRequest,
+		"/api/v1/nodes/" + strings.Repeat("x", 64): http.StatusBadRequest,
+	} {
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != status {
+			t.Fatalf("%s: expected status code %d, got %d", path, status, rec.Code)
+		}
+	}
+}
+
+func TestBootstrapHealth(t *testing.T) {
+	c := initCrawler(t)
+
+	// The first node is up at its advertised IPv4 address, but not at its
+	// advertised IPv6 address, and it's also online at an address that isn't
+	// advertised. The second node was never seen by the crawler.
+	up := generateDHTNode(t)
+	up.IP = net.IPv4(192, 0, 2, 1)
+	upIPv6 := *up
+	upIPv6.Type = dht.NodeTypeUDPIP6
+	upIPv6.IP = net.ParseIP("2001:db8::1")
+	moved := *up
+	moved.IP = net.IPv4(192, 0, 2, 2)
+	untracked := generateDHTNode(t)
+
+	for _, node := range []*dht.Node{up, &upIPv6, &moved} {
+		if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, node := range []*dht.Node{up, &moved} {
+		if err := c.repo.PongDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.bsNodes = []*dht.Node{up, &upIPv6, untracked}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/v1/bootstrap-health", nil)
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	var res []*bootstrapHealth
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(res))
+	}
+
+	if res[0].PublicKey != up.PublicKey.String() || res[0].Status != bootstrapStatusUp {
+		t.Fatalf("unexpected health of first node: %+v", res[0])
+	}
+	if len(res[0].Addresses) != 2 || res[0].Addresses[0].Status != bootstrapStatusUp || res[0].Addresses[1].Status != bootstrapStatusDown {
+		t.Fatalf("unexpected advertised addresses of first node: %+v", res[0].Addresses)
+	}
+	if len(res[0].UnadvertisedAddresses) != 1 || res[0].UnadvertisedAddresses[0].Addr != moved.Addr().String() {
+		t.Fatalf("unexpected unadvertised addresses of first node: %+v", res[0].UnadvertisedAddresses)
+	}
+	expectedProblems := []string{
+		"advertised IPv6 address [2001:db8::1]:33445 is down",
+		"online at unadvertised address 192.0.2.2:33445",
+	}
+	if !slices.Equal(res[0].Problems, expectedProblems) {
+		t.Fatalf("unexpected problems of first node: %q", res[0].Problems)
+	}
+
+	if res[1].Status != bootstrapStatusDown || res[1].Addresses[0].Status != bootstrapStatusUntracked {
+		t.Fatalf("unexpected health of second node: %+v", res[1])
+	}
+}
+
+func TestBootstrapHealthAddressFamily(t *testing.T) {
+	c := initCrawler(t)
+	c.opts.AddressFamily = AddressFamilyIPv4
+
+	// An IPv6 address is never probed by an IPv4-only crawler, so its status
+	// can't be known
+	node := generateDHTNode(t)
+	node.Type = dht.NodeTypeUDPIP6
+	node.IP = net.ParseIP("2001:db8::1")
+	if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	c.bsNodes = []*dht.Node{node}
+
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/bootstrap-health", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+
+	var res []*bootstrapHealth
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 1 || res[0].Status != bootstrapStatusUnknown || res[0].Addresses[0].Status != bootstrapStatusUnknown {
+		t.Fatalf("unexpected health: %+v", res)
+	}
+	if len(res[0].Problems) != 0 {
+		t.Fatalf("unexpected problems: %q", res[0].Problems)
+	}
+}
+
+func TestCachedResponses(t *testing.T) {
+	c := initCrawler(t)
+	fake := clock.NewFake(time.Now())
+	c.opts.Clock = fake
+	c.opts.HTTPCacheTTLs = map[string]time.Duration{"transports": time.Minute}
+	handler := c.newHTTPHandler()
+
+	getTotal := func() int {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/transports", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", rec.Code)
+		}
+		if cc := rec.Header().Get("Cache-Control"); cc != "public, max-age=60" {
+			t.Fatalf("unexpected cache control header: %s", cc)
+		}
+
+		var res transportStats
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Total
+	}
+
+	if total := getTotal(); total != 0 {
+		t.Fatalf("unexpected total: %d", total)
+	}
+
+	node := generateDHTNode(t)
+	if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.repo.PongDHTNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cached response should be served until it expires
+	if total := getTotal(); total != 0 {
+		t.Fatalf("unexpected total: %d", total)
+	}
+	fake.Advance(time.Minute)
+	if total := getTotal(); total != 1 {
+		t.Fatalf("unexpected total: %d", total)
+	}
+
+	// Errors should not be cached
+	c.opts.HTTPCacheTTLs = map[string]time.Duration{"dense-ips": time.Minute}
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/dense-ips?threshold=x", nil))
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+	if rec.Header().Get("Cache-Control") != "" {
+		t.Fatal("error response has a cache control header")
+	}
+	if len(c.cache.entries) != 1 {
+		t.Fatalf("unexpected number of cache entries: %d", len(c.cache.entries))
+	}
+}
+
+func TestRescanStatus(t *testing.T) {
+	c := initCrawler(t)
+
+	getStatus := func() map[string]any {
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/rescan/status", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", rec.Code)
+		}
+
+		var res map[string]any
+		if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := getStatus(); res["status"] != "none" {
+		t.Fatalf("unexpected status without a rescan: %v", res)
+	}
+
+	if _, err := c.repo.TrackDHTNode(ctx, generateDHTNode(t)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.repo.StartRescan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	res := getStatus()
+	if res["status"] != "running" || res["total"] != 1.0 || res["probed"] != 0.0 || res["finished_at"] != nil {
+		t.Fatalf("unexpected status of running rescan: %v", res)
+	}
+}
+
+func TestHTTPServerRestart(t *testing.T) {
+	c := initCrawler(t)
+	srv := c.NewHTTPServer()
+
+	listen := func() net.Listener {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l
+	}
+	get := func(l net.Listener) {
+		res, err := http.Get("http://" + l.Addr().String() + "/api/v1/rescan/status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			t.Fatalf("unexpected status code: %d", res.StatusCode)
+		}
+	}
+
+	// Stopping a server that isn't running is fine
+	if err := srv.Stop(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		l := listen()
+		if err := srv.Start(l); err != nil {
+			t.Fatal(err)
+		}
+		extra := listen()
+		if err := srv.Start(extra); err == nil {
+			t.Fatal("expected error when starting a running server")
+		}
+		extra.Close()
+		get(l)
+
+		if err := srv.Stop(ctx); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := http.Get("http://" + l.Addr().String() + "/api/v1/rescan/status"); err == nil {
+			t.Fatal("expected error after stopping the server")
+		}
+	}
+}
+
+func TestAnonymizeIPs(t *testing.T) {
+	c := initCrawler(t)
+	c.opts.AnonymizeIPs = true
+
+	node := generateDHTNode(t)
+	node.IP = net.ParseIP("192.0.2.123")
+	nodeIPv6 := *node
+	nodeIPv6.Type = dht.NodeTypeUDPIP6
+	nodeIPv6.IP = net.ParseIP("2001:db8:1234:5678::1")
+	for _, n := range []*dht.Node{node, &nodeIPv6} {
+		if _, err := c.repo.TrackDHTNode(ctx, n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.bsNodes = []*dht.Node{node}
+
+	rec := httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/nodes/"+node.PublicKey.String()+"/addresses", nil))
+	var addrs []struct {
+		IP string `json:"ip"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&addrs); err != nil {
+		t.Fatal(err)
+	}
+	var ips []string
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	slices.Sort(ips)
+	if !slices.Equal(ips, []string{"192.0.2.0", "2001:db8:1234::"}) {
+		t.Fatalf("unexpected addresses: %v", ips)
+	}
+
+	rec = httptest.NewRecorder()
+	c.newHTTPHandler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/v1/bootstrap-health", nil))
+	var health []*bootstrapHealth
+	if err := json.NewDecoder(rec.Body).Decode(&health); err != nil {
+		t.Fatal(err)
+	}
+	if len(health) != 1 || len(health[0].Addresses) != 1 || health[0].Addresses[0].Addr != "192.0.2.0:33445" {
+		t.Fatalf("unexpected bootstrap health: %+v", health)
+	}
+
+	// The full addresses are kept for probing
+	dbNode, err := c.repo.GetNodeByPublicKey(ctx, node.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.ContainsFunc(dbNode.Addresses, func(addr *models.NodeAddress) bool {
+		return addr.IP == "192.0.2.123"
+	}) {
+		t.Fatalf("full address not in db: %v", dbNode.Addresses)
+	}
+}
+
+func TestAdminNodeRaw(t *testing.T) {
+	c := initCrawler(t)
+
+	node := generateDHTNode(t)
+	if _, err := c.repo.TrackDHTNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	c.results.recent.Add(&repo.ProbeResult{Node: node, Kind: repo.ProbeKindPong, Time: time.Now()})
+	c.results.recent.Add(&repo.ProbeResult{Node: generateDHTNode(t), Kind: repo.ProbeKindPing, Time: time.Now()})
+	c.bsNodes = []*dht.Node{node}
+
+	get := func(pk *dht.PublicKey, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/admin/nodes/"+pk.String()+"/raw", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		c.newHTTPHandler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	// The admin endpoints don't exist without a token
+	if rec := get(node.PublicKey, "secret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code without admin token: %d", rec.Code)
+	}
+
+	c.opts.AdminToken = "secret"
+	for _, token := range []string{"", "wrong"} {
+		if rec := get(node.PublicKey, token); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("token %q: unexpected status code: %d", token, rec.Code)
+		}
+	}
+	if rec := get(generateDHTNode(t).PublicKey, "secret"); rec.Code != http.StatusNotFound {
+		t.Fatalf("unexpected status code for unknown node: %d", rec.Code)
+	}
+
+	rec := get(node.PublicKey, "secret")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status code: %d", rec.Code)
+	}
+	var res struct {
+		ID         int64   `json:"id"`
+		AddressIDs []int64 `json:"address_ids"`
+		Node       struct {
+			PublicKey string `json:"public_key"`
+		} `json:"node"`
+		BootstrapNode bool `json:"bootstrap_node"`
+		RecentProbes  []struct {
+			Kind string `json:"kind"`
+			Addr string `json:"addr"`
+		} `json:"recent_probes"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+		t.Fatal(err)
+	}
+	if res.ID == 0 || len(res.AddressIDs) != 1 || res.Node.PublicKey != node.PublicKey.String() || !res.BootstrapNode {
+		t.Fatalf("unexpected raw node: %+v", res)
+	}
+	if len(res.RecentProbes) != 1 || res.RecentProbes[0].Kind != "pong" || res.RecentProbes[0].Addr != node.Addr().String() {
+		t.Fatalf("unexpected recent probes: %+v", res.RecentProbes)
+	}
+}
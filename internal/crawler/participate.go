@@ -0,0 +1,75 @@
+package crawler
+
+import (
+	"bytes"
+	"context"
+	"slices"
+
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/dht"
+)
+
+// maxSendNodes is the maximum number of nodes in a sendnodes response, as
+// defined by the Tox DHT protocol.
+const maxSendNodes = 4
+
+// ServedQueries returns the number of getnodes and ping requests of other
+// nodes that were answered since the crawler was started.
+func (c *Crawler) ServedQueries() uint64 {
+	return c.served.Load()
+}
+
+// handleGetNodesPacket answers a getnodes request with the nodes closest to the
+// requested public key. The crawler doesn't keep a routing table, so these are
+// picked from the nodes that responded to it most recently, which are the ones
+// most likely to still be online.
+func (c *Crawler) handleGetNodesPacket(ctx context.Context, node *dht.Node, packet *dht.GetNodesPacket) error {
+	res := &dht.SendNodesPacket{
+		Nodes:  c.closestNodes(packet.PublicKey, node.PublicKey),
+		PingID: packet.PingID,
+	}
+	return c.serveQuery(ctx, node, res)
+}
+
+// handlePingRequestPacket answers a ping request, so that other nodes keep the
+// crawler in their lists.
+func (c *Crawler) handlePingRequestPacket(ctx context.Context, node *dht.Node, packet *dht.PingRequestPacket) error {
+	return c.serveQuery(ctx, node, &dht.PingResponsePacket{PingID: packet.PingID})
+}
+
+func (c *Crawler) serveQuery(ctx context.Context, node *dht.Node, res dht.Packet) error {
+	if !c.probesFamily(node.IP) {
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case c.sendChan <- &dhtPacket{Packet: res, Node: node}:
+	}
+
+	c.served.Add(1)
+	return nil
+}
+
+// closestNodes returns up to maxSendNodes of the recently responsive nodes,
+// closest to the given public key first. The node that asked is left out.
+func (c *Crawler) closestNodes(pk *dht.PublicKey, exclude *dht.PublicKey) []*dht.Node {
+	var nodes []*dht.Node
+	for _, res := range c.results.recent.Items() {
+		if res.Kind != repo.ProbeKindPong || *res.Node.PublicKey == *exclude {
+			continue
+		}
+		if slices.ContainsFunc(nodes, func(node *dht.Node) bool {
+			return *node.PublicKey == *res.Node.PublicKey
+		}) {
+			continue
+		}
+		nodes = append(nodes, res.Node)
+	}
+
+	slices.SortFunc(nodes, func(a, b *dht.Node) int {
+		return bytes.Compare(pk.DistanceTo(a.PublicKey)[:], pk.DistanceTo(b.PublicKey)[:])
+	})
+	return nodes[:min(len(nodes), maxSendNodes)]
+}
@@ -0,0 +1,139 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+)
+
+// DefaultRescanRate is the default maximum number of probes per second sent
+// for a rescan.
+const DefaultRescanRate = 50
+
+const (
+	// rescanPollInterval is the interval at which the db is checked for a
+	// rescan to run.
+	rescanPollInterval = 5 * time.Second
+	// rescanProgressInterval is the number of nodes after which the progress of
+	// a rescan is saved. If the crawler is killed, at most this many nodes are
+	// probed again once the rescan resumes.
+	rescanProgressInterval = 100
+)
+
+var errRescanCanceled = errors.New("rescan canceled")
+
+// runRescans waits for a rescan to be started, and runs it. A rescan that was
+// interrupted by a restart is resumed.
+func (c *Crawler) runRescans(ctx context.Context) {
+	for {
+		rescan, err := c.repo.GetRescan(ctx)
+		if err == nil {
+			if rescan.Status() == models.RescanStatusRunning {
+				if err := c.rescan(ctx, rescan); err != nil && !errors.Is(err, context.Canceled) {
+					c.logger.Error("Unable to run rescan", slog.Any("err", err))
+				}
+			}
+		} else if !errors.Is(err, repo.ErrNotFound) {
+			c.logger.Error("Unable to obtain rescan", slog.Any("err", err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-c.opts.Clock.After(rescanPollInterval):
+		}
+	}
+}
+
+// rescan probes every node after the last one that the given rescan probed,
+// at no more than the configured rescan rate. It stops early if the rescan is
+// canceled.
+func (c *Crawler) rescan(ctx context.Context, rescan *models.Rescan) error {
+	c.logger.Info("Running rescan",
+		slog.Int("probed", rescan.Probed),
+		slog.Int("total", rescan.Total),
+		slog.Int("rate", c.opts.RescanRate))
+
+	ticker := c.opts.Clock.NewTicker(time.Second / time.Duration(c.opts.RescanRate))
+	defer ticker.Stop()
+
+	lastNodeID, probed := rescan.LastNodeID, rescan.Probed
+	saveProgress := func(ctx context.Context) error {
+		ok, err := c.repo.UpdateRescanProgress(ctx, lastNodeID, probed)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errRescanCanceled
+		}
+		return nil
+	}
+
+	err := c.repo.ForEachNodeAfterID(ctx, rescan.LastNodeID, func(node *models.Node) error {
+		for _, addr := range node.Addresses {
+			dhtNode, err := addr.DHTNode()
+			if err != nil {
+				c.logger.Error("Unable to convert db node address to dht node", slog.Any("err", err))
+				continue
+			}
+			if !c.probesFamily(dhtNode.IP) {
+				continue
+			}
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-ticker.C():
+			}
+
+			if err := c.getNodes(ctx, dhtNode, c.ident.PublicKey); err != nil {
+				if errors.Is(err, context.Canceled) {
+					return err
+				}
+				c.logger.Error("Unable to probe node for rescan",
+					slog.String("public_key", dhtNode.PublicKey.String()),
+					slog.String("addr", dhtNode.Addr().String()),
+					slog.Any("err", err))
+			}
+		}
+
+		lastNodeID = node.ID
+		probed++
+		if probed%rescanProgressInterval == 0 {
+			return saveProgress(ctx)
+		}
+		return nil
+	})
+	if errors.Is(err, errRescanCanceled) {
+		c.logger.Info("Rescan canceled", slog.Int("probed", probed))
+		return nil
+	}
+	if err != nil {
+		// Save the progress that was made, so that the rescan resumes where
+		// it left off once the crawler is started again
+		saveCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := saveProgress(saveCtx); err != nil && !errors.Is(err, errRescanCanceled) {
+			c.logger.Error("Unable to save rescan progress", slog.Any("err", err))
+		}
+		return err
+	}
+
+	if err := saveProgress(ctx); err != nil {
+		if errors.Is(err, errRescanCanceled) {
+			c.logger.Info("Rescan canceled", slog.Int("probed", probed))
+			return nil
+		}
+		return err
+	}
+	if err := c.repo.FinishRescan(ctx); err != nil {
+		return err
+	}
+
+	c.logger.Info("Finished rescan", slog.Int("probed", probed))
+	return nil
+}
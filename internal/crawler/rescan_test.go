@@ -0,0 +1,79 @@
+package crawler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/alexbakker/tox4go/dht"
+)
+
+func TestRescanResume(t *testing.T) {
+	c := initCrawler(t)
+	c.opts.RescanRate = 1000
+
+	var (
+		ids   []int64
+		nodes []*dht.Node
+	)
+	for i := 0; i < 3; i++ {
+		dhtNode := generateDHTNode(t)
+		node, err := c.repo.TrackDHTNode(ctx, dhtNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, node.ID)
+		nodes = append(nodes, dhtNode)
+	}
+
+	// Pretend that the first node was probed before the crawler restarted
+	if _, err := c.repo.StartRescan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := c.repo.UpdateRescanProgress(ctx, ids[0], 1); err != nil || !ok {
+		t.Fatalf("unable to update progress: %t %v", ok, err)
+	}
+	rescan, err := c.repo.GetRescan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stand in for the packet transmitters
+	probed := make(chan *dht.Node, 10)
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-runCtx.Done():
+				return
+			case packet := <-c.sendChan:
+				probed <- packet.Node
+			}
+		}
+	}()
+
+	if err := c.rescan(ctx, rescan); err != nil {
+		t.Fatal(err)
+	}
+	// Only the nodes after the first one should have been probed
+	for _, node := range nodes[1:] {
+		select {
+		case probedNode := <-probed:
+			if *probedNode.PublicKey != *node.PublicKey {
+				t.Fatalf("unexpected probed node: %s (expected %s)", probedNode.PublicKey, node.PublicKey)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for probe")
+		}
+	}
+
+	rescan, err = c.repo.GetRescan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescan.Status() != models.RescanStatusFinished || rescan.Probed != 3 || rescan.LastNodeID != ids[2] {
+		t.Fatalf("unexpected rescan after resuming: %+v", rescan)
+	}
+}
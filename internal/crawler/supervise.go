@@ -0,0 +1,64 @@
+package crawler
+
+import (
+	"context"
+	"log/slog"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// panicRestartDelay is the time to wait before restarting a goroutine that
+// panicked, so that a goroutine that keeps panicking doesn't spin.
+const panicRestartDelay = 1 * time.Second
+
+// goSupervised runs fn in a new goroutine that is tracked by wg. If fn panics,
+// the panic is logged along with its stack trace, and fn is restarted after a
+// short delay, unless the context has been canceled by then.
+//
+// A recovered panic is still a bug. It's logged at the error level and
+// counted, so that the crawler keeps running without the panic going
+// unnoticed.
+func (c *Crawler) goSupervised(ctx context.Context, wg *sync.WaitGroup, name string, fn func()) {
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			if !c.runRecovered(name, fn) {
+				return
+			}
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-c.opts.Clock.After(panicRestartDelay):
+			}
+			c.logger.Warn("Restarting goroutine after panic", slog.String("goroutine", name))
+		}
+	}()
+}
+
+// runRecovered runs fn and reports whether it panicked.
+func (c *Crawler) runRecovered(name string, fn func()) (panicked bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			panicked = true
+			total := c.panics.Add(1)
+			c.logger.Error("Recovered from panic",
+				slog.String("goroutine", name),
+				slog.Any("panic", r),
+				slog.Uint64("total_panics", total),
+				slog.String("stack", string(debug.Stack())))
+		}
+	}()
+
+	fn()
+	return false
+}
+
+// Panics returns the number of panics that were recovered from since the
+// crawler was started.
+func (c *Crawler) Panics() uint64 {
+	return c.panics.Load()
+}
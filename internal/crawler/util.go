@@ -2,7 +2,6 @@ package crawler
 
 import (
 	"encoding/binary"
-	"net"
 
 	"github.com/alexbakker/tox4go/dht"
 )
@@ -23,12 +22,3 @@ func getPublicKeyGenerator(n int) func() *dht.PublicKey {
 		return &res
 	}
 }
-
-func isGlobalUnicast(ip net.IP) bool {
-	return !ip.IsUnspecified() &&
-		!ip.IsLoopback() &&
-		!ip.IsPrivate() &&
-		!ip.IsMulticast() &&
-		!ip.IsLinkLocalUnicast() &&
-		!ip.IsLinkLocalMulticast()
-}
@@ -0,0 +1,143 @@
+package crawler
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/clock"
+	"github.com/2mf/ToxStatus/internal/debug"
+	"github.com/2mf/ToxStatus/internal/repo"
+)
+
+const (
+	DefaultResultBatchSize      = 1000
+	DefaultResultFlushInterval  = 1 * time.Second
+	DefaultShutdownFlushTimeout = 5 * time.Second
+)
+
+// recentResultsSize is the number of recent probe results that are kept in
+// memory for state dumps.
+const recentResultsSize = 100
+
+// resultWriter is the single owner of all probe result writes to the db. The
+// workers hand their results to it through a buffered channel, and it writes
+// them in batches, so that the workers don't contend on the write connection.
+type resultWriter struct {
+	repo          repo.NodeRepository
+	logger        *slog.Logger
+	clock         clock.Clock
+	batchSize     int
+	flushInterval time.Duration
+	flushTimeout  time.Duration
+	resultChan    chan *repo.ProbeResult
+	recent        *debug.Ring[*repo.ProbeResult]
+}
+
+func newResultWriter(nodesRepo repo.NodeRepository, logger *slog.Logger, clock clock.Clock, batchSize int, flushInterval time.Duration, flushTimeout time.Duration) *resultWriter {
+	if batchSize == 0 {
+		batchSize = DefaultResultBatchSize
+	}
+	if flushInterval == 0 {
+		flushInterval = DefaultResultFlushInterval
+	}
+	if flushTimeout == 0 {
+		flushTimeout = DefaultShutdownFlushTimeout
+	}
+
+	return &resultWriter{
+		repo:          nodesRepo,
+		logger:        logger,
+		clock:         clock,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		flushTimeout:  flushTimeout,
+		resultChan:    make(chan *repo.ProbeResult, batchSize),
+		recent:        debug.NewRing[*repo.ProbeResult](recentResultsSize),
+	}
+}
+
+// Write queues the given probe result for writing. It blocks if the queue is
+// full, until the writer catches up or the context is canceled.
+func (w *resultWriter) Write(ctx context.Context, res *repo.ProbeResult) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case w.resultChan <- res:
+		w.recent.Add(res)
+		return nil
+	}
+}
+
+// Run writes the queued probe results to the db until the context is
+// canceled. A batch is written once it's full, or once the flush interval has
+// passed since the last write. Once the context is canceled, the results that
+// are still pending are written before Run returns, unless that takes longer
+// than the shutdown flush timeout.
+func (w *resultWriter) Run(ctx context.Context) {
+	ticker := w.clock.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*repo.ProbeResult, 0, w.batchSize)
+	for {
+		select {
+		case <-ctx.Done():
+			w.drain(batch)
+			return
+		case res := <-w.resultChan:
+			batch = append(batch, res)
+			if len(batch) < w.batchSize {
+				continue
+			}
+		case <-ticker.C():
+			if len(batch) == 0 {
+				continue
+			}
+		}
+
+		w.flush(ctx, batch)
+		batch = batch[:0]
+		ticker.Reset(w.flushInterval)
+	}
+}
+
+// drain writes the given partial batch and all results left in the queue,
+// using a fresh context that expires after the shutdown flush timeout.
+func (w *resultWriter) drain(batch []*repo.ProbeResult) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.flushTimeout)
+	defer cancel()
+
+	total := len(batch)
+	for {
+		select {
+		case res := <-w.resultChan:
+			batch = append(batch, res)
+			total++
+			if len(batch) < w.batchSize {
+				continue
+			}
+		default:
+			if len(batch) > 0 {
+				w.flush(ctx, batch)
+			}
+			if total > 0 {
+				w.logger.Info("Flushed pending probe results", slog.Int("count", total))
+			}
+			return
+		}
+
+		w.flush(ctx, batch)
+		batch = batch[:0]
+	}
+}
+
+func (w *resultWriter) flush(ctx context.Context, batch []*repo.ProbeResult) {
+	if err := w.repo.UpdateProbeResults(ctx, batch); err != nil {
+		if errors.Is(err, repo.ErrNotFound) {
+			w.logger.Warn("Skipped some probe results", slog.Any("err", err))
+		} else {
+			w.logger.Error("Unable to write probe results", slog.Int("count", len(batch)), slog.Any("err", err))
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package crawler
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"runtime"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/clock"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/2mf/ToxStatus/internal/repo/mock"
+	"github.com/alexbakker/tox4go/dht"
+	testifymock "github.com/stretchr/testify/mock"
+)
+
+func TestResultWriterBatches(t *testing.T) {
+	nodesRepo := new(mock.MockNodeRepository)
+	t.Cleanup(func() { nodesRepo.AssertExpectations(t) })
+
+	// The fake clock never advances, so only full batches are written
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	w := newResultWriter(nodesRepo, logger, clock.NewFake(time.Now()), 2, time.Second, time.Second)
+
+	flushed := make(chan []*repo.ProbeResult)
+	nodesRepo.On("UpdateProbeResults", testifymock.Anything, testifymock.Anything).
+		Run(func(args testifymock.Arguments) {
+			// The writer reuses the batch slice after flushing
+			batch := args.Get(1).([]*repo.ProbeResult)
+			flushed <- append([]*repo.ProbeResult(nil), batch...)
+		}).
+		Return(nil)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.Run(runCtx)
+
+	node := &dht.Node{Type: dht.NodeTypeUDPIP4, IP: net.IPv4(192, 0, 2, 1), Port: 33445}
+	var results []*repo.ProbeResult
+	for i := 0; i < 4; i++ {
+		res := &repo.ProbeResult{Node: node, Kind: repo.ProbeKindPing, Time: time.Now()}
+		if err := w.Write(ctx, res); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case batch := <-flushed:
+			if len(batch) != 2 || batch[0] != results[i*2] || batch[1] != results[i*2+1] {
+				t.Fatalf("unexpected batch %d: %v", i, batch)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for batch to be written")
+		}
+	}
+}
+
+func TestResultWriterFlushInterval(t *testing.T) {
+	nodesRepo := new(mock.MockNodeRepository)
+	t.Cleanup(func() { nodesRepo.AssertExpectations(t) })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	fake := clock.NewFake(time.Now())
+	w := newResultWriter(nodesRepo, logger, fake, 100, time.Second, time.Second)
+
+	flushed := make(chan int)
+	nodesRepo.On("UpdateProbeResults", testifymock.Anything, testifymock.Anything).
+		Run(func(args testifymock.Arguments) {
+			flushed <- len(args.Get(1).([]*repo.ProbeResult))
+		}).
+		Return(nil)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go w.Run(runCtx)
+
+	node := &dht.Node{Type: dht.NodeTypeUDPIP4, IP: net.IPv4(192, 0, 2, 1), Port: 33445}
+	if err := w.Write(ctx, &repo.ProbeResult{Node: node, Kind: repo.ProbeKindPong, Time: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Wait for the writer to pick up the result before the flush interval
+	// passes, so that it's part of the batch when the ticker fires
+	fake.BlockUntil(1)
+	for len(w.resultChan) > 0 {
+		runtime.Gosched()
+	}
+	fake.Advance(time.Second)
+
+	select {
+	case n := <-flushed:
+		if n != 1 {
+			t.Fatalf("unexpected batch size: %d", n)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for partial batch to be written")
+	}
+}
+
+func TestResultWriterShutdownFlush(t *testing.T) {
+	nodesRepo := new(mock.MockNodeRepository)
+	t.Cleanup(func() { nodesRepo.AssertExpectations(t) })
+
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	w := newResultWriter(nodesRepo, logger, clock.NewFake(time.Now()), 3, time.Second, time.Second)
+
+	var (
+		m       sync.Mutex
+		written []*repo.ProbeResult
+	)
+	nodesRepo.On("UpdateProbeResults", testifymock.Anything, testifymock.Anything).
+		Run(func(args testifymock.Arguments) {
+			if err := args.Get(0).(context.Context).Err(); err != nil {
+				t.Errorf("flushed with a done context: %v", err)
+			}
+
+			m.Lock()
+			defer m.Unlock()
+			written = append(written, args.Get(1).([]*repo.ProbeResult)...)
+		}).
+		Return(nil)
+
+	runCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		w.Run(runCtx)
+	}()
+
+	// Write one full batch and a partial one, then stop the writer before the
+	// flush interval passes
+	node := &dht.Node{Type: dht.NodeTypeUDPIP4, IP: net.IPv4(192, 0, 2, 1), Port: 33445}
+	var results []*repo.ProbeResult
+	for i := 0; i < 5; i++ {
+		res := &repo.ProbeResult{Node: node, Kind: repo.ProbeKindPing, Time: time.Now()}
+		if err := w.Write(ctx, res); err != nil {
+			t.Fatal(err)
+		}
+		results = append(results, res)
+	}
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for writer to stop")
+	}
+
+	if !slices.Equal(written, results) {
+		t.Fatalf("expected %d results to be written in order, got %d", len(results), len(written))
+	}
+}
@@ -0,0 +1,35 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+var tables = []string{"node", "node_address", "rescan"}
+
+// CheckSchema verifies the integrity of the database and that all of the
+// tables of the schema are present.
+func CheckSchema(ctx context.Context, conn *sql.DB) error {
+	var res string
+	if err := conn.QueryRowContext(ctx, "PRAGMA integrity_check").Scan(&res); err != nil {
+		return fmt.Errorf("integrity check: %w", err)
+	}
+	if res != "ok" {
+		return fmt.Errorf("integrity check: %s", res)
+	}
+
+	for _, table := range tables {
+		var found bool
+		if err := conn.QueryRowContext(ctx,
+			"SELECT EXISTS(SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ?)", table,
+		).Scan(&found); err != nil {
+			return fmt.Errorf("check table %s: %w", table, err)
+		}
+		if !found {
+			return fmt.Errorf("missing table: %s", table)
+		}
+	}
+
+	return nil
+}
@@ -32,3 +32,13 @@ type NodeAddress struct {
 	Port       int64
 	Ptr        sql.NullString
 }
+
+type Rescan struct {
+	ID         int64
+	StartedAt  Time
+	FinishedAt Time
+	CanceledAt Time
+	LastNodeID int64
+	Probed     int64
+	Total      int64
+}
@@ -3,9 +3,15 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
 	"fmt"
+	"io/fs"
 	"net/url"
+	"os"
+	"path/filepath"
 	"runtime"
+	"slices"
+	"strings"
 
 	"github.com/mattn/go-sqlite3"
 )
@@ -14,24 +20,75 @@ type OpenOptions struct {
 	Params map[string]string
 }
 
-func RegisterPragmaHook(cacheSize int) {
+// SynchronousModes are the supported values of the sqlite synchronous pragma.
+var SynchronousModes = []string{"off", "normal", "full", "extra"}
+
+// RegisterPragmaHook registers the sqlite driver used by OpenReadWrite. The
+// given synchronous mode must be one of SynchronousModes.
+func RegisterPragmaHook(cacheSize int, synchronous string) {
+	if !slices.Contains(SynchronousModes, synchronous) {
+		panic(fmt.Sprintf("bad synchronous mode: %s", synchronous))
+	}
+
 	sql.Register("toxstatus_sqlite3", &sqlite3.SQLiteDriver{
 		ConnectHook: func(c *sqlite3.SQLiteConn) error {
 			//fmt.Println("Executing pragmas")
 			pragmas := fmt.Sprintf(`
 				PRAGMA journal_mode = WAL;
 				PRAGMA busy_timeout = 5000;
-				PRAGMA synchronous = NORMAL;
+				PRAGMA synchronous = %s;
 				PRAGMA cache_size = -%d;
 				PRAGMA foreign_keys = true;
 				PRAGMA temp_store = memory;
-			`, cacheSize)
+			`, strings.ToUpper(synchronous), cacheSize)
 			_, err := c.Exec(pragmas, nil)
 			return err
 		},
 	})
 }
 
+// CheckDir checks that the directory of the given db file exists and that it's
+// writable, which sqlite needs to be able to create its journal files. If
+// create is true, the directory is created if it doesn't exist yet. The errors
+// returned contain the absolute path of the directory, and wrap fs.ErrNotExist
+// if it doesn't exist.
+func CheckDir(dbFile string, create bool) error {
+	if dbFile == ":memory:" {
+		return nil
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(dbFile))
+	if err != nil {
+		return err
+	}
+
+	fi, err := os.Stat(dir)
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("check db dir: %w", err)
+		}
+		if !create {
+			return fmt.Errorf("db dir %s: %w", dir, fs.ErrNotExist)
+		}
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return fmt.Errorf("create db dir: %w", err)
+		}
+	} else if !fi.IsDir() {
+		return fmt.Errorf("db dir %s is not a directory", dir)
+	}
+
+	// Permission bits don't tell the whole story (read-only mounts, ACLs), so
+	// try to actually create a file
+	f, err := os.CreateTemp(dir, ".toxstatus-check-*")
+	if err != nil {
+		return fmt.Errorf("db dir %s is not writable: %w", dir, err)
+	}
+	f.Close()
+	os.Remove(f.Name())
+
+	return nil
+}
+
 func OpenReadWrite(ctx context.Context, dbFile string, opts OpenOptions) (rdb *sql.DB, wdb *sql.DB, err error) {
 	uri := &url.URL{
 		Scheme: "file",
@@ -15,6 +15,55 @@ SELECT EXISTS(
 SELECT COUNT(*)
 FROM node;
 
+-- name: GetOnlineNodeCount :one
+SELECT COUNT(DISTINCT a.node_id)
+FROM node_address a
+WHERE a.last_pong_at IS NOT NULL
+  AND (unixepoch('subsec') - a.last_pong_at) < CAST(sqlc.arg(node_timeout) AS REAL);
+
+-- name: GetOfflineNodeCount :one
+SELECT COUNT(*)
+FROM node n
+LEFT JOIN node_address a ON a.node_id = n.id
+  AND a.last_pong_at IS NOT NULL
+  AND (unixepoch('subsec') - a.last_pong_at) < CAST(sqlc.arg(node_timeout) AS REAL)
+WHERE a.id IS NULL;
+
+-- name: GetCapabilityCounts :many
+SELECT
+  CAST(c.status AS TEXT) AS status,
+  COUNT(*) AS total,
+  CAST(SUM(c.udp) AS INTEGER) AS udp,
+  CAST(SUM(c.tcp) AS INTEGER) AS tcp,
+  CAST(SUM(c.ipv4) AS INTEGER) AS ipv4,
+  CAST(SUM(c.ipv6) AS INTEGER) AS ipv6
+FROM (
+  SELECT
+    CASE
+      WHEN MAX(a.last_pong_at IS NOT NULL
+        AND (unixepoch('subsec') - a.last_pong_at) < CAST(sqlc.arg(node_timeout) AS REAL)) THEN 'up'
+      WHEN MAX(a.last_ping_at IS NOT NULL) THEN 'down'
+      ELSE 'unknown'
+    END AS status,
+    MAX(CASE WHEN a.net IN ('udp4', 'udp6') THEN 1 ELSE 0 END) AS udp,
+    MAX(CASE WHEN a.net IN ('tcp4', 'tcp6') THEN 1 ELSE 0 END) AS tcp,
+    MAX(CASE WHEN a.net IN ('udp4', 'tcp4') THEN 1 ELSE 0 END) AS ipv4,
+    MAX(CASE WHEN a.net IN ('udp6', 'tcp6') THEN 1 ELSE 0 END) AS ipv6
+  FROM node n
+  LEFT JOIN node_address a ON a.node_id = n.id
+  GROUP BY n.id
+) c
+GROUP BY c.status;
+
+-- name: GetNodeCreationTimes :many
+SELECT created_at
+FROM node;
+
+-- name: GetNodeSeenTimes :many
+SELECT n.id, n.created_at, n.last_seen_at, a.last_pong_at
+FROM node n
+LEFT JOIN node_address a ON a.node_id = n.id;
+
 -- name: UpsertNode :one
 INSERT INTO node(public_key)
 VALUES(?)
@@ -92,3 +141,135 @@ FROM node n
 JOIN node_address a ON a.node_id = n.id
 WHERE a.net = ? AND a.ip = ? AND a.port = ?
   AND (unixepoch('subsec') - n.last_info_req_at) < CAST(sqlc.arg(info_req_timeout) AS REAL);
+
+-- name: GetNodesAfterID :many
+SELECT sqlc.embed(n), sqlc.embed(a)
+FROM node n
+JOIN node_address a ON a.node_id = n.id
+WHERE n.id IN (
+  SELECT b.id
+  FROM node b
+  WHERE b.id > sqlc.arg(after_id)
+  ORDER BY b.id
+  LIMIT sqlc.arg(batch_size)
+)
+ORDER BY n.id, a.id;
+
+-- name: GetNodesPage :many
+-- The matching nodes are those with an address of one of the given nets. If a
+-- status is given, it's determined by those addresses alone. The total number
+-- of matching nodes is returned with every row, so that it doesn't have to be
+-- counted with a copy of the filter. The nets are the last parameter, because
+-- sqlc expands the slice into multiple parameters, which would otherwise throw
+-- off the numbering of the ones after it.
+WITH page AS (
+  SELECT b.id,
+    CASE WHEN CAST(sqlc.arg(sort) AS TEXT) = 'first_seen' THEN b.created_at ELSE b.last_seen_at END AS sort_key,
+    COUNT(*) OVER () AS total
+  FROM node b
+  WHERE b.id IN (
+    SELECT m.node_id
+    FROM matching m
+    WHERE CAST(sqlc.arg(status) AS TEXT) = '' OR m.up = (CAST(sqlc.arg(status) AS TEXT) = 'up')
+  )
+  ORDER BY sort_key DESC, b.id
+  LIMIT sqlc.arg(page_size)
+  OFFSET sqlc.arg(page_offset)
+), matching AS (
+  SELECT f.node_id, MAX(f.last_pong_at IS NOT NULL
+    AND (unixepoch('subsec') - f.last_pong_at) < CAST(sqlc.arg(node_timeout) AS REAL)) AS up
+  FROM node_address f
+  WHERE f.net IN (sqlc.slice(nets))
+  GROUP BY f.node_id
+)
+SELECT p.total, sqlc.embed(n), sqlc.embed(a)
+FROM page p
+JOIN node n ON n.id = p.id
+JOIN node_address a ON a.node_id = n.id
+ORDER BY p.sort_key DESC, n.id, a.id;
+
+-- name: GetOnlineNodes :many
+SELECT sqlc.embed(n), sqlc.embed(a)
+FROM node n
+JOIN node_address a ON a.node_id = n.id
+WHERE a.last_pong_at IS NOT NULL
+  AND (unixepoch('subsec') - a.last_pong_at) < CAST(sqlc.arg(node_timeout) AS REAL);
+
+-- name: GetDuplicateNodeAddresses :many
+SELECT sqlc.embed(n), sqlc.embed(a)
+FROM node n
+JOIN node_address a ON a.node_id = n.id
+WHERE EXISTS (
+  SELECT 1
+  FROM node_address d
+  WHERE d.net = a.net AND d.ip = a.ip AND d.port = a.port AND d.node_id != a.node_id
+)
+ORDER BY a.net, a.ip, a.port, a.id;
+
+-- name: DeleteNodeAddress :exec
+DELETE FROM node_address
+WHERE id = ?;
+
+-- name: DeleteNodeIfNoAddresses :exec
+DELETE FROM node
+WHERE id = ? AND NOT EXISTS (
+  SELECT 1
+  FROM node_address a
+  WHERE a.node_id = node.id
+);
+
+-- name: GetSharedIPs :many
+SELECT DISTINCT a.ip, n.public_key
+FROM node_address a
+JOIN node n ON n.id = a.node_id
+WHERE a.ip IN (
+  SELECT d.ip
+  FROM node_address d
+  GROUP BY d.ip
+  HAVING COUNT(DISTINCT d.node_id) > 1
+)
+ORDER BY a.ip, n.public_key;
+
+-- name: GetNodeAddressesForCleaning :many
+SELECT a.id, a.node_id, CAST(n.public_key AS TEXT) AS raw_public_key, a.net, a.ip, a.port
+FROM node_address a
+JOIN node n ON n.id = a.node_id
+ORDER BY a.id;
+
+-- name: UpdateNodeAddressPingTime :exec
+UPDATE node_address
+SET last_ping_at = ?
+WHERE id = ?;
+
+-- name: UpdateNodeAddressPongTime :exec
+UPDATE node_address
+SET last_pong_at = ?
+WHERE id = ?;
+
+-- name: GetRescan :one
+SELECT *
+FROM rescan
+WHERE id = 1;
+
+-- name: StartRescan :one
+INSERT INTO rescan(id, total)
+VALUES(1, ?)
+ON CONFLICT(id) DO UPDATE SET
+  started_at = unixepoch('subsec'), finished_at = NULL, canceled_at = NULL,
+  last_node_id = 0, probed = 0, total = excluded.total
+RETURNING *;
+
+-- name: UpdateRescanProgress :execrows
+UPDATE rescan
+SET last_node_id = ?, probed = ?
+WHERE id = 1 AND finished_at IS NULL AND canceled_at IS NULL;
+
+-- name: FinishRescan :execrows
+UPDATE rescan
+SET finished_at = unixepoch('subsec')
+WHERE id = 1 AND finished_at IS NULL AND canceled_at IS NULL;
+
+-- name: CancelRescan :execrows
+UPDATE rescan
+SET canceled_at = unixepoch('subsec')
+WHERE id = 1 AND finished_at IS NULL AND canceled_at IS NULL;
@@ -8,8 +8,187 @@ package db
 import (
 	"context"
 	"database/sql"
+	"strings"
 )
 
+const cancelRescan = `-- name: CancelRescan :execrows
+UPDATE rescan
+SET canceled_at = unixepoch('subsec')
+WHERE id = 1 AND finished_at IS NULL AND canceled_at IS NULL
+`
+
+func (q *Queries) CancelRescan(ctx context.Context) (int64, error) {
+	result, err := q.db.ExecContext(ctx, cancelRescan)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const deleteNodeAddress = `-- name: DeleteNodeAddress :exec
+DELETE FROM node_address
+WHERE id = ?
+`
+
+func (q *Queries) DeleteNodeAddress(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, deleteNodeAddress, id)
+	return err
+}
+
+const deleteNodeIfNoAddresses = `-- name: DeleteNodeIfNoAddresses :exec
+DELETE FROM node
+WHERE id = ? AND NOT EXISTS (
+  SELECT 1
+  FROM node_address a
+  WHERE a.node_id = node.id
+)
+`
+
+func (q *Queries) DeleteNodeIfNoAddresses(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, deleteNodeIfNoAddresses, id)
+	return err
+}
+
+const finishRescan = `-- name: FinishRescan :execrows
+UPDATE rescan
+SET finished_at = unixepoch('subsec')
+WHERE id = 1 AND finished_at IS NULL AND canceled_at IS NULL
+`
+
+func (q *Queries) FinishRescan(ctx context.Context) (int64, error) {
+	result, err := q.db.ExecContext(ctx, finishRescan)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const getCapabilityCounts = `-- name: GetCapabilityCounts :many
+SELECT
+  CAST(c.status AS TEXT) AS status,
+  COUNT(*) AS total,
+  CAST(SUM(c.udp) AS INTEGER) AS udp,
+  CAST(SUM(c.tcp) AS INTEGER) AS tcp,
+  CAST(SUM(c.ipv4) AS INTEGER) AS ipv4,
+  CAST(SUM(c.ipv6) AS INTEGER) AS ipv6
+FROM (
+  SELECT
+    CASE
+      WHEN MAX(a.last_pong_at IS NOT NULL
+        AND (unixepoch('subsec') - a.last_pong_at) < CAST(?1 AS REAL)) THEN 'up'
+      WHEN MAX(a.last_ping_at IS NOT NULL) THEN 'down'
+      ELSE 'unknown'
+    END AS status,
+    MAX(CASE WHEN a.net IN ('udp4', 'udp6') THEN 1 ELSE 0 END) AS udp,
+    MAX(CASE WHEN a.net IN ('tcp4', 'tcp6') THEN 1 ELSE 0 END) AS tcp,
+    MAX(CASE WHEN a.net IN ('udp4', 'tcp4') THEN 1 ELSE 0 END) AS ipv4,
+    MAX(CASE WHEN a.net IN ('udp6', 'tcp6') THEN 1 ELSE 0 END) AS ipv6
+  FROM node n
+  LEFT JOIN node_address a ON a.node_id = n.id
+  GROUP BY n.id
+) c
+GROUP BY c.status
+`
+
+type GetCapabilityCountsRow struct {
+	Status string
+	Total  int64
+	Udp    int64
+	Tcp    int64
+	Ipv4   int64
+	Ipv6   int64
+}
+
+func (q *Queries) GetCapabilityCounts(ctx context.Context, nodeTimeout float64) ([]*GetCapabilityCountsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getCapabilityCounts, nodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetCapabilityCountsRow
+	for rows.Next() {
+		var i GetCapabilityCountsRow
+		if err := rows.Scan(
+			&i.Status,
+			&i.Total,
+			&i.Udp,
+			&i.Tcp,
+			&i.Ipv4,
+			&i.Ipv6,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getDuplicateNodeAddresses = `-- name: GetDuplicateNodeAddresses :many
+SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
+FROM node n
+JOIN node_address a ON a.node_id = n.id
+WHERE EXISTS (
+  SELECT 1
+  FROM node_address d
+  WHERE d.net = a.net AND d.ip = a.ip AND d.port = a.port AND d.node_id != a.node_id
+)
+ORDER BY a.net, a.ip, a.port, a.id
+`
+
+type GetDuplicateNodeAddressesRow struct {
+	Node        Node
+	NodeAddress NodeAddress
+}
+
+func (q *Queries) GetDuplicateNodeAddresses(ctx context.Context) ([]*GetDuplicateNodeAddressesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getDuplicateNodeAddresses)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetDuplicateNodeAddressesRow
+	for rows.Next() {
+		var i GetDuplicateNodeAddressesRow
+		if err := rows.Scan(
+			&i.Node.ID,
+			&i.Node.CreatedAt,
+			&i.Node.LastSeenAt,
+			&i.Node.LastInfoReqAt,
+			&i.Node.LastInfoResAt,
+			&i.Node.PublicKey,
+			&i.Node.Fqdn,
+			&i.Node.Motd,
+			&i.Node.Version,
+			&i.NodeAddress.ID,
+			&i.NodeAddress.CreatedAt,
+			&i.NodeAddress.LastSeenAt,
+			&i.NodeAddress.LastPingAt,
+			&i.NodeAddress.LastPongAt,
+			&i.NodeAddress.NodeID,
+			&i.NodeAddress.Net,
+			&i.NodeAddress.Ip,
+			&i.NodeAddress.Port,
+			&i.NodeAddress.Ptr,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getNodeAddress = `-- name: GetNodeAddress :one
 SELECT a.id
 FROM node_address a
@@ -36,6 +215,52 @@ func (q *Queries) GetNodeAddress(ctx context.Context, arg *GetNodeAddressParams)
 	return id, err
 }
 
+const getNodeAddressesForCleaning = `-- name: GetNodeAddressesForCleaning :many
+SELECT a.id, a.node_id, CAST(n.public_key AS TEXT) AS raw_public_key, a.net, a.ip, a.port
+FROM node_address a
+JOIN node n ON n.id = a.node_id
+ORDER BY a.id
+`
+
+type GetNodeAddressesForCleaningRow struct {
+	ID           int64
+	NodeID       int64
+	RawPublicKey string
+	Net          string
+	Ip           string
+	Port         int64
+}
+
+func (q *Queries) GetNodeAddressesForCleaning(ctx context.Context) ([]*GetNodeAddressesForCleaningRow, error) {
+	rows, err := q.db.QueryContext(ctx, getNodeAddressesForCleaning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetNodeAddressesForCleaningRow
+	for rows.Next() {
+		var i GetNodeAddressesForCleaningRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.NodeID,
+			&i.RawPublicKey,
+			&i.Net,
+			&i.Ip,
+			&i.Port,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getNodeByInfoResponseAddress = `-- name: GetNodeByInfoResponseAddress :one
 SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
 FROM node n
@@ -155,6 +380,250 @@ func (q *Queries) GetNodeCount(ctx context.Context) (int64, error) {
 	return count, err
 }
 
+const getNodeCreationTimes = `-- name: GetNodeCreationTimes :many
+SELECT created_at
+FROM node
+`
+
+func (q *Queries) GetNodeCreationTimes(ctx context.Context) ([]Time, error) {
+	rows, err := q.db.QueryContext(ctx, getNodeCreationTimes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []Time
+	for rows.Next() {
+		var created_at Time
+		if err := rows.Scan(&created_at); err != nil {
+			return nil, err
+		}
+		items = append(items, created_at)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNodeSeenTimes = `-- name: GetNodeSeenTimes :many
+SELECT n.id, n.created_at, n.last_seen_at, a.last_pong_at
+FROM node n
+LEFT JOIN node_address a ON a.node_id = n.id
+`
+
+type GetNodeSeenTimesRow struct {
+	ID         int64
+	CreatedAt  Time
+	LastSeenAt Time
+	LastPongAt Time
+}
+
+func (q *Queries) GetNodeSeenTimes(ctx context.Context) ([]*GetNodeSeenTimesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getNodeSeenTimes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetNodeSeenTimesRow
+	for rows.Next() {
+		var i GetNodeSeenTimesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CreatedAt,
+			&i.LastSeenAt,
+			&i.LastPongAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNodesAfterID = `-- name: GetNodesAfterID :many
+SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
+FROM node n
+JOIN node_address a ON a.node_id = n.id
+WHERE n.id IN (
+  SELECT b.id
+  FROM node b
+  WHERE b.id > ?1
+  ORDER BY b.id
+  LIMIT ?2
+)
+ORDER BY n.id, a.id
+`
+
+type GetNodesAfterIDParams struct {
+	AfterID   int64
+	BatchSize int64
+}
+
+type GetNodesAfterIDRow struct {
+	Node        Node
+	NodeAddress NodeAddress
+}
+
+func (q *Queries) GetNodesAfterID(ctx context.Context, arg *GetNodesAfterIDParams) ([]*GetNodesAfterIDRow, error) {
+	rows, err := q.db.QueryContext(ctx, getNodesAfterID, arg.AfterID, arg.BatchSize)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetNodesAfterIDRow
+	for rows.Next() {
+		var i GetNodesAfterIDRow
+		if err := rows.Scan(
+			&i.Node.ID,
+			&i.Node.CreatedAt,
+			&i.Node.LastSeenAt,
+			&i.Node.LastInfoReqAt,
+			&i.Node.LastInfoResAt,
+			&i.Node.PublicKey,
+			&i.Node.Fqdn,
+			&i.Node.Motd,
+			&i.Node.Version,
+			&i.NodeAddress.ID,
+			&i.NodeAddress.CreatedAt,
+			&i.NodeAddress.LastSeenAt,
+			&i.NodeAddress.LastPingAt,
+			&i.NodeAddress.LastPongAt,
+			&i.NodeAddress.NodeID,
+			&i.NodeAddress.Net,
+			&i.NodeAddress.Ip,
+			&i.NodeAddress.Port,
+			&i.NodeAddress.Ptr,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getNodesPage = `-- name: GetNodesPage :many
+WITH page AS (
+  SELECT b.id,
+    CASE WHEN CAST(?1 AS TEXT) = 'first_seen' THEN b.created_at ELSE b.last_seen_at END AS sort_key,
+    COUNT(*) OVER () AS total
+  FROM node b
+  WHERE b.id IN (
+    SELECT m.node_id
+    FROM matching m
+    WHERE CAST(?2 AS TEXT) = '' OR m.up = (CAST(?2 AS TEXT) = 'up')
+  )
+  ORDER BY sort_key DESC, b.id
+  LIMIT ?4
+  OFFSET ?3
+), matching AS (
+  SELECT f.node_id, MAX(f.last_pong_at IS NOT NULL
+    AND (unixepoch('subsec') - f.last_pong_at) < CAST(?5 AS REAL)) AS up
+  FROM node_address f
+  WHERE f.net IN (/*SLICE:nets*/?)
+  GROUP BY f.node_id
+)
+SELECT p.total, n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
+FROM page p
+JOIN node n ON n.id = p.id
+JOIN node_address a ON a.node_id = n.id
+ORDER BY p.sort_key DESC, n.id, a.id
+`
+
+type GetNodesPageParams struct {
+	Sort        string
+	Status      string
+	PageOffset  int64
+	PageSize    int64
+	NodeTimeout float64
+	Nets        []string
+}
+
+type GetNodesPageRow struct {
+	Total       int64
+	Node        Node
+	NodeAddress NodeAddress
+}
+
+// The matching nodes are those with an address of one of the given nets. If a
+// status is given, it's determined by those addresses alone. The total number
+// of matching nodes is returned with every row, so that it doesn't have to be
+// counted with a copy of the filter. The nets are the last parameter, because
+// sqlc expands the slice into multiple parameters, which would otherwise throw
+// off the numbering of the ones after it.
+func (q *Queries) GetNodesPage(ctx context.Context, arg *GetNodesPageParams) ([]*GetNodesPageRow, error) {
+	query := getNodesPage
+	var queryParams []interface{}
+	queryParams = append(queryParams, arg.Sort)
+	queryParams = append(queryParams, arg.Status)
+	queryParams = append(queryParams, arg.PageOffset)
+	queryParams = append(queryParams, arg.PageSize)
+	queryParams = append(queryParams, arg.NodeTimeout)
+	if len(arg.Nets) > 0 {
+		for _, v := range arg.Nets {
+			queryParams = append(queryParams, v)
+		}
+		query = strings.Replace(query, "/*SLICE:nets*/?", strings.Repeat(",?", len(arg.Nets))[1:], 1)
+	} else {
+		query = strings.Replace(query, "/*SLICE:nets*/?", "NULL", 1)
+	}
+	rows, err := q.db.QueryContext(ctx, query, queryParams...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetNodesPageRow
+	for rows.Next() {
+		var i GetNodesPageRow
+		if err := rows.Scan(
+			&i.Total,
+			&i.Node.ID,
+			&i.Node.CreatedAt,
+			&i.Node.LastSeenAt,
+			&i.Node.LastInfoReqAt,
+			&i.Node.LastInfoResAt,
+			&i.Node.PublicKey,
+			&i.Node.Fqdn,
+			&i.Node.Motd,
+			&i.Node.Version,
+			&i.NodeAddress.ID,
+			&i.NodeAddress.CreatedAt,
+			&i.NodeAddress.LastSeenAt,
+			&i.NodeAddress.LastPingAt,
+			&i.NodeAddress.LastPongAt,
+			&i.NodeAddress.NodeID,
+			&i.NodeAddress.Net,
+			&i.NodeAddress.Ip,
+			&i.NodeAddress.Port,
+			&i.NodeAddress.Ptr,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getNodesWithStaleBootstrapInfo = `-- name: GetNodesWithStaleBootstrapInfo :many
 SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
 FROM node n
@@ -221,6 +690,113 @@ func (q *Queries) GetNodesWithStaleBootstrapInfo(ctx context.Context, arg *GetNo
 	return items, nil
 }
 
+const getOfflineNodeCount = `-- name: GetOfflineNodeCount :one
+SELECT COUNT(*)
+FROM node n
+LEFT JOIN node_address a ON a.node_id = n.id
+  AND a.last_pong_at IS NOT NULL
+  AND (unixepoch('subsec') - a.last_pong_at) < CAST(?1 AS REAL)
+WHERE a.id IS NULL
+`
+
+func (q *Queries) GetOfflineNodeCount(ctx context.Context, nodeTimeout float64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getOfflineNodeCount, nodeTimeout)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const getOnlineNodeCount = `-- name: GetOnlineNodeCount :one
+SELECT COUNT(DISTINCT a.node_id)
+FROM node_address a
+WHERE a.last_pong_at IS NOT NULL
+  AND (unixepoch('subsec') - a.last_pong_at) < CAST(?1 AS REAL)
+`
+
+func (q *Queries) GetOnlineNodeCount(ctx context.Context, nodeTimeout float64) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getOnlineNodeCount, nodeTimeout)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
+const getOnlineNodes = `-- name: GetOnlineNodes :many
+SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
+FROM node n
+JOIN node_address a ON a.node_id = n.id
+WHERE a.last_pong_at IS NOT NULL
+  AND (unixepoch('subsec') - a.last_pong_at) < CAST(?1 AS REAL)
+`
+
+type GetOnlineNodesRow struct {
+	Node        Node
+	NodeAddress NodeAddress
+}
+
+func (q *Queries) GetOnlineNodes(ctx context.Context, nodeTimeout float64) ([]*GetOnlineNodesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getOnlineNodes, nodeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetOnlineNodesRow
+	for rows.Next() {
+		var i GetOnlineNodesRow
+		if err := rows.Scan(
+			&i.Node.ID,
+			&i.Node.CreatedAt,
+			&i.Node.LastSeenAt,
+			&i.Node.LastInfoReqAt,
+			&i.Node.LastInfoResAt,
+			&i.Node.PublicKey,
+			&i.Node.Fqdn,
+			&i.Node.Motd,
+			&i.Node.Version,
+			&i.NodeAddress.ID,
+			&i.NodeAddress.CreatedAt,
+			&i.NodeAddress.LastSeenAt,
+			&i.NodeAddress.LastPingAt,
+			&i.NodeAddress.LastPongAt,
+			&i.NodeAddress.NodeID,
+			&i.NodeAddress.Net,
+			&i.NodeAddress.Ip,
+			&i.NodeAddress.Port,
+			&i.NodeAddress.Ptr,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getRescan = `-- name: GetRescan :one
+SELECT id, started_at, finished_at, canceled_at, last_node_id, probed, total
+FROM rescan
+WHERE id = 1
+`
+
+func (q *Queries) GetRescan(ctx context.Context) (*Rescan, error) {
+	row := q.db.QueryRowContext(ctx, getRescan)
+	var i Rescan
+	err := row.Scan(
+		&i.ID,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.CanceledAt,
+		&i.LastNodeID,
+		&i.Probed,
+		&i.Total,
+	)
+	return &i, err
+}
+
 const getResponsiveNodes = `-- name: GetResponsiveNodes :many
 SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
 FROM node n
@@ -276,6 +852,47 @@ func (q *Queries) GetResponsiveNodes(ctx context.Context) ([]*GetResponsiveNodes
 	return items, nil
 }
 
+const getSharedIPs = `-- name: GetSharedIPs :many
+SELECT DISTINCT a.ip, n.public_key
+FROM node_address a
+JOIN node n ON n.id = a.node_id
+WHERE a.ip IN (
+  SELECT d.ip
+  FROM node_address d
+  GROUP BY d.ip
+  HAVING COUNT(DISTINCT d.node_id) > 1
+)
+ORDER BY a.ip, n.public_key
+`
+
+type GetSharedIPsRow struct {
+	Ip        string
+	PublicKey *PublicKey
+}
+
+func (q *Queries) GetSharedIPs(ctx context.Context) ([]*GetSharedIPsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getSharedIPs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*GetSharedIPsRow
+	for rows.Next() {
+		var i GetSharedIPsRow
+		if err := rows.Scan(&i.Ip, &i.PublicKey); err != nil {
+			return nil, err
+		}
+		items = append(items, &i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getUnresponsiveNodes = `-- name: GetUnresponsiveNodes :many
 SELECT n.id, n.created_at, n.last_seen_at, n.last_info_req_at, n.last_info_res_at, n.public_key, n.fqdn, n.motd, n.version, a.id, a.created_at, a.last_seen_at, a.last_ping_at, a.last_pong_at, a.node_id, a.net, a.ip, a.port, a.ptr
 FROM node n
@@ -370,6 +987,30 @@ func (q *Queries) PongNodeAddress(ctx context.Context, id int64) error {
 	return err
 }
 
+const startRescan = `-- name: StartRescan :one
+INSERT INTO rescan(id, total)
+VALUES(1, ?)
+ON CONFLICT(id) DO UPDATE SET
+  started_at = unixepoch('subsec'), finished_at = NULL, canceled_at = NULL,
+  last_node_id = 0, probed = 0, total = excluded.total
+RETURNING id, started_at, finished_at, canceled_at, last_node_id, probed, total
+`
+
+func (q *Queries) StartRescan(ctx context.Context, total int64) (*Rescan, error) {
+	row := q.db.QueryRowContext(ctx, startRescan, total)
+	var i Rescan
+	err := row.Scan(
+		&i.ID,
+		&i.StartedAt,
+		&i.FinishedAt,
+		&i.CanceledAt,
+		&i.LastNodeID,
+		&i.Probed,
+		&i.Total,
+	)
+	return &i, err
+}
+
 const updateNodeAddress = `-- name: UpdateNodeAddress :one
 UPDATE node_address
 SET node_id = ?, net = ?, ip = ?, port = ?, ptr = ?
@@ -411,6 +1052,38 @@ func (q *Queries) UpdateNodeAddress(ctx context.Context, arg *UpdateNodeAddressP
 	return &i, err
 }
 
+const updateNodeAddressPingTime = `-- name: UpdateNodeAddressPingTime :exec
+UPDATE node_address
+SET last_ping_at = ?
+WHERE id = ?
+`
+
+type UpdateNodeAddressPingTimeParams struct {
+	LastPingAt Time
+	ID         int64
+}
+
+func (q *Queries) UpdateNodeAddressPingTime(ctx context.Context, arg *UpdateNodeAddressPingTimeParams) error {
+	_, err := q.db.ExecContext(ctx, updateNodeAddressPingTime, arg.LastPingAt, arg.ID)
+	return err
+}
+
+const updateNodeAddressPongTime = `-- name: UpdateNodeAddressPongTime :exec
+UPDATE node_address
+SET last_pong_at = ?
+WHERE id = ?
+`
+
+type UpdateNodeAddressPongTimeParams struct {
+	LastPongAt Time
+	ID         int64
+}
+
+func (q *Queries) UpdateNodeAddressPongTime(ctx context.Context, arg *UpdateNodeAddressPongTimeParams) error {
+	_, err := q.db.ExecContext(ctx, updateNodeAddressPongTime, arg.LastPongAt, arg.ID)
+	return err
+}
+
 const updateNodeBootstrapInfo = `-- name: UpdateNodeBootstrapInfo :exec
 UPDATE node
 SET motd = ?, version = ?, last_info_res_at = unixepoch('subsec')
@@ -444,6 +1117,25 @@ func (q *Queries) UpdateNodeInfoRequestTime(ctx context.Context, arg *UpdateNode
 	return err
 }
 
+const updateRescanProgress = `-- name: UpdateRescanProgress :execrows
+UPDATE rescan
+SET last_node_id = ?, probed = ?
+WHERE id = 1 AND finished_at IS NULL AND canceled_at IS NULL
+`
+
+type UpdateRescanProgressParams struct {
+	LastNodeID int64
+	Probed     int64
+}
+
+func (q *Queries) UpdateRescanProgress(ctx context.Context, arg *UpdateRescanProgressParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updateRescanProgress, arg.LastNodeID, arg.Probed)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const upsertNode = `-- name: UpsertNode :one
 INSERT INTO node(public_key)
 VALUES(?)
@@ -0,0 +1,49 @@
+package db
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestGetNodesPageIndex(t *testing.T) {
+	readConn, writeConn, err := OpenReadWrite(ctx, ":memory:", OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		readConn.Close()
+		writeConn.Close()
+	})
+
+	// The parameters in the order that GetNodesPage passes them, with the nets
+	// of a filter by address family
+	query := strings.Replace(getNodesPage, "/*SLICE:nets*/?", "?,?", 1)
+	rows, err := writeConn.QueryContext(ctx, "EXPLAIN QUERY PLAN "+query, "", "up", 0, 100, 60.0, "udp4", "tcp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	var plan []string
+	for rows.Next() {
+		var id, parent, notUsed int
+		var detail string
+		if err := rows.Scan(&id, &parent, &notUsed, &detail); err != nil {
+			t.Fatal(err)
+		}
+		plan = append(plan, detail)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	const expected = "SEARCH f USING INDEX node_address_net_node_id (net=?)"
+	for _, detail := range plan {
+		if strings.HasPrefix(detail, "SCAN f") {
+			t.Fatalf("unexpected full scan of node_address: %q", plan)
+		}
+	}
+	if !strings.Contains(strings.Join(plan, "\n"), expected) {
+		t.Fatalf("expected the net filter to use the index, got: %q", plan)
+	}
+}
@@ -0,0 +1,160 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+const (
+	RepairActionOrphans    = "remove orphaned rows"
+	RepairActionEmptyNodes = "remove nodes without addresses"
+	RepairActionReindex    = "reindex"
+	RepairActionAnalyze    = "analyze"
+	RepairActionVacuum     = "vacuum"
+)
+
+// RepairAction is the result of one of the steps of Repair.
+type RepairAction struct {
+	Name string
+	// Rows is the number of rows that were removed, or would be removed in a
+	// dry run
+	Rows int64
+	// Skipped is true if the action wasn't run, because of a dry run
+	Skipped bool
+}
+
+// RepairReport describes the actions taken by Repair.
+type RepairReport struct {
+	Actions []*RepairAction
+	// FreeBytes is the size of the unused pages in the db file before it was
+	// vacuumed, which is roughly the amount of space reclaimed
+	FreeBytes int64
+}
+
+// Repair fixes common issues with the db and compacts it. Rows that violate a
+// foreign key constraint (which can happen if the db was modified with foreign
+// key enforcement turned off) are removed first, followed by nodes that no
+// longer have any addresses, after which the indexes are rebuilt, the query
+// planner statistics are refreshed and the db file is vacuumed. If dryRun is
+// true, only the rows that would be removed are counted.
+func Repair(ctx context.Context, conn *sql.DB, dryRun bool) (*RepairReport, error) {
+	var report RepairReport
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	orphans, err := removeOrphans(ctx, tx, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("remove orphaned rows: %w", err)
+	}
+	report.Actions = append(report.Actions, &RepairAction{Name: RepairActionOrphans, Rows: orphans})
+
+	emptyNodes, err := removeEmptyNodes(ctx, tx, dryRun)
+	if err != nil {
+		return nil, fmt.Errorf("remove nodes without addresses: %w", err)
+	}
+	report.Actions = append(report.Actions, &RepairAction{Name: RepairActionEmptyNodes, Rows: emptyNodes})
+
+	// The transaction has to be done with before the connection can be used
+	// again, because it may be the only one
+	if dryRun {
+		err = tx.Rollback()
+	} else {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pageSize, freePages int64
+	if err := conn.QueryRowContext(ctx, "PRAGMA page_size").Scan(&pageSize); err != nil {
+		return nil, fmt.Errorf("get page size: %w", err)
+	}
+	if err := conn.QueryRowContext(ctx, "PRAGMA freelist_count").Scan(&freePages); err != nil {
+		return nil, fmt.Errorf("get free page count: %w", err)
+	}
+	report.FreeBytes = pageSize * freePages
+
+	// VACUUM can't run in a transaction, so these are run separately after
+	// the rows have been removed
+	for _, action := range []string{RepairActionReindex, RepairActionAnalyze, RepairActionVacuum} {
+		if !dryRun {
+			if _, err := conn.ExecContext(ctx, action); err != nil {
+				return nil, fmt.Errorf("%s: %w", action, err)
+			}
+		}
+		report.Actions = append(report.Actions, &RepairAction{Name: action, Skipped: dryRun})
+	}
+
+	return &report, nil
+}
+
+// removeOrphans removes the rows that refer to a row in another table that
+// doesn't exist, as reported by sqlite's foreign key check.
+func removeOrphans(ctx context.Context, tx *sql.Tx, dryRun bool) (int64, error) {
+	rows, err := tx.QueryContext(ctx, "PRAGMA foreign_key_check")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	type orphan struct {
+		table string
+		rowID int64
+	}
+	var orphans []orphan
+	for rows.Next() {
+		var o orphan
+		var parent string
+		var fkID int64
+		if err := rows.Scan(&o.table, &o.rowID, &parent, &fkID); err != nil {
+			return 0, err
+		}
+		orphans = append(orphans, o)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	if dryRun {
+		return int64(len(orphans)), nil
+	}
+
+	var removed int64
+	for _, o := range orphans {
+		// The table name comes from sqlite itself, so it's safe to use here
+		res, err := tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %q WHERE rowid = ?", o.table), o.rowID)
+		if err != nil {
+			return 0, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return 0, err
+		}
+		removed += n
+	}
+
+	return removed, nil
+}
+
+// removeEmptyNodes removes the nodes that don't have any addresses left. These
+// can't be probed, so there's no point in keeping them around.
+func removeEmptyNodes(ctx context.Context, tx *sql.Tx, dryRun bool) (int64, error) {
+	const where = "WHERE NOT EXISTS (SELECT 1 FROM node_address a WHERE a.node_id = node.id)"
+	if dryRun {
+		var n int64
+		err := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM node "+where).Scan(&n)
+		return n, err
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM node "+where)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
@@ -0,0 +1,102 @@
+package db
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRepair(t *testing.T) {
+	readConn, writeConn, err := OpenReadWrite(ctx, filepath.Join(t.TempDir(), "test.db"), OpenOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		readConn.Close()
+		writeConn.Close()
+	})
+
+	// Foreign keys are enforced by the pragma hook, so turn them off for a
+	// single connection to be able to insert orphaned rows
+	conn, err := writeConn.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		"PRAGMA foreign_keys = false",
+		"INSERT INTO node(id, public_key) VALUES(1, '" + strings.Repeat("a", 64) + "')",
+		"INSERT INTO node(id, public_key) VALUES(2, '" + strings.Repeat("b", 64) + "')",
+		"INSERT INTO node_address(node_id, net, ip, port) VALUES(1, 'udp4', '1.1.1.1', 33445)",
+		// Orphaned addresses of a node that doesn't exist
+		"INSERT INTO node_address(node_id, net, ip, port) VALUES(3, 'udp4', '8.8.8.8', 33445)",
+		"INSERT INTO node_address(node_id, net, ip, port) VALUES(3, 'udp6', '2001:db8::1', 33445)",
+		"PRAGMA foreign_keys = true",
+	} {
+		if _, err := conn.ExecContext(ctx, stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn.Close()
+
+	count := func(table string) (n int) {
+		if err := writeConn.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	check := func(report *RepairReport, skipped bool) {
+		expected := []RepairAction{
+			{Name: RepairActionOrphans, Rows: 2},
+			{Name: RepairActionEmptyNodes, Rows: 1},
+			{Name: RepairActionReindex, Skipped: skipped},
+			{Name: RepairActionAnalyze, Skipped: skipped},
+			{Name: RepairActionVacuum, Skipped: skipped},
+		}
+		if len(report.Actions) != len(expected) {
+			t.Fatalf("unexpected number of actions: %d", len(report.Actions))
+		}
+		for i, action := range report.Actions {
+			if *action != expected[i] {
+				t.Fatalf("unexpected action %d: %+v", i, action)
+			}
+		}
+	}
+
+	report, err := Repair(ctx, writeConn, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report, true)
+	if n := count("node"); n != 2 {
+		t.Fatalf("dry run removed nodes: %d left", n)
+	}
+	if n := count("node_address"); n != 3 {
+		t.Fatalf("dry run removed node addresses: %d left", n)
+	}
+
+	report, err = Repair(ctx, writeConn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(report, false)
+	if n := count("node"); n != 1 {
+		t.Fatalf("unexpected number of nodes: %d", n)
+	}
+	if n := count("node_address"); n != 1 {
+		t.Fatalf("unexpected number of node addresses: %d", n)
+	}
+	if err := CheckSchema(ctx, writeConn); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything has been repaired, so a second run shouldn't find anything
+	report, err = Repair(ctx, writeConn, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, action := range report.Actions[:2] {
+		if action.Rows != 0 {
+			t.Fatalf("unexpected action: %+v", action)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+const (
+	DefaultBusyRetries    = 5
+	DefaultBusyRetryDelay = 100 * time.Millisecond
+)
+
+// WriteConn is a db connection that can be written to, either directly or in
+// a transaction. It's implemented by both *sql.DB and *RetryDB.
+type WriteConn interface {
+	DBTX
+	Begin() (*sql.Tx, error)
+}
+
+type RetryOptions struct {
+	Logger *slog.Logger
+	// Retries is the maximum number of times a statement is retried if sqlite
+	// reports that the db is busy.
+	Retries int
+	// Delay is the time to wait before the first retry. It's doubled for
+	// every retry after that. Defaults to DefaultBusyRetryDelay.
+	Delay time.Duration
+}
+
+// RetryDB wraps a db connection to retry statements that fail with
+// SQLITE_BUSY. The busy_timeout pragma already covers most contention within
+// sqlite itself, but not all of it: sqlite returns SQLITE_BUSY right away if
+// waiting could deadlock, for example when upgrading a read transaction.
+type RetryDB struct {
+	*sql.DB
+	opts RetryOptions
+}
+
+var _ WriteConn = (*RetryDB)(nil)
+
+func NewRetryDB(conn *sql.DB, opts RetryOptions) *RetryDB {
+	if opts.Delay == 0 {
+		opts.Delay = DefaultBusyRetryDelay
+	}
+	if opts.Logger == nil {
+		opts.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	}
+
+	return &RetryDB{DB: conn, opts: opts}
+}
+
+// IsBusy reports whether the given error is an SQLITE_BUSY error.
+func IsBusy(err error) bool {
+	var sqliteErr sqlite3.Error
+	return errors.As(err, &sqliteErr) && sqliteErr.Code == sqlite3.ErrBusy
+}
+
+func (d *RetryDB) ExecContext(ctx context.Context, query string, args ...interface{}) (res sql.Result, err error) {
+	err = d.retry(ctx, query, func() error {
+		res, err = d.DB.ExecContext(ctx, query, args...)
+		return err
+	})
+	return res, err
+}
+
+func (d *RetryDB) QueryContext(ctx context.Context, query string, args ...interface{}) (rows *sql.Rows, err error) {
+	err = d.retry(ctx, query, func() error {
+		rows, err = d.DB.QueryContext(ctx, query, args...)
+		return err
+	})
+	return rows, err
+}
+
+func (d *RetryDB) QueryRowContext(ctx context.Context, query string, args ...interface{}) (row *sql.Row) {
+	d.retry(ctx, query, func() error {
+		// The error of a row is known before it's scanned, so this doesn't
+		// consume it
+		row = d.DB.QueryRowContext(ctx, query, args...)
+		return row.Err()
+	})
+	return row
+}
+
+// Begin starts a transaction. The db is opened with _txlock=immediate, so
+// this is where a write transaction is most likely to run into SQLITE_BUSY.
+func (d *RetryDB) Begin() (tx *sql.Tx, err error) {
+	err = d.retry(context.Background(), "BEGIN", func() error {
+		tx, err = d.DB.Begin()
+		return err
+	})
+	return tx, err
+}
+
+func (d *RetryDB) retry(ctx context.Context, query string, fn func() error) error {
+	delay := d.opts.Delay
+	for i := 0; ; i++ {
+		err := fn()
+		if err == nil || !IsBusy(err) || i >= d.opts.Retries {
+			return err
+		}
+
+		d.opts.Logger.Debug("Retrying busy db statement",
+			slog.String("statement", statementName(query)),
+			slog.Int("attempt", i+1),
+			slog.Duration("delay", delay))
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// statementName returns the name that sqlc gave to the given query, or the
+// first line of the query if it doesn't have one.
+func statementName(query string) string {
+	first, _, _ := strings.Cut(strings.TrimSpace(query), "\n")
+	if name, ok := strings.CutPrefix(first, "-- name: "); ok {
+		name, _, _ = strings.Cut(name, " ")
+		return name
+	}
+	return first
+}
@@ -0,0 +1,122 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"io"
+	"log/slog"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+func init() {
+	RegisterPragmaHook(2000, "normal")
+}
+
+// hookHandler calls a function for every log record, after passing it on to
+// the wrapped handler.
+type hookHandler struct {
+	slog.Handler
+	fn func(r slog.Record)
+}
+
+func (h *hookHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.fn(r)
+	return h.Handler.Handle(ctx, r)
+}
+
+// openLockedDB opens a db file and holds a write lock on it through a separate
+// connection. The returned connection fails with SQLITE_BUSY right away until
+// unlock is called.
+func openLockedDB(t *testing.T) (conn *sql.DB, unlock func()) {
+	dbFile := filepath.Join(t.TempDir(), "test.db")
+	open := func() *sql.DB {
+		readConn, writeConn, err := OpenReadWrite(ctx, dbFile, OpenOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		readConn.Close()
+		t.Cleanup(func() { writeConn.Close() })
+		return writeConn
+	}
+
+	conn = open()
+	// Don't let sqlite wait for the lock itself. This sticks, because there's
+	// only a single write connection.
+	if _, err := conn.ExecContext(ctx, "PRAGMA busy_timeout = 0"); err != nil {
+		t.Fatal(err)
+	}
+
+	lockTx, err := open().Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var once sync.Once
+	unlock = func() {
+		once.Do(func() {
+			if err := lockTx.Rollback(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+	t.Cleanup(unlock)
+
+	return conn, unlock
+}
+
+func TestRetryDB(t *testing.T) {
+	conn, unlock := openLockedDB(t)
+
+	var retries []string
+	logger := slog.New(&hookHandler{
+		Handler: slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: slog.LevelDebug}),
+		fn: func(r slog.Record) {
+			r.Attrs(func(attr slog.Attr) bool {
+				if attr.Key == "statement" {
+					retries = append(retries, attr.Value.String())
+				}
+				return true
+			})
+			// Release the lock after the first failed attempt
+			unlock()
+		},
+	})
+
+	rdb := NewRetryDB(conn, RetryOptions{
+		Logger:  logger,
+		Retries: 5,
+		Delay:   10 * time.Millisecond,
+	})
+	if err := New(rdb).UpdateNodeAddressPingTime(ctx, &UpdateNodeAddressPingTimeParams{
+		LastPingAt: Time(time.Now()),
+		ID:         1,
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(retries) != 1 || retries[0] != "UpdateNodeAddressPingTime" {
+		t.Fatalf("unexpected retries: %v", retries)
+	}
+}
+
+func TestRetryDBExhausted(t *testing.T) {
+	conn, _ := openLockedDB(t)
+
+	rdb := NewRetryDB(conn, RetryOptions{
+		Retries: 2,
+		Delay:   time.Millisecond,
+	})
+	_, err := rdb.ExecContext(ctx, "DELETE FROM node")
+	if !IsBusy(err) {
+		t.Fatalf("expected busy error, got: %v", err)
+	}
+
+	if _, err := rdb.Begin(); !IsBusy(err) {
+		t.Fatalf("expected busy error, got: %v", err)
+	}
+}
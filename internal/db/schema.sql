@@ -30,3 +30,22 @@ CREATE TABLE IF NOT EXISTS node_address (
   UNIQUE(node_id, net, ip, port),
   FOREIGN KEY (node_id) REFERENCES node (id) 
 ) STRICT;
+
+-- Used to filter nodes by the protocol and address family of their addresses
+CREATE INDEX IF NOT EXISTS node_address_net_node_id ON node_address (net, node_id);
+
+-- The progress of the most recent operator-triggered full rescan. There's at
+-- most one row, because only one rescan can run at a time.
+CREATE TABLE IF NOT EXISTS rescan (
+  id            INTEGER NOT NULL PRIMARY KEY CHECK (id = 1),
+  started_at    REAL NOT NULL DEFAULT(unixepoch('subsec')),
+  finished_at   REAL,
+  canceled_at   REAL,
+  -- The ID of the last node that was probed. Nodes are probed in order of ID,
+  -- so an interrupted rescan resumes after it.
+  last_node_id  INTEGER NOT NULL DEFAULT 0,
+  -- The number of nodes probed so far
+  probed        INTEGER NOT NULL DEFAULT 0,
+  -- The number of nodes that were known when the rescan was started
+  total         INTEGER NOT NULL
+) STRICT;
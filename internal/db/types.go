@@ -4,6 +4,7 @@ import (
 	"database/sql/driver"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"time"
 
 	"github.com/alexbakker/tox4go/dht"
@@ -23,7 +24,9 @@ func (t *Time) Scan(src any) error {
 		return fmt.Errorf("can't scan into db.Time: %T", src)
 	}
 
-	*t = Time(time.UnixMilli(int64(f * 1000)))
+	// The seconds are rarely exact as a float, so round to the nearest
+	// millisecond instead of truncating, which could end up 1ms early
+	*t = Time(time.UnixMilli(int64(math.Round(f * 1000))))
 	return nil
 }
 
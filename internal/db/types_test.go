@@ -0,0 +1,25 @@
+package db
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimeRoundTrip(t *testing.T) {
+	start := time.Now().Truncate(time.Millisecond)
+	for i := 0; i < 1000; i++ {
+		expected := start.Add(time.Duration(i) * time.Millisecond)
+
+		value, err := Time(expected).Value()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var res Time
+		if err := res.Scan(value); err != nil {
+			t.Fatal(err)
+		}
+		if !time.Time(res).Equal(expected) {
+			t.Fatalf("expected %s, got %s", expected, time.Time(res))
+		}
+	}
+}
@@ -0,0 +1,50 @@
+// Package debug provides helpers for inspecting the state of a running
+// ToxStatus instance.
+package debug
+
+import "sync"
+
+// Ring is a fixed-size ring buffer that keeps the most recent items that were
+// added to it. It's safe for concurrent use.
+type Ring[T any] struct {
+	m     sync.Mutex
+	items []T
+	next  int
+	full  bool
+}
+
+// NewRing returns a ring buffer that holds up to size items.
+func NewRing[T any](size int) *Ring[T] {
+	return &Ring[T]{items: make([]T, size)}
+}
+
+// Add adds the given item to the ring buffer, overwriting the oldest one if
+// the buffer is full.
+func (r *Ring[T]) Add(item T) {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if len(r.items) == 0 {
+		return
+	}
+
+	r.items[r.next] = item
+	r.next = (r.next + 1) % len(r.items)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// Items returns a copy of the items in the ring buffer, oldest first.
+func (r *Ring[T]) Items() []T {
+	r.m.Lock()
+	defer r.m.Unlock()
+
+	if !r.full {
+		return append([]T(nil), r.items[:r.next]...)
+	}
+
+	res := make([]T, 0, len(r.items))
+	res = append(res, r.items[r.next:]...)
+	return append(res, r.items[:r.next]...)
+}
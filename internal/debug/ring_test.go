@@ -0,0 +1,31 @@
+package debug
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRing(t *testing.T) {
+	ring := NewRing[int](3)
+	for _, tc := range []struct {
+		Add   int
+		Items []int
+	}{
+		{1, []int{1}},
+		{2, []int{1, 2}},
+		{3, []int{1, 2, 3}},
+		{4, []int{2, 3, 4}},
+		{5, []int{3, 4, 5}},
+		{6, []int{4, 5, 6}},
+		{7, []int{5, 6, 7}},
+	} {
+		ring.Add(tc.Add)
+		if items := ring.Items(); !reflect.DeepEqual(items, tc.Items) {
+			t.Fatalf("after adding %d: expected %v, got %v", tc.Add, tc.Items, items)
+		}
+	}
+
+	if items := NewRing[int](3).Items(); len(items) != 0 {
+		t.Fatalf("expected empty ring, got %v", items)
+	}
+}
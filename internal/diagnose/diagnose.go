@@ -0,0 +1,163 @@
+// Package diagnose implements the checks run by the diagnose subcommand.
+package diagnose
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/alexbakker/tox4go/toxstatus"
+)
+
+// Check is a single self-diagnostic check.
+type Check interface {
+	Name() string
+	// Run performs the check. It returns an error describing the problem if
+	// the check fails.
+	Run(ctx context.Context) error
+}
+
+type Result struct {
+	Check Check
+	Err   error
+}
+
+// Run runs the given checks in order and returns their results. A failing
+// check does not prevent the ones after it from running.
+func Run(ctx context.Context, checks []Check) []*Result {
+	var results []*Result
+	for _, check := range checks {
+		results = append(results, &Result{
+			Check: check,
+			Err:   check.Run(ctx),
+		})
+	}
+
+	return results
+}
+
+// DBCheck checks that the db can be opened and that it's intact. The sqlite
+// driver must have been registered with db.RegisterPragmaHook beforehand.
+type DBCheck struct {
+	File string
+}
+
+func (c *DBCheck) Name() string {
+	return "db"
+}
+
+func (c *DBCheck) Run(ctx context.Context) error {
+	if err := db.CheckDir(c.File, false); err != nil {
+		return err
+	}
+
+	readConn, writeConn, err := db.OpenReadWrite(ctx, c.File, db.OpenOptions{})
+	if err != nil {
+		return fmt.Errorf("open db: %w", err)
+	}
+	defer func() {
+		readConn.Close()
+		writeConn.Close()
+	}()
+
+	return db.CheckSchema(ctx, readConn)
+}
+
+// BootstrapCheck checks that the list of bootstrap nodes can be fetched and
+// that it contains at least one online node.
+type BootstrapCheck struct {
+	Client *toxstatus.Client
+}
+
+func (c *BootstrapCheck) Name() string {
+	return "bootstrap nodes"
+}
+
+func (c *BootstrapCheck) Run(ctx context.Context) error {
+	nodes, err := c.Client.GetNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("no online nodes returned")
+	}
+
+	return nil
+}
+
+// UDPBindCheck checks that a UDP socket can be bound to the given address.
+// This fails if another instance is already running.
+type UDPBindCheck struct {
+	Addr string
+}
+
+func (c *UDPBindCheck) Name() string {
+	return "udp socket"
+}
+
+func (c *UDPBindCheck) Run(ctx context.Context) error {
+	var lc net.ListenConfig
+	conn, err := lc.ListenPacket(ctx, "udp", c.Addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
+
+// DiskSpaceCheck checks that the file system that the db file is on has at
+// least MinFree bytes of free space left.
+type DiskSpaceCheck struct {
+	File    string
+	MinFree uint64
+}
+
+func (c *DiskSpaceCheck) Name() string {
+	return "disk space"
+}
+
+func (c *DiskSpaceCheck) Run(ctx context.Context) error {
+	free, err := freeSpace(filepath.Dir(c.File))
+	if err != nil {
+		return err
+	}
+	if free < c.MinFree {
+		return fmt.Errorf("%d MB free, need at least %d MB", free>>20, c.MinFree>>20)
+	}
+
+	return nil
+}
+
+// DBSizeCheck checks that the db file, including its write-ahead log, is not
+// larger than MaxSize bytes.
+type DBSizeCheck struct {
+	File    string
+	MaxSize int64
+}
+
+func (c *DBSizeCheck) Name() string {
+	return "db size"
+}
+
+func (c *DBSizeCheck) Run(ctx context.Context) error {
+	var size int64
+	for _, file := range []string{c.File, c.File + "-wal"} {
+		fi, err := os.Stat(file)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) && file != c.File {
+				continue
+			}
+			return err
+		}
+		size += fi.Size()
+	}
+	if size > c.MaxSize {
+		return fmt.Errorf("db is %d MB, limit is %d MB", size>>20, c.MaxSize>>20)
+	}
+
+	return nil
+}
@@ -0,0 +1,131 @@
+package diagnose
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/2mf/ToxStatus/internal/db"
+	"github.com/alexbakker/tox4go/toxstatus"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+var ctx = context.Background()
+
+func init() {
+	db.RegisterPragmaHook(2000, "normal")
+}
+
+type mockCheck struct {
+	name string
+	err  error
+	ran  bool
+}
+
+func (c *mockCheck) Name() string {
+	return c.name
+}
+
+func (c *mockCheck) Run(ctx context.Context) error {
+	c.ran = true
+	return c.err
+}
+
+func TestRun(t *testing.T) {
+	checkErr := errors.New("broken")
+	checks := []*mockCheck{
+		{name: "first"},
+		{name: "second", err: checkErr},
+		{name: "third"},
+	}
+
+	var cs []Check
+	for _, check := range checks {
+		cs = append(cs, check)
+	}
+
+	results := Run(ctx, cs)
+	if len(results) != len(checks) {
+		t.Fatalf("expected %d results, got %d", len(checks), len(results))
+	}
+	for i, res := range results {
+		if !checks[i].ran {
+			t.Fatalf("check %s didn't run", checks[i].name)
+		}
+		if res.Check != checks[i] || !errors.Is(res.Err, checks[i].err) {
+			t.Fatalf("unexpected result for check %s: %v", checks[i].name, res.Err)
+		}
+	}
+}
+
+func TestDBCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "toxstatus.db")
+	if err := (&DBCheck{File: file}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	file = filepath.Join(t.TempDir(), "nonexistent", "toxstatus.db")
+	if err := (&DBCheck{File: file}).Run(ctx); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected not exist error, got: %v", err)
+	}
+}
+
+func TestBootstrapCheck(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"nodes": []}`))
+	}))
+	defer srv.Close()
+
+	check := &BootstrapCheck{Client: &toxstatus.Client{URL: srv.URL}}
+	if err := check.Run(ctx); err == nil {
+		t.Fatal("expected error for empty node list")
+	}
+}
+
+func TestUDPBindCheck(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := (&UDPBindCheck{Addr: conn.LocalAddr().String()}).Run(ctx); err == nil {
+		t.Fatal("expected error for address in use")
+	}
+	if err := (&UDPBindCheck{Addr: "127.0.0.1:0"}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDiskSpaceCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "toxstatus.db")
+	if err := (&DiskSpaceCheck{File: file}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&DiskSpaceCheck{File: file, MinFree: math.MaxUint64}).Run(ctx); err == nil {
+		t.Fatal("expected error for insufficient disk space")
+	}
+}
+
+func TestDBSizeCheck(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "toxstatus.db")
+	if err := os.WriteFile(file, make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file+"-wal", make([]byte, 1024), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&DBSizeCheck{File: file, MaxSize: 2048}).Run(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&DBSizeCheck{File: file, MaxSize: 2047}).Run(ctx); err == nil {
+		t.Fatal("expected error for db exceeding size limit")
+	}
+}
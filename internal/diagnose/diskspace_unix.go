@@ -0,0 +1,17 @@
+//go:build unix
+
+package diagnose
+
+import (
+	"fmt"
+	"syscall"
+)
+
+func freeSpace(dir string) (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, fmt.Errorf("statfs %s: %w", dir, err)
+	}
+
+	return st.Bavail * uint64(st.Bsize), nil
+}
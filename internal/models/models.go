@@ -1,6 +1,8 @@
 package models
 
 import (
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net"
 	"time"
@@ -19,6 +21,31 @@ type Node struct {
 	MOTD          *string        `json:"motd"`
 	Version       uint32         `json:"version"`
 	Addresses     []*NodeAddress `json:"addresses"`
+	// ReputationFlagged is set if one of the addresses of the node is in a
+	// range flagged by the configured IP reputation feed.
+	ReputationFlagged bool `json:"reputation_flagged"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. It encodes the public
+// key of the node as a hex string, and the timestamps as described in
+// formatJSONTime.
+func (n *Node) MarshalJSON() ([]byte, error) {
+	type node Node
+	return json.Marshal(&struct {
+		*node
+		CreatedAt     *string `json:"created_at"`
+		LastSeenAt    *string `json:"last_seen_at"`
+		LastInfoReqAt *string `json:"last_info_req_at"`
+		LastInfoResAt *string `json:"last_info_res_at"`
+		PublicKey     string  `json:"public_key"`
+	}{
+		node:          (*node)(n),
+		CreatedAt:     formatJSONTime(n.CreatedAt),
+		LastSeenAt:    formatJSONTime(n.LastSeenAt),
+		LastInfoReqAt: formatJSONTime(n.LastInfoReqAt),
+		LastInfoResAt: formatJSONTime(n.LastInfoResAt),
+		PublicKey:     n.PublicKey.String(),
+	})
 }
 
 type NodeAddress struct {
@@ -34,6 +61,38 @@ type NodeAddress struct {
 	Ptr        *string   `json:"ptr"`
 }
 
+// MarshalJSON implements the json.Marshaler interface. It encodes the
+// timestamps as described in formatJSONTime.
+func (a *NodeAddress) MarshalJSON() ([]byte, error) {
+	type nodeAddress NodeAddress
+	return json.Marshal(&struct {
+		*nodeAddress
+		CreatedAt  *string `json:"created_at"`
+		LastSeenAt *string `json:"last_seen_at"`
+		LastPingAt *string `json:"last_ping_at"`
+		LastPongAt *string `json:"last_pong_at"`
+	}{
+		nodeAddress: (*nodeAddress)(a),
+		CreatedAt:   formatJSONTime(a.CreatedAt),
+		LastSeenAt:  formatJSONTime(a.LastSeenAt),
+		LastPingAt:  formatJSONTime(a.LastPingAt),
+		LastPongAt:  formatJSONTime(a.LastPongAt),
+	})
+}
+
+// formatJSONTime formats the given time the way all timestamps are represented
+// in the JSON output: as an RFC 3339 string in UTC, or null if the time is
+// unset. Without this, times read from the db would be encoded in the local
+// time zone of the server, and unset ones as "0001-01-01T00:00:00Z".
+func formatJSONTime(t time.Time) *string {
+	if t.IsZero() {
+		return nil
+	}
+
+	s := t.UTC().Format(time.RFC3339Nano)
+	return &s
+}
+
 func (a *NodeAddress) DHTNode() (*dht.Node, error) {
 	publicKey := (*dht.PublicKey)(a.Node.PublicKey)
 
@@ -54,3 +113,43 @@ func (a *NodeAddress) DHTNode() (*dht.Node, error) {
 		Port:      int(a.Port),
 	}, nil
 }
+
+// IsGlobalUnicast reports whether the given IP address is one that a node on
+// the public internet could be reached at.
+func IsGlobalUnicast(ip net.IP) bool {
+	return !ip.IsUnspecified() &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsMulticast() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast()
+}
+
+// AnonymizeIP masks the host part of the given IP address: the last octet of
+// an IPv4 address and the last 80 bits of an IPv6 address, leaving the /24 or
+// the /48 network. An empty string is returned if the IP address is invalid.
+func AnonymizeIP(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String()
+}
+
+// ParsePublicKey parses a hex-encoded public key.
+func ParsePublicKey(s string) (*dht.PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != dht.PublicKeySize {
+		return nil, fmt.Errorf("bad public key size: %d", len(b))
+	}
+
+	var pk dht.PublicKey
+	copy(pk[:], b)
+	return &pk, nil
+}
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/alexbakker/tox4go/dht"
+)
+
+func TestAnonymizeIP(t *testing.T) {
+	for ip, expected := range map[string]string{
+		"192.0.2.123":                      "192.0.2.0",
+		"::ffff:192.0.2.123":               "192.0.2.0",
+		"2001:db8:1234:5678:9abc:def0:1:2": "2001:db8:1234::",
+		"not an ip":                        "",
+	} {
+		if res := AnonymizeIP(ip); res != expected {
+			t.Fatalf("%s: expected %q, got %q", ip, expected, res)
+		}
+	}
+}
+
+func TestNodeMarshalJSON(t *testing.T) {
+	ident, err := dht.NewIdentity(dht.IdentityOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created := time.Date(2024, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	node := &Node{
+		CreatedAt: created,
+		PublicKey: ident.PublicKey,
+	}
+	node.Addresses = []*NodeAddress{{
+		Node:       node,
+		CreatedAt:  created,
+		LastPongAt: created,
+		Net:        "udp4",
+		IP:         "192.0.2.1",
+		Port:       33445,
+	}}
+
+	data, err := json.Marshal(node)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var res map[string]any
+	if err := json.Unmarshal(data, &res); err != nil {
+		t.Fatal(err)
+	}
+
+	if res["public_key"] != ident.PublicKey.String() {
+		t.Fatalf("unexpected public key: %v", res["public_key"])
+	}
+	if res["created_at"] != "2024-01-02T02:04:05Z" {
+		t.Fatalf("created_at not in UTC: %v", res["created_at"])
+	}
+	if v, ok := res["last_seen_at"]; !ok || v != nil {
+		t.Fatalf("unset last_seen_at not null: %v", v)
+	}
+
+	addr := res["addresses"].([]any)[0].(map[string]any)
+	if addr["last_pong_at"] != "2024-01-02T02:04:05Z" {
+		t.Fatalf("last_pong_at not in UTC: %v", addr["last_pong_at"])
+	}
+	if v, ok := addr["last_ping_at"]; !ok || v != nil {
+		t.Fatalf("unset last_ping_at not null: %v", v)
+	}
+	if _, ok := addr["port"].(float64); !ok {
+		t.Fatalf("port not a number: %v", addr["port"])
+	}
+}
@@ -0,0 +1,59 @@
+package models
+
+import (
+	"encoding/json"
+	"time"
+)
+
+const (
+	RescanStatusRunning  = "running"
+	RescanStatusFinished = "finished"
+	RescanStatusCanceled = "canceled"
+)
+
+// Rescan is an operator-triggered pass over all known nodes, that probes each
+// of them once.
+type Rescan struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	CanceledAt time.Time `json:"canceled_at"`
+	// LastNodeID is the ID of the last node that was probed. Nodes are probed
+	// in order of ID, so an interrupted rescan resumes after it.
+	LastNodeID int64 `json:"-"`
+	Probed     int   `json:"probed"`
+	// Total is the number of nodes that were known when the rescan was
+	// started. Nodes tracked since then are probed as well, so Probed can end
+	// up higher than Total.
+	Total int `json:"total"`
+}
+
+// Status returns one of the RescanStatus constants.
+func (r *Rescan) Status() string {
+	switch {
+	case !r.CanceledAt.IsZero():
+		return RescanStatusCanceled
+	case !r.FinishedAt.IsZero():
+		return RescanStatusFinished
+	default:
+		return RescanStatusRunning
+	}
+}
+
+// MarshalJSON implements the json.Marshaler interface. It adds the status of
+// the rescan, and encodes the timestamps as described in formatJSONTime.
+func (r *Rescan) MarshalJSON() ([]byte, error) {
+	type rescan Rescan
+	return json.Marshal(&struct {
+		*rescan
+		Status     string  `json:"status"`
+		StartedAt  *string `json:"started_at"`
+		FinishedAt *string `json:"finished_at"`
+		CanceledAt *string `json:"canceled_at"`
+	}{
+		rescan:     (*rescan)(r),
+		Status:     r.Status(),
+		StartedAt:  formatJSONTime(r.StartedAt),
+		FinishedAt: formatJSONTime(r.FinishedAt),
+		CanceledAt: formatJSONTime(r.CanceledAt),
+	})
+}
@@ -0,0 +1,192 @@
+// Package mock provides a mock implementation of repo.NodeRepository for use
+// in tests.
+package mock
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/2mf/ToxStatus/internal/models"
+	"github.com/2mf/ToxStatus/internal/repo"
+	"github.com/alexbakker/tox4go/dht"
+	testifymock "github.com/stretchr/testify/mock"
+)
+
+type MockNodeRepository struct {
+	testifymock.Mock
+}
+
+var _ repo.NodeRepository = (*MockNodeRepository)(nil)
+
+func (m *MockNodeRepository) GetNodeByPublicKey(ctx context.Context, pk *dht.PublicKey) (*models.Node, error) {
+	args := m.Called(ctx, pk)
+	node, _ := args.Get(0).(*models.Node)
+	return node, args.Error(1)
+}
+
+func (m *MockNodeRepository) ForEachNode(ctx context.Context, fn func(node *models.Node) error) error {
+	args := m.Called(ctx, fn)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) ForEachNodeAfterID(ctx context.Context, afterID int64, fn func(node *models.Node) error) error {
+	args := m.Called(ctx, afterID, fn)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) HasNodeByPublicKey(ctx context.Context, pk *dht.PublicKey) (bool, error) {
+	args := m.Called(ctx, pk)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockNodeRepository) GetNodeCount(ctx context.Context) (int64, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockNodeRepository) CountNodes(ctx context.Context, filters repo.NodeFilters) (int64, error) {
+	args := m.Called(ctx, filters)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *MockNodeRepository) GetNodesPage(ctx context.Context, opts repo.PageOptions) ([]*models.Node, int64, error) {
+	args := m.Called(ctx, opts)
+	return args.Get(0).([]*models.Node), args.Get(1).(int64), args.Error(2)
+}
+
+func (m *MockNodeRepository) CapabilityMatrix(ctx context.Context) (*repo.CapabilityMatrix, error) {
+	args := m.Called(ctx)
+	matrix, _ := args.Get(0).(*repo.CapabilityMatrix)
+	return matrix, args.Error(1)
+}
+
+func (m *MockNodeRepository) AgeDistribution(ctx context.Context, bounds []time.Duration) ([]*repo.AgeBucket, error) {
+	args := m.Called(ctx, bounds)
+	buckets, _ := args.Get(0).([]*repo.AgeBucket)
+	return buckets, args.Error(1)
+}
+
+func (m *MockNodeRepository) ChurnReport(ctx context.Context, period time.Duration, windows int) ([]*repo.ChurnWindow, error) {
+	args := m.Called(ctx, period, windows)
+	report, _ := args.Get(0).([]*repo.ChurnWindow)
+	return report, args.Error(1)
+}
+
+func (m *MockNodeRepository) NewNodesPerPeriod(ctx context.Context, window time.Duration, bucketSize time.Duration) ([]*repo.PeriodBucket, error) {
+	args := m.Called(ctx, window, bucketSize)
+	buckets, _ := args.Get(0).([]*repo.PeriodBucket)
+	return buckets, args.Error(1)
+}
+
+func (m *MockNodeRepository) FindSimilar(ctx context.Context, pk *dht.PublicKey, limit int) ([]*repo.ScoredNode, error) {
+	args := m.Called(ctx, pk, limit)
+	nodes, _ := args.Get(0).([]*repo.ScoredNode)
+	return nodes, args.Error(1)
+}
+
+func (m *MockNodeRepository) TrackDHTNode(ctx context.Context, node *dht.Node) (*models.Node, error) {
+	args := m.Called(ctx, node)
+	res, _ := args.Get(0).(*models.Node)
+	return res, args.Error(1)
+}
+
+func (m *MockNodeRepository) PingDHTNode(ctx context.Context, node *dht.Node) error {
+	args := m.Called(ctx, node)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) PongDHTNode(ctx context.Context, node *dht.Node) error {
+	args := m.Called(ctx, node)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) GetNodesWithStaleBootstrapInfo(ctx context.Context) ([]*models.Node, error) {
+	args := m.Called(ctx)
+	nodes, _ := args.Get(0).([]*models.Node)
+	return nodes, args.Error(1)
+}
+
+func (m *MockNodeRepository) GetOnlineNodes(ctx context.Context) ([]*models.Node, error) {
+	args := m.Called(ctx)
+	nodes, _ := args.Get(0).([]*models.Node)
+	return nodes, args.Error(1)
+}
+
+func (m *MockNodeRepository) UpdateNodeInfoRequestTime(ctx context.Context, addrReqTimes map[int64]time.Time) error {
+	args := m.Called(ctx, addrReqTimes)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) UpdateNodeInfo(ctx context.Context, addr *net.UDPAddr, motd string, version uint32) error {
+	args := m.Called(ctx, addr, motd, version)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) GetResponsiveDHTNodes(ctx context.Context) ([]*dht.Node, error) {
+	args := m.Called(ctx)
+	nodes, _ := args.Get(0).([]*dht.Node)
+	return nodes, args.Error(1)
+}
+
+func (m *MockNodeRepository) GetUnresponsiveDHTNodes(ctx context.Context, retryDelay time.Duration) ([]*dht.Node, error) {
+	args := m.Called(ctx, retryDelay)
+	nodes, _ := args.Get(0).([]*dht.Node)
+	return nodes, args.Error(1)
+}
+
+func (m *MockNodeRepository) FindDuplicates(ctx context.Context) ([]*repo.MergeResult, error) {
+	args := m.Called(ctx)
+	results, _ := args.Get(0).([]*repo.MergeResult)
+	return results, args.Error(1)
+}
+
+func (m *MockNodeRepository) FindAndMergeDuplicates(ctx context.Context) ([]*repo.MergeResult, error) {
+	args := m.Called(ctx)
+	results, _ := args.Get(0).([]*repo.MergeResult)
+	return results, args.Error(1)
+}
+
+func (m *MockNodeRepository) GetDenseIPs(ctx context.Context, threshold int) ([]*repo.DenseIP, error) {
+	args := m.Called(ctx, threshold)
+	ips, _ := args.Get(0).([]*repo.DenseIP)
+	return ips, args.Error(1)
+}
+
+func (m *MockNodeRepository) CleanInvalidNodes(ctx context.Context, opts repo.CleanOptions) (*repo.CleanReport, error) {
+	args := m.Called(ctx, opts)
+	report, _ := args.Get(0).(*repo.CleanReport)
+	return report, args.Error(1)
+}
+
+func (m *MockNodeRepository) UpdateProbeResults(ctx context.Context, results []*repo.ProbeResult) error {
+	args := m.Called(ctx, results)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) GetRescan(ctx context.Context) (*models.Rescan, error) {
+	args := m.Called(ctx)
+	rescan, _ := args.Get(0).(*models.Rescan)
+	return rescan, args.Error(1)
+}
+
+func (m *MockNodeRepository) StartRescan(ctx context.Context) (*models.Rescan, error) {
+	args := m.Called(ctx)
+	rescan, _ := args.Get(0).(*models.Rescan)
+	return rescan, args.Error(1)
+}
+
+func (m *MockNodeRepository) UpdateRescanProgress(ctx context.Context, lastNodeID int64, probed int) (bool, error) {
+	args := m.Called(ctx, lastNodeID, probed)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *MockNodeRepository) FinishRescan(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+func (m *MockNodeRepository) CancelRescan(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
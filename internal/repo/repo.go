@@ -3,11 +3,15 @@ package repo
 import (
 	"context"
 	"database/sql"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net"
+	"slices"
+	"strings"
 	"time"
 
+	"github.com/2mf/ToxStatus/internal/clock"
 	"github.com/2mf/ToxStatus/internal/db"
 	"github.com/2mf/ToxStatus/internal/models"
 	"github.com/alexbakker/tox4go/dht"
@@ -16,10 +20,337 @@ import (
 
 var ErrNotFound = fmt.Errorf("not found: %w", sql.ErrNoRows)
 
+// ErrRescanRunning is returned by StartRescan if a rescan is already running.
+var ErrRescanRunning = errors.New("a rescan is already running")
+
+// NodeTimeout is the time after which a node address is no longer considered
+// to be online if it hasn't responded to any of our requests.
+const NodeTimeout = 5 * time.Minute
+
+// NodeRepository is the interface through which the rest of the application
+// accesses the node db. NodesRepo is the sqlite implementation of it.
+type NodeRepository interface {
+	GetNodeByPublicKey(ctx context.Context, pk *dht.PublicKey) (*models.Node, error)
+	ForEachNode(ctx context.Context, fn func(node *models.Node) error) error
+	ForEachNodeAfterID(ctx context.Context, afterID int64, fn func(node *models.Node) error) error
+	HasNodeByPublicKey(ctx context.Context, pk *dht.PublicKey) (bool, error)
+	GetNodeCount(ctx context.Context) (int64, error)
+	CountNodes(ctx context.Context, filters NodeFilters) (int64, error)
+	GetNodesPage(ctx context.Context, opts PageOptions) ([]*models.Node, int64, error)
+	CapabilityMatrix(ctx context.Context) (*CapabilityMatrix, error)
+	AgeDistribution(ctx context.Context, bounds []time.Duration) ([]*AgeBucket, error)
+	ChurnReport(ctx context.Context, period time.Duration, windows int) ([]*ChurnWindow, error)
+	NewNodesPerPeriod(ctx context.Context, window time.Duration, bucketSize time.Duration) ([]*PeriodBucket, error)
+	FindSimilar(ctx context.Context, pk *dht.PublicKey, limit int) ([]*ScoredNode, error)
+	TrackDHTNode(ctx context.Context, node *dht.Node) (*models.Node, error)
+	PingDHTNode(ctx context.Context, node *dht.Node) error
+	PongDHTNode(ctx context.Context, node *dht.Node) error
+	GetNodesWithStaleBootstrapInfo(ctx context.Context) ([]*models.Node, error)
+	GetOnlineNodes(ctx context.Context) ([]*models.Node, error)
+	UpdateNodeInfoRequestTime(ctx context.Context, addrReqTimes map[int64]time.Time) error
+	UpdateNodeInfo(ctx context.Context, addr *net.UDPAddr, motd string, version uint32) error
+	GetResponsiveDHTNodes(ctx context.Context) ([]*dht.Node, error)
+	GetUnresponsiveDHTNodes(ctx context.Context, retryDelay time.Duration) ([]*dht.Node, error)
+	FindDuplicates(ctx context.Context) ([]*MergeResult, error)
+	FindAndMergeDuplicates(ctx context.Context) ([]*MergeResult, error)
+	GetDenseIPs(ctx context.Context, threshold int) ([]*DenseIP, error)
+	CleanInvalidNodes(ctx context.Context, opts CleanOptions) (*CleanReport, error)
+	UpdateProbeResults(ctx context.Context, results []*ProbeResult) error
+	GetRescan(ctx context.Context) (*models.Rescan, error)
+	StartRescan(ctx context.Context) (*models.Rescan, error)
+	UpdateRescanProgress(ctx context.Context, lastNodeID int64, probed int) (bool, error)
+	FinishRescan(ctx context.Context) error
+	CancelRescan(ctx context.Context) error
+}
+
+type ProbeKind int
+
+const (
+	// ProbeKindPing is a getnodes request sent to a node.
+	ProbeKindPing ProbeKind = iota
+	// ProbeKindPong is a sendnodes response received from a node.
+	ProbeKindPong
+)
+
+// ProbeResult is a ping sent to or a pong received from a DHT node.
+type ProbeResult struct {
+	Node *dht.Node
+	Kind ProbeKind
+	Time time.Time
+}
+
+// CleanReason is the reason a node address was removed by CleanInvalidNodes.
+type CleanReason string
+
+const (
+	CleanReasonInvalidPublicKey CleanReason = "invalid public key"
+	CleanReasonUnroutableIP     CleanReason = "unroutable ip"
+	CleanReasonReservedPort     CleanReason = "reserved port"
+)
+
+type CleanOptions struct {
+	// DryRun only reports what would be removed, without changing the db.
+	DryRun bool
+	// ReservedPorts also removes node addresses with a port below 1024. This
+	// is opt-in, because some legitimate nodes run on well-known ports like
+	// 443 to get through firewalls.
+	ReservedPorts bool
+}
+
+type CleanReport struct {
+	// Addresses holds the number of node addresses removed, by reason.
+	Addresses map[CleanReason]int
+	// Nodes is the number of nodes removed, because they had no addresses
+	// left.
+	Nodes int
+}
+
+const (
+	NodeStatusUp   = "up"
+	NodeStatusDown = "down"
+)
+
+// NodeStatuses are the valid values of NodeFilters.Status.
+var NodeStatuses = []string{NodeStatusUp, NodeStatusDown}
+
+// The protocols and address families that nodes can be filtered by.
+const (
+	NodeNetUDP     = "udp"
+	NodeNetTCP     = "tcp"
+	NodeFamilyIPv4 = "ipv4"
+	NodeFamilyIPv6 = "ipv6"
+)
+
+// NodeNets and NodeFamilies are the valid values of NodeFilters.Net and
+// NodeFilters.Family.
+var (
+	NodeNets     = []string{NodeNetUDP, NodeNetTCP}
+	NodeFamilies = []string{NodeFamilyIPv4, NodeFamilyIPv6}
+)
+
+// NodeFilters narrows down the nodes counted by CountNodes and returned by
+// GetNodesPage. The filters are combined: a node only matches if one of its
+// addresses matches Net and Family, and if Status is set, the node's status is
+// determined by those matching addresses alone. This way, a node that is up
+// over UDP but not over TCP is only up if filtered by UDP.
+type NodeFilters struct {
+	// Status only counts nodes that are up or down. A node is up if one of
+	// its addresses responded to us within NodeTimeout. An empty status
+	// counts all nodes.
+	Status string
+	// Net only counts nodes with an address of the given protocol.
+	Net string
+	// Family only counts nodes with an address of the given address family.
+	Family string
+}
+
+func (f *NodeFilters) validate() error {
+	if f.Status != "" && !slices.Contains(NodeStatuses, f.Status) {
+		return fmt.Errorf("bad node status: %s (must be one of: %s)", f.Status, strings.Join(NodeStatuses, ", "))
+	}
+	if f.Net != "" && !slices.Contains(NodeNets, f.Net) {
+		return fmt.Errorf("bad node net: %s (must be one of: %s)", f.Net, strings.Join(NodeNets, ", "))
+	}
+	if f.Family != "" && !slices.Contains(NodeFamilies, f.Family) {
+		return fmt.Errorf("bad node family: %s (must be one of: %s)", f.Family, strings.Join(NodeFamilies, ", "))
+	}
+	return nil
+}
+
+// nets returns the nets of the node addresses in the db that match the net and
+// family of the filters.
+func (f *NodeFilters) nets() []string {
+	nets := []string{NodeNetUDP, NodeNetTCP}
+	if f.Net != "" {
+		nets = []string{f.Net}
+	}
+	families := []string{"4", "6"}
+	switch f.Family {
+	case NodeFamilyIPv4:
+		families = []string{"4"}
+	case NodeFamilyIPv6:
+		families = []string{"6"}
+	}
+
+	var res []string
+	for _, net := range nets {
+		for _, family := range families {
+			res = append(res, net+family)
+		}
+	}
+	return res
+}
+
+// The orders that GetNodesPage can sort the nodes in. Both put the most
+// recent nodes first.
+const (
+	NodeSortLastSeen  = "last_seen"
+	NodeSortFirstSeen = "first_seen"
+)
+
+// NodeSorts are the valid values of PageOptions.Sort.
+var NodeSorts = []string{NodeSortLastSeen, NodeSortFirstSeen}
+
+// PageOptions selects the page of nodes returned by GetNodesPage.
+type PageOptions struct {
+	// Sort is the order to sort the nodes in. It defaults to NodeSortLastSeen.
+	Sort string
+	// Limit is the maximum number of nodes in the page. A negative limit
+	// returns all nodes after the offset.
+	Limit   int
+	Offset  int
+	Filters NodeFilters
+}
+
+// NodeStatusUnknown is the status of a node that hasn't been probed yet. It's
+// only reported by CapabilityMatrix. CountNodes counts these nodes as down.
+const NodeStatusUnknown = "unknown"
+
+// Capability is a way in which a node can be reached, as reported by
+// CapabilityMatrix.
+type Capability string
+
+const (
+	CapabilityUDP  Capability = "udp"
+	CapabilityTCP  Capability = "tcp"
+	CapabilityIPv4 Capability = "ipv4"
+	CapabilityIPv6 Capability = "ipv6"
+)
+
+var Capabilities = []Capability{CapabilityUDP, CapabilityTCP, CapabilityIPv4, CapabilityIPv6}
+
+// CapabilityStatuses are the statuses that CapabilityMatrix counts the nodes
+// by.
+var CapabilityStatuses = []string{NodeStatusUp, NodeStatusDown, NodeStatusUnknown}
+
+// CapabilityMatrix is the number of nodes with each capability, by status. A
+// node has a capability if at least one of its addresses has it, regardless
+// of whether that address is the one that responded to us.
+type CapabilityMatrix struct {
+	// Totals is the number of nodes with each status
+	Totals map[string]int64
+	// Counts is the number of nodes with each status, for each capability
+	Counts map[Capability]map[string]int64
+}
+
+// Total returns the total number of nodes.
+func (m *CapabilityMatrix) Total() int64 {
+	var total int64
+	for _, n := range m.Totals {
+		total += n
+	}
+	return total
+}
+
+// Percent returns the percentage of all nodes that have the given capability.
+func (m *CapabilityMatrix) Percent(c Capability) float64 {
+	total := m.Total()
+	if total == 0 {
+		return 0
+	}
+
+	var n int64
+	for _, count := range m.Counts[c] {
+		n += count
+	}
+	return float64(n) / float64(total) * 100
+}
+
+// AgeBucket is a range of node ages, as reported by AgeDistribution. The age
+// of a node is the time since it was first tracked.
+type AgeBucket struct {
+	// Min is the inclusive lower bound of the range.
+	Min time.Duration
+	// Max is the exclusive upper bound of the range. It's 0 for the last
+	// bucket, which has no upper bound.
+	Max   time.Duration
+	Count int
+}
+
+// ChurnWindow is the node turnover in a period of time, as reported by
+// ChurnReport.
+type ChurnWindow struct {
+	Start time.Time
+	End   time.Time
+	// New is the number of nodes that were first seen in the window.
+	New int
+	// Lost is the number of nodes that were last seen in the window, and are
+	// no longer online.
+	Lost int
+	// Total is the number of nodes that were known in the window: nodes that
+	// were first seen before it ended and last seen after it started.
+	Total int
+}
+
+// Rate returns the churn rate of the window: (new + lost) / total.
+func (w *ChurnWindow) Rate() float64 {
+	if w.Total == 0 {
+		return 0
+	}
+	return float64(w.New+w.Lost) / float64(w.Total)
+}
+
+// PeriodBucket is the number of nodes that were first seen in a period of
+// time, as reported by NewNodesPerPeriod.
+type PeriodBucket struct {
+	Start time.Time
+	End   time.Time
+	Count int
+}
+
+// Similarity is an attribute that a node has in common with another node, as
+// reported by FindSimilar.
+type Similarity string
+
+const (
+	// SimilarityVersion is a matching bootstrap node version.
+	SimilarityVersion Similarity = "version"
+	// SimilarityMOTD is a matching bootstrap node MOTD. Operators of multiple
+	// nodes tend to use the same MOTD for all of them.
+	SimilarityMOTD Similarity = "motd"
+	// SimilarityTransports is a matching set of transports (e.g. udp4 and
+	// tcp6) that the node is reachable over.
+	SimilarityTransports Similarity = "transports"
+	// SimilarityNetwork is an address in a shared IPv4 /24 or IPv6 /48
+	// network, which usually means that the nodes are hosted by the same
+	// provider.
+	SimilarityNetwork Similarity = "network"
+)
+
+// ScoredNode is a node found by FindSimilar. Its score is the number of
+// attributes that it has in common with the reference node.
+type ScoredNode struct {
+	Node    *models.Node
+	Matches []Similarity
+}
+
+func (n *ScoredNode) Score() int {
+	return len(n.Matches)
+}
+
+// DenseIP is an IP address that is shared by multiple nodes.
+type DenseIP struct {
+	IP         string
+	PublicKeys []*dht.PublicKey
+}
+
+// MergeResult describes a network address that was tracked for multiple nodes,
+// and how that was resolved.
+type MergeResult struct {
+	// Kept is the node address with the most probe history. It's kept.
+	Kept *models.NodeAddress
+	// Removed are the other node addresses with the same network address. They
+	// are deleted, along with their nodes if they have no addresses left.
+	Removed []*models.NodeAddress
+}
+
+var _ NodeRepository = (*NodesRepo)(nil)
+
 type NodesRepo struct {
-	wdb *sql.DB
-	rq  *db.Queries
-	wq  *db.Queries
+	wdb   db.WriteConn
+	rq    *db.Queries
+	wq    *db.Queries
+	clock clock.Clock
 }
 
 type nodeAddressCombo struct {
@@ -27,11 +358,12 @@ type nodeAddressCombo struct {
 	NodeAddress db.NodeAddress
 }
 
-func New(rdb *sql.DB, wdb *sql.DB) *NodesRepo {
+func New(rdb *sql.DB, wdb db.WriteConn) *NodesRepo {
 	return &NodesRepo{
-		wdb: wdb,
-		rq:  db.New(rdb),
-		wq:  db.New(wdb),
+		wdb:   wdb,
+		rq:    db.New(rdb),
+		wq:    db.New(wdb),
+		clock: clock.Real,
 	}
 }
 
@@ -54,6 +386,53 @@ func (r *NodesRepo) GetNodeByPublicKey(ctx context.Context, pk *dht.PublicKey) (
 	return node, nil
 }
 
+// ForEachNode calls fn for every known node, in order of their ID. Nodes are
+// read from the db in batches, so that memory usage stays bounded regardless
+// of the size of the node table.
+func (r *NodesRepo) ForEachNode(ctx context.Context, fn func(node *models.Node) error) error {
+	return r.ForEachNodeAfterID(ctx, 0, fn)
+}
+
+// ForEachNodeAfterID is like ForEachNode, but starts after the node with the
+// given ID.
+func (r *NodesRepo) ForEachNodeAfterID(ctx context.Context, afterID int64, fn func(node *models.Node) error) error {
+	const batchSize = 1000
+
+	for {
+		rows, err := r.rq.GetNodesAfterID(ctx, &db.GetNodesAfterIDParams{
+			AfterID:   afterID,
+			BatchSize: batchSize,
+		})
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			return nil
+		}
+
+		var node *models.Node
+		for _, row := range rows {
+			if node != nil && node.ID != row.Node.ID {
+				if err := fn(node); err != nil {
+					return err
+				}
+				node = nil
+			}
+			if node == nil {
+				node = convertNode(&row.Node)
+			}
+
+			addr := convertNodeAddress(node, &row.NodeAddress)
+			node.Addresses = append(node.Addresses, addr)
+		}
+		if err := fn(node); err != nil {
+			return err
+		}
+
+		afterID = node.ID
+	}
+}
+
 func (r *NodesRepo) HasNodeByPublicKey(ctx context.Context, pk *dht.PublicKey) (bool, error) {
 	res, err := r.rq.HasNodeByPublicKey(ctx, (*db.PublicKey)(pk))
 	if err != nil {
@@ -67,6 +446,332 @@ func (r *NodesRepo) GetNodeCount(ctx context.Context) (int64, error) {
 	return r.rq.GetNodeCount(ctx)
 }
 
+// CountNodes counts the nodes that match the given filters. If only the status
+// is filtered by, nodes without any addresses are counted as down.
+func (r *NodesRepo) CountNodes(ctx context.Context, filters NodeFilters) (int64, error) {
+	if filters.Net != "" || filters.Family != "" {
+		if err := filters.validate(); err != nil {
+			return 0, err
+		}
+		return r.countFilteredNodes(ctx, filters)
+	}
+
+	switch filters.Status {
+	case "":
+		return r.rq.GetNodeCount(ctx)
+	case NodeStatusUp:
+		return r.rq.GetOnlineNodeCount(ctx, NodeTimeout.Seconds())
+	case NodeStatusDown:
+		return r.rq.GetOfflineNodeCount(ctx, NodeTimeout.Seconds())
+	default:
+		return 0, fmt.Errorf("bad node status: %s (must be one of: %s)", filters.Status, strings.Join(NodeStatuses, ", "))
+	}
+}
+
+func (r *NodesRepo) countFilteredNodes(ctx context.Context, filters NodeFilters) (int64, error) {
+	rows, err := r.getNodesPage(ctx, PageOptions{Limit: 1, Filters: filters})
+	if err != nil || len(rows) == 0 {
+		return 0, err
+	}
+	return rows[0].Total, nil
+}
+
+func (r *NodesRepo) getNodesPage(ctx context.Context, opts PageOptions) ([]*db.GetNodesPageRow, error) {
+	return r.rq.GetNodesPage(ctx, &db.GetNodesPageParams{
+		Sort:        opts.Sort,
+		Status:      opts.Filters.Status,
+		PageOffset:  int64(opts.Offset),
+		PageSize:    int64(opts.Limit),
+		NodeTimeout: NodeTimeout.Seconds(),
+		Nets:        opts.Filters.nets(),
+	})
+}
+
+// GetNodesPage returns a page of the nodes that match the filters of the given
+// options, with all of their addresses, sorted as set in the options. It also
+// returns the total number of matching nodes. Nodes without any addresses
+// never match.
+func (r *NodesRepo) GetNodesPage(ctx context.Context, opts PageOptions) ([]*models.Node, int64, error) {
+	if err := opts.Filters.validate(); err != nil {
+		return nil, 0, err
+	}
+	if opts.Sort != "" && !slices.Contains(NodeSorts, opts.Sort) {
+		return nil, 0, fmt.Errorf("bad node sort: %s (must be one of: %s)", opts.Sort, strings.Join(NodeSorts, ", "))
+	}
+
+	rows, err := r.getNodesPage(ctx, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var nodes []*models.Node
+	var total int64
+	for _, row := range rows {
+		if len(nodes) == 0 || nodes[len(nodes)-1].ID != row.Node.ID {
+			nodes = append(nodes, convertNode(&row.Node))
+		}
+		node := nodes[len(nodes)-1]
+		node.Addresses = append(node.Addresses, convertNodeAddress(node, &row.NodeAddress))
+		total = row.Total
+	}
+
+	// The total comes with the rows of the page, so if the page is past the
+	// last matching node, it has to be obtained separately
+	if len(rows) == 0 && opts.Offset > 0 {
+		if total, err = r.countFilteredNodes(ctx, opts.Filters); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	return nodes, total, nil
+}
+
+// CapabilityMatrix counts the nodes by capability and status. A node is up if
+// one of its addresses responded to us within NodeTimeout, down if it was
+// probed but isn't up, and unknown if it hasn't been probed at all.
+func (r *NodesRepo) CapabilityMatrix(ctx context.Context) (*CapabilityMatrix, error) {
+	rows, err := r.rq.GetCapabilityCounts(ctx, NodeTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	m := &CapabilityMatrix{
+		Totals: make(map[string]int64),
+		Counts: make(map[Capability]map[string]int64),
+	}
+	for _, c := range Capabilities {
+		m.Counts[c] = make(map[string]int64)
+	}
+	for _, row := range rows {
+		m.Totals[row.Status] = row.Total
+		m.Counts[CapabilityUDP][row.Status] = row.Udp
+		m.Counts[CapabilityTCP][row.Status] = row.Tcp
+		m.Counts[CapabilityIPv4][row.Status] = row.Ipv4
+		m.Counts[CapabilityIPv6][row.Status] = row.Ipv6
+	}
+
+	return m, nil
+}
+
+// AgeDistribution counts the nodes by age. The given bounds must be positive
+// and in ascending order. They divide the ages into len(bounds)+1 buckets,
+// starting at 0 and ending with a bucket without an upper bound.
+func (r *NodesRepo) AgeDistribution(ctx context.Context, bounds []time.Duration) ([]*AgeBucket, error) {
+	for i, bound := range bounds {
+		if bound <= 0 || (i > 0 && bound <= bounds[i-1]) {
+			return nil, fmt.Errorf("bad age bucket bounds: %v (must be positive and ascending)", bounds)
+		}
+	}
+
+	times, err := r.rq.GetNodeCreationTimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	buckets := make([]*AgeBucket, 0, len(bounds)+1)
+	var lower time.Duration
+	for _, bound := range append(slices.Clone(bounds), 0) {
+		buckets = append(buckets, &AgeBucket{Min: lower, Max: bound})
+		lower = bound
+	}
+
+	now := r.clock.Now()
+	for _, t := range times {
+		age := now.Sub(time.Time(t))
+		i, _ := slices.BinarySearch(bounds, age)
+		// An age equal to a bound belongs to the bucket that starts at it
+		if i < len(bounds) && bounds[i] == age {
+			i++
+		}
+		buckets[i].Count++
+	}
+
+	return buckets, nil
+}
+
+// ChurnReport reports the node turnover in the given number of consecutive
+// windows of the given period, ending now, oldest first. A node was last seen
+// at the last time that its public key was seen in the DHT or that any of its
+// addresses responded to us, whichever is later.
+func (r *NodesRepo) ChurnReport(ctx context.Context, period time.Duration, windows int) ([]*ChurnWindow, error) {
+	if period <= 0 || windows <= 0 {
+		return nil, fmt.Errorf("bad churn report windows: %d of %s (must be positive)", windows, period)
+	}
+
+	rows, err := r.rq.GetNodeSeenTimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	type seenTimes struct {
+		CreatedAt  time.Time
+		LastSeenAt time.Time
+	}
+	nodes := make(map[int64]*seenTimes)
+	for _, row := range rows {
+		node, ok := nodes[row.ID]
+		if !ok {
+			node = &seenTimes{CreatedAt: time.Time(row.CreatedAt), LastSeenAt: time.Time(row.LastSeenAt)}
+			nodes[row.ID] = node
+		}
+		if pongAt := time.Time(row.LastPongAt); pongAt.After(node.LastSeenAt) {
+			node.LastSeenAt = pongAt
+		}
+	}
+
+	now := r.clock.Now()
+	res := make([]*ChurnWindow, 0, windows)
+	for i := windows; i > 0; i-- {
+		w := &ChurnWindow{
+			Start: now.Add(-time.Duration(i) * period),
+			End:   now.Add(-time.Duration(i-1) * period),
+		}
+		for _, node := range nodes {
+			if !node.CreatedAt.Before(w.End) || node.LastSeenAt.Before(w.Start) {
+				continue
+			}
+
+			w.Total++
+			if !node.CreatedAt.Before(w.Start) {
+				w.New++
+			}
+			if node.LastSeenAt.Before(w.End) && now.Sub(node.LastSeenAt) >= NodeTimeout {
+				w.Lost++
+			}
+		}
+		res = append(res, w)
+	}
+
+	return res, nil
+}
+
+// NewNodesPerPeriod counts the nodes that were first seen in each consecutive
+// bucket of the given size within the given window, ending now, oldest first.
+// If the window isn't a multiple of the bucket size, the remainder at the start
+// of the window is left out.
+func (r *NodesRepo) NewNodesPerPeriod(ctx context.Context, window time.Duration, bucketSize time.Duration) ([]*PeriodBucket, error) {
+	if bucketSize <= 0 || window < bucketSize {
+		return nil, fmt.Errorf("bad new nodes buckets: %s in %s (must be positive and fit in the window)", bucketSize, window)
+	}
+
+	times, err := r.rq.GetNodeCreationTimes(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := r.clock.Now()
+	n := int(window / bucketSize)
+	res := make([]*PeriodBucket, 0, n)
+	for i := n; i > 0; i-- {
+		res = append(res, &PeriodBucket{
+			Start: now.Add(-time.Duration(i) * bucketSize),
+			End:   now.Add(-time.Duration(i-1) * bucketSize),
+		})
+	}
+
+	start := res[0].Start
+	for _, t := range times {
+		createdAt := time.Time(t)
+		if createdAt.Before(start) || createdAt.After(now) {
+			continue
+		}
+		// A node created exactly now belongs to the last bucket
+		i := min(int(createdAt.Sub(start)/bucketSize), n-1)
+		res[i].Count++
+	}
+
+	return res, nil
+}
+
+// FindSimilar finds the nodes that have the most attributes in common with the
+// node with the given public key, up to the given limit. See Similarity for
+// the attributes that are compared. Nodes are ordered by descending score, and
+// then by the order in which they were first tracked. Nodes that have nothing
+// in common with the reference node are left out.
+func (r *NodesRepo) FindSimilar(ctx context.Context, pk *dht.PublicKey, limit int) ([]*ScoredNode, error) {
+	if limit <= 0 {
+		return nil, fmt.Errorf("bad limit: %d (must be positive)", limit)
+	}
+
+	ref, err := r.GetNodeByPublicKey(ctx, pk)
+	if err != nil {
+		return nil, err
+	}
+	refTransports := nodeTransports(ref)
+	refNetworks := make(map[string]bool)
+	for _, addr := range ref.Addresses {
+		refNetworks[addressNetwork(addr.IP)] = true
+	}
+
+	var res []*ScoredNode
+	err = r.ForEachNode(ctx, func(node *models.Node) error {
+		if node.ID == ref.ID {
+			return nil
+		}
+
+		var matches []Similarity
+		if ref.Version != 0 && node.Version == ref.Version {
+			matches = append(matches, SimilarityVersion)
+		}
+		if ref.MOTD != nil && *ref.MOTD != "" && node.MOTD != nil && *node.MOTD == *ref.MOTD {
+			matches = append(matches, SimilarityMOTD)
+		}
+		if slices.Equal(nodeTransports(node), refTransports) {
+			matches = append(matches, SimilarityTransports)
+		}
+		if slices.ContainsFunc(node.Addresses, func(addr *models.NodeAddress) bool {
+			return refNetworks[addressNetwork(addr.IP)]
+		}) {
+			matches = append(matches, SimilarityNetwork)
+		}
+
+		if len(matches) > 0 {
+			res = append(res, &ScoredNode{Node: node, Matches: matches})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// ForEachNode iterates in order of ID, so a stable sort keeps ties in the
+	// order in which the nodes were first tracked
+	slices.SortStableFunc(res, func(a, b *ScoredNode) int {
+		return b.Score() - a.Score()
+	})
+	if len(res) > limit {
+		res = res[:limit]
+	}
+
+	return res, nil
+}
+
+// nodeTransports returns the sorted, deduplicated list of networks that the
+// given node has addresses on.
+func nodeTransports(node *models.Node) []string {
+	var res []string
+	for _, addr := range node.Addresses {
+		res = append(res, addr.Net)
+	}
+	slices.Sort(res)
+	return slices.Compact(res)
+}
+
+// addressNetwork returns the /24 network of the given IPv4 address, or the /48
+// network of the given IPv6 address, in CIDR notation.
+func addressNetwork(s string) string {
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return s
+	}
+
+	mask := net.CIDRMask(48, 8*net.IPv6len)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, mask = ip4, net.CIDRMask(24, 8*net.IPv4len)
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
 func (r *NodesRepo) TrackDHTNode(ctx context.Context, node *dht.Node) (*models.Node, error) {
 	tx, err := r.wdb.Begin()
 	if err != nil {
@@ -133,9 +838,67 @@ func (r *NodesRepo) PongDHTNode(ctx context.Context, node *dht.Node) error {
 	return r.rq.PongNodeAddress(ctx, id)
 }
 
+// UpdateProbeResults records the ping and pong times of the given probe
+// results in a single transaction. This is a lot cheaper than calling
+// PingDHTNode or PongDHTNode for every result. Results for nodes that are not
+// tracked are skipped. If there were any, an error wrapping ErrNotFound is
+// returned after the other results were committed.
+func (r *NodesRepo) UpdateProbeResults(ctx context.Context, results []*ProbeResult) error {
+	tx, err := r.wdb.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var notFound int
+	q := r.wq.WithTx(tx)
+	for _, res := range results {
+		id, err := q.GetNodeAddress(ctx, &db.GetNodeAddressParams{
+			PublicKey: (*db.PublicKey)(res.Node.PublicKey),
+			Net:       res.Node.Type.Net(),
+			Ip:        res.Node.IP.String(),
+			Port:      int64(res.Node.Port),
+		})
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				notFound++
+				continue
+			}
+			return err
+		}
+
+		switch res.Kind {
+		case ProbeKindPing:
+			err = q.UpdateNodeAddressPingTime(ctx, &db.UpdateNodeAddressPingTimeParams{
+				ID:         id,
+				LastPingAt: db.Time(res.Time),
+			})
+		case ProbeKindPong:
+			err = q.UpdateNodeAddressPongTime(ctx, &db.UpdateNodeAddressPongTimeParams{
+				ID:         id,
+				LastPongAt: db.Time(res.Time),
+			})
+		default:
+			err = fmt.Errorf("bad probe kind: %d", res.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if notFound > 0 {
+		return fmt.Errorf("%d probe results for untracked nodes: %w", notFound, ErrNotFound)
+	}
+
+	return nil
+}
+
 func (r *NodesRepo) GetNodesWithStaleBootstrapInfo(ctx context.Context) ([]*models.Node, error) {
 	rows, err := r.rq.GetNodesWithStaleBootstrapInfo(ctx, &db.GetNodesWithStaleBootstrapInfoParams{
-		NodeTimeout:  (5 * time.Minute).Seconds(),
+		NodeTimeout:  NodeTimeout.Seconds(),
 		InfoInterval: (1 * time.Minute).Seconds(),
 	})
 	if err != nil {
@@ -157,6 +920,29 @@ func (r *NodesRepo) GetNodesWithStaleBootstrapInfo(ctx context.Context) ([]*mode
 	return maps.Values(nodes), nil
 }
 
+// GetOnlineNodes returns all nodes that have at least one address that
+// responded to us recently. Only the online addresses are included.
+func (r *NodesRepo) GetOnlineNodes(ctx context.Context) ([]*models.Node, error) {
+	rows, err := r.rq.GetOnlineNodes(ctx, NodeTimeout.Seconds())
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := make(map[dht.PublicKey]*models.Node)
+	for _, row := range rows {
+		node, ok := nodes[dht.PublicKey(*row.Node.PublicKey)]
+		if !ok {
+			node = convertNode(&row.Node)
+			nodes[*node.PublicKey] = node
+		}
+
+		addr := convertNodeAddress(node, &row.NodeAddress)
+		node.Addresses = append(node.Addresses, addr)
+	}
+
+	return maps.Values(nodes), nil
+}
+
 func (r *NodesRepo) UpdateNodeInfoRequestTime(ctx context.Context, addrReqTimes map[int64]time.Time) error {
 	tx, err := r.wdb.Begin()
 	if err != nil {
@@ -247,6 +1033,182 @@ func (r *NodesRepo) GetUnresponsiveDHTNodes(ctx context.Context, retryDelay time
 	return convertNodeAddressesToDHTNodes(combos)
 }
 
+// FindDuplicates returns the duplicate node addresses that
+// FindAndMergeDuplicates would resolve, without making any changes to the db.
+func (r *NodesRepo) FindDuplicates(ctx context.Context) ([]*MergeResult, error) {
+	return findDuplicates(ctx, r.rq)
+}
+
+// FindAndMergeDuplicates looks for network addresses (net, ip and port) that
+// were tracked for more than one node, which happens if a node operator
+// misconfigured their node or changes its keys. Only the node address with the
+// most probe history is kept. The rest is deleted in a single transaction.
+func (r *NodesRepo) FindAndMergeDuplicates(ctx context.Context) ([]*MergeResult, error) {
+	tx, err := r.wdb.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := r.wq.WithTx(tx)
+	results, err := findDuplicates(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, res := range results {
+		for _, addr := range res.Removed {
+			if err := q.DeleteNodeAddress(ctx, addr.ID); err != nil {
+				return nil, fmt.Errorf("delete node address: %w", err)
+			}
+			if err := q.DeleteNodeIfNoAddresses(ctx, addr.Node.ID); err != nil {
+				return nil, fmt.Errorf("delete node: %w", err)
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func findDuplicates(ctx context.Context, q *db.Queries) ([]*MergeResult, error) {
+	rows, err := q.GetDuplicateNodeAddresses(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows are ordered by network address, so duplicates are adjacent
+	var results []*MergeResult
+	var res *MergeResult
+	for _, row := range rows {
+		node := convertNode(&row.Node)
+		addr := convertNodeAddress(node, &row.NodeAddress)
+		node.Addresses = append(node.Addresses, addr)
+
+		if res == nil || res.Kept.Net != addr.Net || res.Kept.IP != addr.IP || res.Kept.Port != addr.Port {
+			res = &MergeResult{Kept: addr}
+			results = append(results, res)
+			continue
+		}
+
+		if hasMoreProbeHistory(addr, res.Kept) {
+			res.Removed = append(res.Removed, res.Kept)
+			res.Kept = addr
+		} else {
+			res.Removed = append(res.Removed, addr)
+		}
+	}
+
+	return results, nil
+}
+
+// hasMoreProbeHistory reports whether node address a has more probe history
+// than b. This is the case if it responded to us more recently or, if neither
+// did, if it has been known for longer.
+func hasMoreProbeHistory(a *models.NodeAddress, b *models.NodeAddress) bool {
+	if !a.LastPongAt.Equal(b.LastPongAt) {
+		return a.LastPongAt.After(b.LastPongAt)
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// GetDenseIPs returns the IP addresses that more than threshold distinct nodes
+// were seen on, along with the public keys of those nodes. Running a couple of
+// nodes on a single host is normal, but an unusually high number of them may
+// indicate a sybil attack.
+func (r *NodesRepo) GetDenseIPs(ctx context.Context, threshold int) ([]*DenseIP, error) {
+	rows, err := r.rq.GetSharedIPs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The rows are ordered by IP address
+	res := []*DenseIP{}
+	for i := 0; i < len(rows); {
+		ip := &DenseIP{IP: rows[i].Ip}
+		for ; i < len(rows) && rows[i].Ip == ip.IP; i++ {
+			ip.PublicKeys = append(ip.PublicKeys, (*dht.PublicKey)(rows[i].PublicKey))
+		}
+		if len(ip.PublicKeys) > threshold {
+			res = append(res, ip)
+		}
+	}
+
+	return res, nil
+}
+
+// CleanInvalidNodes removes node addresses that fail validation, along with
+// their nodes if they have no addresses left. Nodes with an invalid public key
+// are removed entirely. Such entries can't be produced by the crawler itself,
+// but may have been inserted by older versions or by hand.
+func (r *NodesRepo) CleanInvalidNodes(ctx context.Context, opts CleanOptions) (*CleanReport, error) {
+	tx, err := r.wdb.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := r.wq.WithTx(tx)
+	rows, err := q.GetNodeAddressesForCleaning(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	remaining := make(map[int64]int)
+	for _, row := range rows {
+		remaining[row.NodeID]++
+	}
+
+	report := &CleanReport{Addresses: make(map[CleanReason]int)}
+	for _, row := range rows {
+		reason, ok := validateNodeAddress(row, &opts)
+		if ok {
+			continue
+		}
+
+		report.Addresses[reason]++
+		if remaining[row.NodeID]--; remaining[row.NodeID] == 0 {
+			report.Nodes++
+		}
+		if opts.DryRun {
+			continue
+		}
+
+		if err := q.DeleteNodeAddress(ctx, row.ID); err != nil {
+			return nil, fmt.Errorf("delete node address: %w", err)
+		}
+		if err := q.DeleteNodeIfNoAddresses(ctx, row.NodeID); err != nil {
+			return nil, fmt.Errorf("delete node: %w", err)
+		}
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+func validateNodeAddress(row *db.GetNodeAddressesForCleaningRow, opts *CleanOptions) (CleanReason, bool) {
+	if pk, err := hex.DecodeString(row.RawPublicKey); err != nil || len(pk) != len(dht.PublicKey{}) {
+		return CleanReasonInvalidPublicKey, false
+	}
+	if ip := net.ParseIP(row.Ip); ip == nil || !models.IsGlobalUnicast(ip) {
+		return CleanReasonUnroutableIP, false
+	}
+	if opts.ReservedPorts && row.Port < 1024 {
+		return CleanReasonReservedPort, false
+	}
+
+	return "", true
+}
+
 func convertNodeAddressesToDHTNodes(rows []*nodeAddressCombo) ([]*dht.Node, error) {
 	// Only return a single address per node for now
 	nodes := make(map[dht.PublicKey]*dht.Node)
@@ -278,6 +1240,110 @@ func convertNodeAddressesToDHTNodes(rows []*nodeAddressCombo) ([]*dht.Node, erro
 	return maps.Values(nodes), nil
 }
 
+// GetRescan returns the most recent rescan, or ErrNotFound if there never was
+// one.
+func (r *NodesRepo) GetRescan(ctx context.Context) (*models.Rescan, error) {
+	rescan, err := r.rq.GetRescan(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+
+	return convertRescan(rescan), nil
+}
+
+// StartRescan starts a new rescan, replacing the previous one. It returns
+// ErrRescanRunning if the previous one hasn't finished or been canceled.
+func (r *NodesRepo) StartRescan(ctx context.Context) (*models.Rescan, error) {
+	tx, err := r.wdb.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	q := r.wq.WithTx(tx)
+	prev, err := q.GetRescan(ctx)
+	if err == nil {
+		if convertRescan(prev).Status() == models.RescanStatusRunning {
+			return nil, ErrRescanRunning
+		}
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("get rescan: %w", err)
+	}
+
+	total, err := q.GetNodeCount(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("get node count: %w", err)
+	}
+
+	rescan, err := q.StartRescan(ctx, total)
+	if err != nil {
+		return nil, fmt.Errorf("start rescan: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return convertRescan(rescan), nil
+}
+
+// UpdateRescanProgress saves the progress of the running rescan. It reports
+// false if there's no running rescan, because it was canceled in the meantime.
+func (r *NodesRepo) UpdateRescanProgress(ctx context.Context, lastNodeID int64, probed int) (bool, error) {
+	n, err := r.wq.UpdateRescanProgress(ctx, &db.UpdateRescanProgressParams{
+		LastNodeID: lastNodeID,
+		Probed:     int64(probed),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	return n > 0, nil
+}
+
+// FinishRescan marks the running rescan as finished. It returns ErrNotFound if
+// there's no running rescan.
+func (r *NodesRepo) FinishRescan(ctx context.Context) error {
+	n, err := r.wq.FinishRescan(ctx)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// CancelRescan marks the running rescan as canceled. A running crawler stops
+// probing for it once it notices. It returns ErrNotFound if there's no running
+// rescan.
+func (r *NodesRepo) CancelRescan(ctx context.Context) error {
+	n, err := r.wq.CancelRescan(ctx)
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+func convertRescan(rescan *db.Rescan) *models.Rescan {
+	return &models.Rescan{
+		StartedAt:  time.Time(rescan.StartedAt),
+		FinishedAt: time.Time(rescan.FinishedAt),
+		CanceledAt: time.Time(rescan.CanceledAt),
+		LastNodeID: rescan.LastNodeID,
+		Probed:     int(rescan.Probed),
+		Total:      int(rescan.Total),
+	}
+}
+
 func convertNode(dbNode *db.Node) *models.Node {
 	return &models.Node{
 		ID:            dbNode.ID,
@@ -5,9 +5,17 @@ import (
 	"context"
 	"crypto/rand"
 	"errors"
+	"fmt"
+	"maps"
 	"net"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/2mf/ToxStatus/internal/clock"
 	"github.com/2mf/ToxStatus/internal/db"
 	"github.com/2mf/ToxStatus/internal/models"
 	"github.com/alexbakker/tox4go/dht"
@@ -17,7 +25,7 @@ import (
 var ctx = context.Background()
 
 func init() {
-	db.RegisterPragmaHook(2000)
+	db.RegisterPragmaHook(2000, "normal")
 }
 
 func initRepo(t *testing.T) (repo *NodesRepo, close func() error) {
@@ -125,6 +133,478 @@ func TestHasNodeByPublicKey(t *testing.T) {
 	}
 }
 
+func TestGetNodesPage(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	// Nodes that were first seen in the order they were tracked in, but last
+	// seen in the opposite order
+	now := time.Now()
+	var keys []string
+	for i := 0; i < 5; i++ {
+		dhtNode := generateDHTNode(t)
+		node, err := repo.TrackDHTNode(ctx, dhtNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.wdb.ExecContext(ctx, "UPDATE node SET created_at = ?, last_seen_at = ? WHERE id = ?",
+			db.Time(now.Add(time.Duration(i-10)*time.Hour)), db.Time(now.Add(-time.Duration(i)*time.Hour)), node.ID); err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, dhtNode.PublicKey.String())
+	}
+	reversed := slices.Clone(keys)
+	slices.Reverse(reversed)
+
+	for _, tc := range []struct {
+		Opts     PageOptions
+		Expected []string
+	}{
+		{Opts: PageOptions{Limit: 2}, Expected: keys[:2]},
+		{Opts: PageOptions{Sort: NodeSortLastSeen, Limit: 2, Offset: 2}, Expected: keys[2:4]},
+		{Opts: PageOptions{Sort: NodeSortFirstSeen, Limit: 3}, Expected: reversed[:3]},
+		{Opts: PageOptions{Sort: NodeSortFirstSeen, Limit: 3, Offset: 3}, Expected: reversed[3:]},
+		{Opts: PageOptions{Limit: 2, Offset: 5}, Expected: nil},
+		{Opts: PageOptions{Limit: -1, Offset: 1}, Expected: keys[1:]},
+	} {
+		nodes, total, err := repo.GetNodesPage(ctx, tc.Opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if total != 5 {
+			t.Fatalf("%+v: unexpected total: %d", tc.Opts, total)
+		}
+
+		var res []string
+		for _, node := range nodes {
+			if len(node.Addresses) != 1 {
+				t.Fatalf("%+v: unexpected addresses of node %s: %v", tc.Opts, node.PublicKey, node.Addresses)
+			}
+			res = append(res, node.PublicKey.String())
+		}
+		if !slices.Equal(res, tc.Expected) {
+			t.Fatalf("%+v: expected %v, got %v", tc.Opts, tc.Expected, res)
+		}
+	}
+
+	if _, _, err := repo.GetNodesPage(ctx, PageOptions{Sort: "uptime", Limit: 1}); err == nil {
+		t.Fatal("expected error for bad sort")
+	}
+}
+
+func TestGetNodesPageFilters(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	// A node that's up over UDP, but has never responded over TCP, and a node
+	// that's only known by an IPv6 address that never responded
+	both := generateDHTNode(t)
+	bothTCP := *both
+	bothTCP.Type = dht.NodeTypeTCPIP4
+	ipv6 := generateDHTNode(t)
+	ipv6.Type = dht.NodeTypeUDPIP6
+	ipv6.IP = net.ParseIP("2001:db8::1")
+	for _, node := range []*dht.Node{both, &bothTCP, ipv6} {
+		if _, err := repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.PongDHTNode(ctx, both); err != nil {
+		t.Fatal(err)
+	}
+
+	bothKey, ipv6Key := both.PublicKey.String(), ipv6.PublicKey.String()
+	for _, tc := range []struct {
+		Filters  NodeFilters
+		Expected []string
+	}{
+		{Filters: NodeFilters{}, Expected: []string{bothKey, ipv6Key}},
+		{Filters: NodeFilters{Net: NodeNetUDP}, Expected: []string{bothKey, ipv6Key}},
+		{Filters: NodeFilters{Net: NodeNetTCP}, Expected: []string{bothKey}},
+		{Filters: NodeFilters{Net: NodeNetUDP, Status: NodeStatusUp}, Expected: []string{bothKey}},
+		{Filters: NodeFilters{Net: NodeNetTCP, Status: NodeStatusUp}, Expected: nil},
+		{Filters: NodeFilters{Net: NodeNetTCP, Status: NodeStatusDown}, Expected: []string{bothKey}},
+		{Filters: NodeFilters{Family: NodeFamilyIPv6}, Expected: []string{ipv6Key}},
+		{Filters: NodeFilters{Family: NodeFamilyIPv6, Status: NodeStatusUp}, Expected: nil},
+		{Filters: NodeFilters{Family: NodeFamilyIPv4, Net: NodeNetUDP, Status: NodeStatusUp}, Expected: []string{bothKey}},
+	} {
+		nodes, total, err := repo.GetNodesPage(ctx, PageOptions{Limit: 10, Filters: tc.Filters})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var res []string
+		for _, node := range nodes {
+			res = append(res, node.PublicKey.String())
+		}
+		slices.Sort(res)
+		slices.Sort(tc.Expected)
+		if !slices.Equal(res, tc.Expected) || total != int64(len(tc.Expected)) {
+			t.Fatalf("%+v: expected %v, got %v (total: %d)", tc.Filters, tc.Expected, res, total)
+		}
+
+		count, err := repo.CountNodes(ctx, tc.Filters)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != total {
+			t.Fatalf("%+v: expected a count of %d, got %d", tc.Filters, total, count)
+		}
+	}
+
+	for _, filters := range []NodeFilters{{Net: "sctp"}, {Family: "ipv5"}, {Status: "sideways", Net: NodeNetUDP}} {
+		if _, _, err := repo.GetNodesPage(ctx, PageOptions{Limit: 10, Filters: filters}); err == nil {
+			t.Fatalf("%+v: expected error for bad filters", filters)
+		}
+	}
+}
+
+func TestCountNodes(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	// A node that's online at one of its two addresses, a node that responded
+	// too long ago and a node that never responded
+	online := generateDHTNode(t)
+	onlineIPv6 := *online
+	onlineIPv6.Type = dht.NodeTypeUDPIP6
+	onlineIPv6.IP = net.ParseIP("2001:db8::1")
+	stale := generateDHTNode(t)
+	silent := generateDHTNode(t)
+	for _, node := range []*dht.Node{online, &onlineIPv6, stale, silent} {
+		if _, err := repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, node := range []*dht.Node{online, stale} {
+		if err := repo.PongDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	staleID, err := repo.getDHTNodeAddressID(ctx, stale)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.wdb.ExecContext(ctx, "UPDATE node_address SET last_pong_at = ? WHERE id = ?",
+		db.Time(time.Now().Add(-2*NodeTimeout)), staleID); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		Status string
+		Count  int64
+	}{
+		{Status: "", Count: 3},
+		{Status: NodeStatusUp, Count: 1},
+		{Status: NodeStatusDown, Count: 2},
+	} {
+		count, err := repo.CountNodes(ctx, NodeFilters{Status: tc.Status})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != tc.Count {
+			t.Fatalf("status %q: expected %d nodes, got %d", tc.Status, tc.Count, count)
+		}
+	}
+
+	if _, err := repo.CountNodes(ctx, NodeFilters{Status: "sideways"}); err == nil {
+		t.Fatal("expected error for bad status")
+	}
+}
+
+func TestCapabilityMatrix(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	m, err := repo.CapabilityMatrix(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Total() != 0 || m.Percent(CapabilityUDP) != 0 {
+		t.Fatalf("unexpected matrix for empty db: %+v", m)
+	}
+
+	// Every combination of transport and address family, with the status of
+	// the node derived from the probe of its first address
+	nodeTypes := []dht.NodeType{dht.NodeTypeUDPIP4, dht.NodeTypeUDPIP6, dht.NodeTypeTCPIP4, dht.NodeTypeTCPIP6}
+	statuses := []string{NodeStatusUp, NodeStatusDown, NodeStatusUnknown}
+	for i := 1; i < 1<<len(nodeTypes); i++ {
+		status := statuses[i%len(statuses)]
+		node := generateDHTNode(t)
+		var probed bool
+		for j, nodeType := range nodeTypes {
+			if i&(1<<j) == 0 {
+				continue
+			}
+
+			addr := *node
+			addr.Type = nodeType
+			if strings.HasSuffix(nodeType.Net(), "6") {
+				addr.IP = net.ParseIP(fmt.Sprintf("2001:db8::%x", i))
+			}
+			if _, err := repo.TrackDHTNode(ctx, &addr); err != nil {
+				t.Fatal(err)
+			}
+			if probed {
+				continue
+			}
+			probed = true
+
+			switch status {
+			case NodeStatusUp:
+				err = repo.PongDHTNode(ctx, &addr)
+			case NodeStatusDown:
+				err = repo.PingDHTNode(ctx, &addr)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	m, err = repo.CapabilityMatrix(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Total() != 15 {
+		t.Fatalf("unexpected total: %d", m.Total())
+	}
+	expectedTotals := map[string]int64{NodeStatusUp: 5, NodeStatusDown: 5, NodeStatusUnknown: 5}
+	if !maps.Equal(m.Totals, expectedTotals) {
+		t.Fatalf("unexpected totals: %v", m.Totals)
+	}
+
+	// Each single capability is present in 12 of the 15 combinations. The
+	// statuses cycle, so count them the same way the nodes were generated.
+	expected := make(map[Capability]map[string]int64)
+	for _, c := range Capabilities {
+		expected[c] = make(map[string]int64)
+	}
+	for i := 1; i < 1<<len(nodeTypes); i++ {
+		status := statuses[i%len(statuses)]
+		if i&0b0011 != 0 {
+			expected[CapabilityUDP][status]++
+		}
+		if i&0b1100 != 0 {
+			expected[CapabilityTCP][status]++
+		}
+		if i&0b0101 != 0 {
+			expected[CapabilityIPv4][status]++
+		}
+		if i&0b1010 != 0 {
+			expected[CapabilityIPv6][status]++
+		}
+	}
+	for _, c := range Capabilities {
+		if !maps.Equal(m.Counts[c], expected[c]) {
+			t.Fatalf("capability %s: expected %v, got %v", c, expected[c], m.Counts[c])
+		}
+		if percent := m.Percent(c); percent != 80 {
+			t.Fatalf("capability %s: unexpected percentage: %f", c, percent)
+		}
+	}
+}
+
+func TestNewNodesPerPeriod(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	now := time.Now().Truncate(time.Millisecond)
+	repo.clock = clock.NewFake(now)
+
+	// Nodes created exactly on the start of a bucket belong to it, and the
+	// one created before the window isn't counted
+	const day = 24 * time.Hour
+	for _, age := range []time.Duration{0, 2 * day, 5 * day, 12 * day, 30 * day, 31 * day} {
+		node, err := repo.TrackDHTNode(ctx, generateDHTNode(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		createdAt := db.Time(now.Add(-age))
+		if _, err := repo.wdb.ExecContext(ctx, "UPDATE node SET created_at = ? WHERE id = ?", createdAt, node.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buckets, err := repo.NewNodesPerPeriod(ctx, 30*day, 5*day)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []int{1, 0, 0, 1, 0, 3}
+	if len(buckets) != len(expected) {
+		t.Fatalf("expected %d buckets, got %d", len(expected), len(buckets))
+	}
+	for i, bucket := range buckets {
+		start := now.Add(-time.Duration(len(expected)-i) * 5 * day)
+		if !bucket.Start.Equal(start) || !bucket.End.Equal(start.Add(5*day)) || bucket.Count != expected[i] {
+			t.Fatalf("bucket %d: unexpected bucket: %+v", i, *bucket)
+		}
+	}
+
+	if _, err := repo.NewNodesPerPeriod(ctx, day, 5*day); err == nil {
+		t.Fatal("expected error for bucket size larger than the window")
+	}
+}
+
+func TestAgeDistribution(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	// Timestamps are read back from the db with millisecond precision, so
+	// truncate the time of the fake clock to make ages that are exactly on a
+	// bound
+	now := time.Now().Truncate(time.Millisecond)
+	repo.clock = clock.NewFake(now)
+
+	// The age of 7 days is on the bound between the first two buckets, so it
+	// belongs to the second one
+	const day = 24 * time.Hour
+	for _, age := range []time.Duration{0, 3 * day, 7 * day, 20 * day, 100 * day, 365 * day} {
+		node, err := repo.TrackDHTNode(ctx, generateDHTNode(t))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		createdAt := db.Time(now.Add(-age))
+		if _, err := repo.wdb.ExecContext(ctx, "UPDATE node SET created_at = ? WHERE id = ?", createdAt, node.ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	buckets, err := repo.AgeDistribution(ctx, []time.Duration{7 * day, 30 * day, 90 * day})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []AgeBucket{
+		{Min: 0, Max: 7 * day, Count: 2},
+		{Min: 7 * day, Max: 30 * day, Count: 2},
+		{Min: 30 * day, Max: 90 * day, Count: 0},
+		{Min: 90 * day, Max: 0, Count: 2},
+	}
+	if len(buckets) != len(expected) {
+		t.Fatalf("expected %d buckets, got %d", len(expected), len(buckets))
+	}
+	for i, bucket := range buckets {
+		if *bucket != expected[i] {
+			t.Fatalf("bucket %d: expected %+v, got %+v", i, expected[i], *bucket)
+		}
+	}
+
+	if _, err := repo.AgeDistribution(ctx, []time.Duration{30 * day, 7 * day}); err == nil {
+		t.Fatal("expected error for descending bounds")
+	}
+}
+
+func TestChurnReport(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	const day = 24 * time.Hour
+	for _, node := range []struct {
+		Created  time.Duration
+		LastSeen time.Duration
+		Pong     time.Duration
+	}{
+		// Known for a long time and still online through a recent pong
+		{Created: 30 * day, LastSeen: 30 * day, Pong: time.Minute},
+		// Appeared and disappeared during the previous week
+		{Created: 10 * day, LastSeen: 9 * day},
+		// Appeared in the previous week and disappeared this week
+		{Created: 8 * day, LastSeen: 2 * day},
+		// Appeared this week and still around
+		{Created: 1 * day, LastSeen: 0},
+	} {
+		dhtNode := generateDHTNode(t)
+		res, err := repo.TrackDHTNode(ctx, dhtNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		now := time.Now()
+		if _, err := repo.wdb.ExecContext(ctx, "UPDATE node SET created_at = ?, last_seen_at = ? WHERE id = ?",
+			db.Time(now.Add(-node.Created)), db.Time(now.Add(-node.LastSeen)), res.ID); err != nil {
+			t.Fatal(err)
+		}
+		if node.Pong != 0 {
+			if _, err := repo.wdb.ExecContext(ctx, "UPDATE node_address SET last_pong_at = ? WHERE node_id = ?",
+				db.Time(now.Add(-node.Pong)), res.ID); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	report, err := repo.ChurnReport(ctx, 7*day, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []struct {
+		New, Lost, Total int
+		Rate             float64
+	}{
+		{New: 0, Lost: 0, Total: 1, Rate: 0},
+		{New: 2, Lost: 1, Total: 3, Rate: 1},
+		{New: 1, Lost: 1, Total: 3, Rate: 2.0 / 3},
+	}
+	if len(report) != len(expected) {
+		t.Fatalf("expected %d windows, got %d", len(expected), len(report))
+	}
+	for i, w := range report {
+		if w.New != expected[i].New || w.Lost != expected[i].Lost || w.Total != expected[i].Total || w.Rate() != expected[i].Rate {
+			t.Fatalf("window %d: expected %+v, got %+v (rate %f)", i, expected[i], *w, w.Rate())
+		}
+	}
+}
+
+func TestFindSimilar(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	track := func(ip string, motd string, version uint32) *models.Node {
+		dhtNode := generateDHTNode(t)
+		dhtNode.IP = net.ParseIP(ip)
+		res, err := repo.TrackDHTNode(ctx, dhtNode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := repo.wdb.ExecContext(ctx, "UPDATE node SET motd = ?, version = ? WHERE id = ?", motd, version, res.ID); err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	ref := track("192.0.2.1", "hello", 2024010100)
+	// Same provider, MOTD and version as the reference node
+	cluster := track("192.0.2.2", "hello", 2024010100)
+	// Only the version and the transports match
+	version := track("198.51.100.1", "", 2024010100)
+	// Only the transports match
+	track("203.0.113.1", "", 1)
+
+	nodes, err := repo.FindSimilar(ctx, ref.PublicKey, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nodes) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(nodes))
+	}
+
+	expectedMatches := []Similarity{SimilarityVersion, SimilarityMOTD, SimilarityTransports, SimilarityNetwork}
+	if *nodes[0].Node.PublicKey != *cluster.PublicKey || !slices.Equal(nodes[0].Matches, expectedMatches) {
+		t.Fatalf("unexpected most similar node: %s %v", nodes[0].Node.PublicKey, nodes[0].Matches)
+	}
+	if *nodes[1].Node.PublicKey != *version.PublicKey || nodes[1].Score() != 2 {
+		t.Fatalf("unexpected second most similar node: %s %v", nodes[1].Node.PublicKey, nodes[1].Matches)
+	}
+
+	if _, err := repo.FindSimilar(ctx, generatePublicKey(t), 10); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+}
+
 func TestPongNonExistentNode(t *testing.T) {
 	repo, close := initRepo(t)
 	defer close()
@@ -140,3 +620,379 @@ func TestPongNonExistentNode(t *testing.T) {
 		t.Fatalf("expected error: '%v', got: %v", ErrNotFound, err)
 	}
 }
+
+func TestFindAndMergeDuplicates(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	// Nodes a, b and c share an address. Only a responded to us, so its
+	// address is the one that should be kept. Node c has another address, so
+	// it should survive the merge.
+	a, b, c, d := generateDHTNode(t), generateDHTNode(t), generateDHTNode(t), generateDHTNode(t)
+	b.IP, c.IP = a.IP, a.IP
+	cOther := *c
+	cOther.IP = generateIP(t)
+	for _, node := range []*dht.Node{a, b, c, &cOther, d} {
+		if _, err := repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := repo.PongDHTNode(ctx, a); err != nil {
+		t.Fatal(err)
+	}
+
+	checkResults := func(results []*MergeResult) {
+		if len(results) != 1 {
+			t.Fatalf("expected 1 duplicate, got %d", len(results))
+		}
+		res := results[0]
+		if *res.Kept.Node.PublicKey != *a.PublicKey {
+			t.Fatalf("unexpected node kept: %s", res.Kept.Node.PublicKey)
+		}
+		if len(res.Removed) != 2 {
+			t.Fatalf("expected 2 removed addresses, got %d", len(res.Removed))
+		}
+		for _, addr := range res.Removed {
+			if pk := *addr.Node.PublicKey; pk != *b.PublicKey && pk != *c.PublicKey {
+				t.Fatalf("unexpected node removed: %s", addr.Node.PublicKey)
+			}
+			if addr.IP != a.IP.String() || addr.Port != a.Port {
+				t.Fatalf("unexpected address removed: %s:%d", addr.IP, addr.Port)
+			}
+		}
+	}
+
+	results, err := repo.FindDuplicates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResults(results)
+
+	count, err := repo.GetNodeCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 4 {
+		t.Fatalf("expected 4 nodes before merge, got %d", count)
+	}
+
+	results, err = repo.FindAndMergeDuplicates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkResults(results)
+
+	for _, tc := range []struct {
+		Node      *dht.Node
+		Addresses int
+	}{{a, 1}, {b, 0}, {c, 1}, {d, 1}} {
+		node, err := repo.GetNodeByPublicKey(ctx, tc.Node.PublicKey)
+		if tc.Addresses == 0 {
+			if !errors.Is(err, ErrNotFound) {
+				t.Fatalf("expected error: '%v', got: %v", ErrNotFound, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(node.Addresses) != tc.Addresses {
+			t.Fatalf("expected %d addresses, got %d", tc.Addresses, len(node.Addresses))
+		}
+	}
+
+	if results, err = repo.FindDuplicates(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 0 {
+		t.Fatalf("expected no duplicates after merge, got %d", len(results))
+	}
+}
+
+func TestCleanInvalidNodes(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	// Random IPs may be private, so use fixed ones
+	valid := generateDHTNode(t)
+	valid.IP = net.IPv4(192, 0, 2, 10)
+	private := generateDHTNode(t)
+	private.IP = net.IPv4(10, 0, 0, 1)
+	reserved := generateDHTNode(t)
+	reserved.IP = net.IPv4(192, 0, 2, 11)
+	reserved.Port = 53
+	// This node has a valid address next to a loopback one, so it survives
+	mixed := generateDHTNode(t)
+	mixed.IP = net.IPv4(192, 0, 2, 12)
+	mixedLoopback := *mixed
+	mixedLoopback.IP = net.IPv4(127, 0, 0, 1)
+	for _, node := range []*dht.Node{valid, private, reserved, mixed, &mixedLoopback} {
+		if _, err := repo.TrackDHTNode(ctx, node); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The db only checks the length of public keys
+	res, err := repo.wdb.ExecContext(ctx, "INSERT INTO node(public_key) VALUES(?)", strings.Repeat("z", 64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	badKeyID, err := res.LastInsertId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.wdb.ExecContext(ctx, "INSERT INTO node_address(node_id, net, ip, port) VALUES(?, 'udp4', '192.0.2.1', 33445)", badKeyID); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := &CleanReport{
+		Addresses: map[CleanReason]int{
+			CleanReasonInvalidPublicKey: 1,
+			CleanReasonUnroutableIP:     2,
+			CleanReasonReservedPort:     1,
+		},
+		Nodes: 3,
+	}
+
+	report, err := repo.CleanInvalidNodes(ctx, CleanOptions{DryRun: true, ReservedPorts: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("expected report %+v, got %+v", expected, report)
+	}
+
+	count, err := repo.GetNodeCount(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Fatalf("expected 5 nodes after dry run, got %d", count)
+	}
+
+	if report, err = repo.CleanInvalidNodes(ctx, CleanOptions{ReservedPorts: true}); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("expected report %+v, got %+v", expected, report)
+	}
+
+	if count, err = repo.GetNodeCount(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Fatalf("expected 2 nodes after clean, got %d", count)
+	}
+
+	node, err := repo.GetNodeByPublicKey(ctx, mixed.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(node.Addresses) != 1 || node.Addresses[0].IP != mixed.IP.String() {
+		t.Fatalf("unexpected addresses left: %v", node.Addresses)
+	}
+}
+
+func BenchmarkRepo_BatchWrite(b *testing.B) {
+	const batchSize = 100
+
+	for _, mode := range []string{"off", "normal"} {
+		b.Run(fmt.Sprintf("synchronous=%s", mode), func(b *testing.B) {
+			// The synchronous mode only matters for databases on disk
+			readConn, writeConn, err := db.OpenReadWrite(ctx, filepath.Join(b.TempDir(), "bench.db"), db.OpenOptions{})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer readConn.Close()
+			defer writeConn.Close()
+
+			// The driver can only be registered once, so override the pragma
+			// set by the hook. This sticks, because there's only a single
+			// write connection.
+			if _, err := writeConn.ExecContext(ctx, fmt.Sprintf("PRAGMA synchronous = %s", mode)); err != nil {
+				b.Fatal(err)
+			}
+
+			repo := New(readConn, writeConn)
+			reqTimes := make(map[int64]time.Time)
+			for i := 0; i < batchSize; i++ {
+				ident, err := dht.NewIdentity(dht.IdentityOptions{})
+				if err != nil {
+					b.Fatal(err)
+				}
+
+				node, err := repo.TrackDHTNode(ctx, &dht.Node{
+					Type:      dht.NodeTypeUDPIP4,
+					PublicKey: ident.PublicKey,
+					IP:        net.IPv4(192, 0, 2, byte(i)),
+					Port:      33445,
+				})
+				if err != nil {
+					b.Fatal(err)
+				}
+				reqTimes[node.ID] = time.Time{}
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				now := time.Now()
+				for id := range reqTimes {
+					reqTimes[id] = now
+				}
+				if err := repo.UpdateNodeInfoRequestTime(ctx, reqTimes); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateProbeResults(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	tracked := generateDHTNode(t)
+	if _, err := repo.TrackDHTNode(ctx, tracked); err != nil {
+		t.Fatal(err)
+	}
+
+	pingTime := time.Now().Add(-time.Minute).Truncate(time.Second)
+	pongTime := time.Now().Truncate(time.Second)
+	err := repo.UpdateProbeResults(ctx, []*ProbeResult{
+		{Node: tracked, Kind: ProbeKindPing, Time: pingTime},
+		{Node: generateDHTNode(t), Kind: ProbeKindPong, Time: pongTime},
+		{Node: tracked, Kind: ProbeKindPong, Time: pongTime},
+	})
+	if !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected error: '%v', got: %v", ErrNotFound, err)
+	}
+
+	// The results for the tracked node should still have been written
+	node, err := repo.GetNodeByPublicKey(ctx, tracked.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := node.Addresses[0]
+	if !addr.LastPingAt.Equal(pingTime) {
+		t.Fatalf("unexpected ping time: %s (expected %s)", addr.LastPingAt, pingTime)
+	}
+	if !addr.LastPongAt.Equal(pongTime) {
+		t.Fatalf("unexpected pong time: %s (expected %s)", addr.LastPongAt, pongTime)
+	}
+}
+
+func BenchmarkRepo_ProbeResults(b *testing.B) {
+	const batchSize = 100
+
+	readConn, writeConn, err := db.OpenReadWrite(ctx, filepath.Join(b.TempDir(), "bench.db"), db.OpenOptions{})
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer readConn.Close()
+	defer writeConn.Close()
+
+	repo := New(readConn, writeConn)
+	var nodes []*dht.Node
+	for i := 0; i < batchSize; i++ {
+		ident, err := dht.NewIdentity(dht.IdentityOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		node := &dht.Node{
+			Type:      dht.NodeTypeUDPIP4,
+			PublicKey: ident.PublicKey,
+			IP:        net.IPv4(192, 0, 2, byte(i)),
+			Port:      33445,
+		}
+		if _, err := repo.TrackDHTNode(ctx, node); err != nil {
+			b.Fatal(err)
+		}
+		nodes = append(nodes, node)
+	}
+
+	b.Run("direct", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, node := range nodes {
+				if err := repo.PingDHTNode(ctx, node); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batched", func(b *testing.B) {
+		results := make([]*ProbeResult, len(nodes))
+		for i := 0; i < b.N; i++ {
+			now := time.Now()
+			for j, node := range nodes {
+				results[j] = &ProbeResult{Node: node, Kind: ProbeKindPing, Time: now}
+			}
+			if err := repo.UpdateProbeResults(ctx, results); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestRescan(t *testing.T) {
+	repo, close := initRepo(t)
+	defer close()
+
+	if _, err := repo.GetRescan(ctx); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		if _, err := repo.TrackDHTNode(ctx, generateDHTNode(t)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rescan, err := repo.StartRescan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescan.Status() != models.RescanStatusRunning || rescan.Total != 3 {
+		t.Fatalf("unexpected rescan: %+v", rescan)
+	}
+	if _, err := repo.StartRescan(ctx); !errors.Is(err, ErrRescanRunning) {
+		t.Fatalf("expected rescan running error, got: %v", err)
+	}
+
+	if ok, err := repo.UpdateRescanProgress(ctx, 2, 2); err != nil || !ok {
+		t.Fatalf("unable to update progress: %t %v", ok, err)
+	}
+	if err := repo.CancelRescan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := repo.UpdateRescanProgress(ctx, 3, 3); err != nil || ok {
+		t.Fatalf("updated progress of canceled rescan: %t %v", ok, err)
+	}
+	if err := repo.CancelRescan(ctx); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+
+	rescan, err = repo.GetRescan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescan.Status() != models.RescanStatusCanceled || rescan.LastNodeID != 2 || rescan.Probed != 2 {
+		t.Fatalf("unexpected canceled rescan: %+v", rescan)
+	}
+
+	// Starting a new rescan resets the progress
+	rescan, err = repo.StartRescan(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rescan.Status() != models.RescanStatusRunning || rescan.LastNodeID != 0 || rescan.Probed != 0 {
+		t.Fatalf("unexpected restarted rescan: %+v", rescan)
+	}
+	if err := repo.FinishRescan(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if rescan, err = repo.GetRescan(ctx); err != nil || rescan.Status() != models.RescanStatusFinished {
+		t.Fatalf("unexpected finished rescan: %+v %v", rescan, err)
+	}
+}
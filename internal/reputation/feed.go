@@ -0,0 +1,128 @@
+// Package reputation implements IP reputation feeds: lists of IP ranges that
+// are known to be used for abuse, maintained by an external source.
+package reputation
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Feed is a list of flagged IP ranges, loaded from a file with one CIDR or IP
+// address per line. Empty lines and lines starting with # are ignored. The
+// file is expected to be updated by an external process, so it can be
+// reloaded at any time.
+type Feed struct {
+	file string
+
+	m       sync.RWMutex
+	nets    []*net.IPNet
+	modTime time.Time
+}
+
+// Load reads the feed from the given file.
+func Load(file string) (*Feed, error) {
+	f := &Feed{file: file}
+	if _, err := f.Reload(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// Reload reads the feed file again if it was modified since it was last
+// loaded. It reports whether the feed was reloaded. If the file can't be read
+// or parsed, the previously loaded list is kept.
+func (f *Feed) Reload() (bool, error) {
+	fi, err := os.Stat(f.file)
+	if err != nil {
+		return false, err
+	}
+
+	f.m.RLock()
+	unchanged := fi.ModTime().Equal(f.modTime)
+	f.m.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	data, err := os.ReadFile(f.file)
+	if err != nil {
+		return false, err
+	}
+
+	nets, err := parse(bytes.NewReader(data))
+	if err != nil {
+		return false, fmt.Errorf("parse reputation feed %s: %w", f.file, err)
+	}
+
+	f.m.Lock()
+	f.nets = nets
+	f.modTime = fi.ModTime()
+	f.m.Unlock()
+	return true, nil
+}
+
+// Contains reports whether the given IP address is in one of the flagged
+// ranges.
+func (f *Feed) Contains(ip net.IP) bool {
+	f.m.RLock()
+	defer f.m.RUnlock()
+
+	for _, ipNet := range f.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Len returns the number of flagged ranges.
+func (f *Feed) Len() int {
+	f.m.RLock()
+	defer f.m.RUnlock()
+	return len(f.nets)
+}
+
+func parse(r io.Reader) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for i := 1; scanner.Scan(); i++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if !strings.Contains(line, "/") {
+			ip := net.ParseIP(line)
+			if ip == nil {
+				return nil, fmt.Errorf("line %d: bad ip: %s", i, line)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i, err)
+		}
+		nets = append(nets, ipNet)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return nets, nil
+}
@@ -0,0 +1,75 @@
+package reputation
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFeed(t *testing.T, file string, data string, modTime time.Time) {
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(file, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFeed(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "feed.txt")
+	now := time.Now()
+	writeFeed(t, file, "# Known abusers\n192.0.2.0/24\n\n2001:db8::1\n198.51.100.7\n", now)
+
+	feed, err := Load(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feed.Len() != 3 {
+		t.Fatalf("expected 3 ranges, got %d", feed.Len())
+	}
+
+	for ip, flagged := range map[string]bool{
+		"192.0.2.42":   true,
+		"198.51.100.7": true,
+		"198.51.100.8": false,
+		"2001:db8::1":  true,
+		"2001:db8::2":  false,
+		"203.0.113.1":  false,
+	} {
+		if feed.Contains(net.ParseIP(ip)) != flagged {
+			t.Fatalf("expected %s flagged: %t", ip, flagged)
+		}
+	}
+
+	// An unchanged file is not reloaded
+	reloaded, err := feed.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reloaded {
+		t.Fatal("unexpected reload of unchanged feed")
+	}
+
+	// A broken update keeps the previous list around
+	writeFeed(t, file, "203.0.113.0/24\nnonsense\n", now.Add(time.Second))
+	if _, err := feed.Reload(); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected parse error on line 2, got: %v", err)
+	}
+	if !feed.Contains(net.ParseIP("192.0.2.42")) {
+		t.Fatal("expected previous list to be kept")
+	}
+
+	writeFeed(t, file, "203.0.113.0/24\n", now.Add(2*time.Second))
+	if reloaded, err = feed.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !reloaded {
+		t.Fatal("expected feed to be reloaded")
+	}
+	if feed.Contains(net.ParseIP("192.0.2.42")) || !feed.Contains(net.ParseIP("203.0.113.1")) {
+		t.Fatal("unexpected contents after reload")
+	}
+}
@@ -0,0 +1,152 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+)
+
+// inheritEnv is the environment variable that signals to a new process that it
+// was started by a parent process that passed its sockets along. The sockets
+// are passed as the first extra file descriptors, in a fixed order.
+const inheritEnv = "TOXSTATUS_INHERIT_SOCKETS"
+
+const (
+	toxUDPFd = 3
+	httpFd   = 4
+)
+
+// Sockets are the listening sockets of a toxstatus process, which can be handed
+// over to a new process to restart without dropping the Tox UDP socket.
+type Sockets struct {
+	ToxUDP *net.UDPConn
+	HTTP   *net.TCPListener
+}
+
+// ListenSockets binds a new set of sockets to the given addresses.
+func ListenSockets(toxUDPAddr string, httpAddr string, opts SocketOptions) (*Sockets, error) {
+	lc := net.ListenConfig{Control: opts.udpControl}
+	packetConn, err := lc.ListenPacket(context.Background(), "udp", toxUDPAddr)
+	if err != nil {
+		return nil, fmt.Errorf("tox udp listen: %w", err)
+	}
+	udpConn := packetConn.(*net.UDPConn)
+
+	tcpAddr, err := net.ResolveTCPAddr("tcp", httpAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, err
+	}
+
+	httpListener, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("http listen: %w", err)
+	}
+
+	return &Sockets{ToxUDP: udpConn, HTTP: httpListener}, nil
+}
+
+// InheritSockets returns the sockets that were passed to this process by its
+// parent process. If no sockets were passed, nil is returned.
+func InheritSockets() (*Sockets, error) {
+	if os.Getenv(inheritEnv) == "" {
+		return nil, nil
+	}
+
+	// Make sure the sockets don't get passed along to any other child process
+	if err := os.Unsetenv(inheritEnv); err != nil {
+		return nil, err
+	}
+
+	return socketsFromFiles(
+		os.NewFile(toxUDPFd, "tox-udp"),
+		os.NewFile(httpFd, "http"),
+	)
+}
+
+// Exec starts a new instance of the running executable, with the same
+// arguments, and passes the sockets along to it. The caller is responsible for
+// shutting down once the new process has started.
+func (s *Sockets) Exec() (*os.Process, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), inheritEnv+"=1")
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.ExtraFiles = files
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	return cmd.Process, nil
+}
+
+// files returns duplicates of the file descriptors of the sockets, in the order
+// in which they're expected by InheritSockets.
+func (s *Sockets) files() ([]*os.File, error) {
+	udpFile, err := s.ToxUDP.File()
+	if err != nil {
+		return nil, fmt.Errorf("tox udp socket file: %w", err)
+	}
+
+	httpFile, err := s.HTTP.File()
+	if err != nil {
+		udpFile.Close()
+		return nil, fmt.Errorf("http socket file: %w", err)
+	}
+
+	return []*os.File{udpFile, httpFile}, nil
+}
+
+func socketsFromFiles(udpFile *os.File, httpFile *os.File) (*Sockets, error) {
+	defer udpFile.Close()
+	defer httpFile.Close()
+
+	packetConn, err := net.FilePacketConn(udpFile)
+	if err != nil {
+		return nil, fmt.Errorf("inherit tox udp socket: %w", err)
+	}
+	udpConn, ok := packetConn.(*net.UDPConn)
+	if !ok {
+		packetConn.Close()
+		return nil, errors.New("inherit tox udp socket: not a udp socket")
+	}
+
+	listener, err := net.FileListener(httpFile)
+	if err != nil {
+		udpConn.Close()
+		return nil, fmt.Errorf("inherit http socket: %w", err)
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		udpConn.Close()
+		listener.Close()
+		return nil, errors.New("inherit http socket: not a tcp socket")
+	}
+
+	return &Sockets{ToxUDP: udpConn, HTTP: tcpListener}, nil
+}
+
+// Close closes all sockets.
+func (s *Sockets) Close() error {
+	return errors.Join(s.ToxUDP.Close(), s.HTTP.Close())
+}
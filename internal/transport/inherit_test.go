@@ -0,0 +1,84 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestSocketsSurviveHandover(t *testing.T) {
+	sockets, err := ListenSockets("127.0.0.1:0", "127.0.0.1:0", SocketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := sockets.files()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// This mimics what happens to the sockets of the old process after it has
+	// started the new one
+	udpAddr := sockets.ToxUDP.LocalAddr().(*net.UDPAddr)
+	httpAddr := sockets.HTTP.Addr().String()
+	if err := sockets.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	inherited, err := socketsFromFiles(files[0], files[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer inherited.Close()
+
+	if inherited.ToxUDP.LocalAddr().String() != udpAddr.String() {
+		t.Fatalf("expected udp addr %s, got %s", udpAddr, inherited.ToxUDP.LocalAddr())
+	}
+
+	client, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	data := []byte("ping")
+	if _, err := client.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	inherited.ToxUDP.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 64)
+	n, _, err := inherited.ToxUDP.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], data) {
+		t.Fatalf("unexpected packet data: %q", buf[:n])
+	}
+
+	conn, err := net.Dial("tcp", httpAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	inherited.HTTP.SetDeadline(time.Now().Add(5 * time.Second))
+	accepted, err := inherited.HTTP.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+}
+
+func TestInheritSocketsWithoutParent(t *testing.T) {
+	t.Setenv(inheritEnv, "")
+
+	sockets, err := InheritSockets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sockets != nil {
+		t.Fatal("expected no inherited sockets")
+	}
+}
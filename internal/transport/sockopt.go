@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// SocketOptions are the options that ListenSockets applies to the sockets
+// before binding them.
+type SocketOptions struct {
+	// BindDevice is the name of the network interface to bind the Tox UDP
+	// socket to, so that all Tox traffic goes through it. Only supported on
+	// Linux.
+	BindDevice string
+	// ReusePort sets SO_REUSEPORT on the Tox UDP socket, so that multiple
+	// processes can bind the same port. If the OS doesn't support it,
+	// ListenSockets returns an error that wraps errors.ErrUnsupported.
+	ReusePort bool
+}
+
+// udpControl is used as the Control function of the net.ListenConfig for the
+// Tox UDP socket.
+func (o *SocketOptions) udpControl(network string, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		if o.BindDevice != "" {
+			if err = bindToDevice(fd, o.BindDevice); err != nil {
+				err = fmt.Errorf("bind to device %s: %w", o.BindDevice, err)
+				return
+			}
+		}
+		if o.ReusePort {
+			if err = reusePort(fd); err != nil {
+				err = fmt.Errorf("set SO_REUSEPORT: %w", err)
+			}
+		}
+	}); cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// SetRecvBufSize sets the size of the OS receive buffer of the given UDP
+// socket. It returns the size that the OS actually applied, which may differ
+// from the requested size: Linux doubles it to make room for bookkeeping, and
+// caps it at net.core.rmem_max. If the actual size can't be determined on this
+// platform, the requested size is returned.
+func SetRecvBufSize(conn *net.UDPConn, size int) (int, error) {
+	if err := conn.SetReadBuffer(size); err != nil {
+		return 0, fmt.Errorf("set udp receive buffer size: %w", err)
+	}
+
+	actual, err := getRecvBufSize(conn)
+	if errors.Is(err, errors.ErrUnsupported) {
+		return size, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("get udp receive buffer size: %w", err)
+	}
+
+	return actual, nil
+}
@@ -0,0 +1,26 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// BindDeviceSupported reports whether SocketOptions.BindDevice is supported on
+// this platform.
+const BindDeviceSupported = true
+
+func bindToDevice(fd uintptr, device string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, device)
+}
+
+func reusePort(fd uintptr) error {
+	err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+	// Kernels older than 3.9 don't know about the option
+	if errors.Is(err, syscall.ENOPROTOOPT) {
+		return fmt.Errorf("%w: %w", errors.ErrUnsupported, err)
+	}
+	return err
+}
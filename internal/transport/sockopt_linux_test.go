@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+)
+
+func TestListenSocketsBindDevice(t *testing.T) {
+	sockets, err := ListenSockets("127.0.0.1:0", "127.0.0.1:0", SocketOptions{BindDevice: "lo"})
+	if errors.Is(err, syscall.EPERM) {
+		t.Skip("binding to a device requires CAP_NET_RAW on this kernel")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	sockets.Close()
+
+	if _, err := ListenSockets("127.0.0.1:0", "127.0.0.1:0", SocketOptions{BindDevice: "nonexistent0"}); !errors.Is(err, syscall.ENODEV) {
+		t.Fatalf("expected no such device error, got: %v", err)
+	}
+}
+
+func TestListenSocketsReusePort(t *testing.T) {
+	opts := SocketOptions{ReusePort: true}
+	first, err := ListenSockets("127.0.0.1:0", "127.0.0.1:0", opts)
+	if errors.Is(err, errors.ErrUnsupported) {
+		t.Skip("SO_REUSEPORT is not supported by this kernel")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+
+	addr := first.ToxUDP.LocalAddr().String()
+	second, err := ListenSockets(addr, "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.Close()
+
+	// Both sockets need the option to be able to share the port
+	if _, err := ListenSockets(addr, "127.0.0.1:0", SocketOptions{}); !errors.Is(err, syscall.EADDRINUSE) {
+		t.Fatalf("expected address in use error, got: %v", err)
+	}
+}
+
+func TestSetRecvBufSize(t *testing.T) {
+	sockets, err := ListenSockets("127.0.0.1:0", "127.0.0.1:0", SocketOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sockets.Close()
+
+	// Stay well below the default net.core.rmem_max, so that the size isn't
+	// capped
+	const size = 16384
+	actual, err := SetRecvBufSize(sockets.ToxUDP, size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if actual != 2*size {
+		t.Fatalf("unexpected receive buffer size: %d (expected %d)", actual, 2*size)
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package transport
+
+import "errors"
+
+// BindDeviceSupported reports whether SocketOptions.BindDevice is supported on
+// this platform.
+const BindDeviceSupported = false
+
+func bindToDevice(fd uintptr, device string) error {
+	return errors.New("binding to a device is only supported on Linux")
+}
+
+func reusePort(fd uintptr) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,95 @@
+package transport
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+
+	"github.com/alexbakker/tox4go/transport"
+)
+
+// DefaultReadBufferSize is large enough to hold any packet of the Tox DHT and
+// bootstrap protocols.
+const DefaultReadBufferSize = 2048
+
+// UDPTransport is a Tox transport that operates on an existing UDP socket. In
+// contrast to the UDP transport of tox4go, it doesn't bind the socket itself.
+// This allows the socket to be configured beforehand, or to be inherited from a
+// parent process.
+type UDPTransport struct {
+	conn     *net.UDPConn
+	stopChan chan struct{}
+	handler  transport.PacketHandler
+	opts     UDPTransportOptions
+
+	truncated atomic.Uint64
+}
+
+type UDPTransportOptions struct {
+	// ReadBufferSize is the size of the buffer that incoming packets are read
+	// into. Packets that don't fit are truncated by the kernel. Those are
+	// dropped and counted. Defaults to DefaultReadBufferSize.
+	ReadBufferSize int
+}
+
+func NewUDPTransport(conn *net.UDPConn, handler transport.PacketHandler, opts UDPTransportOptions) *UDPTransport {
+	if opts.ReadBufferSize == 0 {
+		opts.ReadBufferSize = DefaultReadBufferSize
+	}
+
+	return &UDPTransport{
+		conn:     conn,
+		stopChan: make(chan struct{}),
+		handler:  handler,
+		opts:     opts,
+	}
+}
+
+func (t *UDPTransport) SendPacket(data []byte, addr *net.UDPAddr) error {
+	_, err := t.conn.WriteTo(data, addr)
+	return err
+}
+
+func (t *UDPTransport) HandlePacket(data []byte, addr *net.UDPAddr) {
+	t.handler(data, addr)
+}
+
+func (t *UDPTransport) Listen() error {
+	buf := make([]byte, t.opts.ReadBufferSize)
+	for {
+		read, _, flags, senderAddr, err := t.conn.ReadMsgUDP(buf, nil)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				close(t.stopChan)
+			}
+			return err
+		}
+
+		if read < 1 {
+			continue
+		}
+
+		// A truncated packet can't be decrypted, so there's no point in
+		// passing it on to the handler
+		if flags&msgTrunc != 0 {
+			t.truncated.Add(1)
+			continue
+		}
+
+		t.HandlePacket(buf[:read], senderAddr)
+	}
+}
+
+// TruncatedPackets returns the number of packets that were dropped so far,
+// because they didn't fit in the read buffer.
+func (t *UDPTransport) TruncatedPackets() uint64 {
+	return t.truncated.Load()
+}
+
+// Close closes the underlying UDP socket. It waits for Listen to return, so it
+// must only be called after Listen was started.
+func (t *UDPTransport) Close() error {
+	err := t.conn.Close()
+	<-t.stopChan
+	return err
+}
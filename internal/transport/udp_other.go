@@ -0,0 +1,15 @@
+//go:build !unix
+
+package transport
+
+import (
+	"errors"
+	"net"
+)
+
+// Truncation of received packets can't be detected on this platform
+const msgTrunc = 0
+
+func getRecvBufSize(conn *net.UDPConn) (int, error) {
+	return 0, errors.ErrUnsupported
+}
@@ -0,0 +1,54 @@
+package transport
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUDPTransportDropsTruncatedPackets(t *testing.T) {
+	if msgTrunc == 0 {
+		t.Skip("truncation detection is not supported on this platform")
+	}
+
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	packets := make(chan []byte, 2)
+	tp := NewUDPTransport(conn, func(data []byte, addr *net.UDPAddr) {
+		cdata := make([]byte, len(data))
+		copy(cdata, data)
+		packets <- cdata
+	}, UDPTransportOptions{ReadBufferSize: 8})
+	go tp.Listen()
+	defer tp.Close()
+
+	client, err := net.DialUDP("udp", nil, conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	small := []byte("ping")
+	for _, data := range [][]byte{bytes.Repeat([]byte{1}, 16), small} {
+		if _, err := client.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case data := <-packets:
+		if !bytes.Equal(data, small) {
+			t.Fatalf("unexpected packet data: %q", data)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for packet")
+	}
+
+	if n := tp.TruncatedPackets(); n != 1 {
+		t.Fatalf("expected 1 truncated packet, got %d", n)
+	}
+}
@@ -0,0 +1,26 @@
+//go:build unix
+
+package transport
+
+import (
+	"net"
+	"syscall"
+)
+
+const msgTrunc = syscall.MSG_TRUNC
+
+func getRecvBufSize(conn *net.UDPConn) (int, error) {
+	rawConn, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int
+	if cerr := rawConn.Control(func(fd uintptr) {
+		size, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF)
+	}); cerr != nil {
+		return 0, cerr
+	}
+
+	return size, err
+}